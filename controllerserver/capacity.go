@@ -0,0 +1,124 @@
+package controllerserver
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/smb-csi-driver/nodeserver"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultCapacityCacheTTL is how long GetCapacity reports the free space of a share before it mounts it again.
+const DefaultCapacityCacheTTL = time.Minute
+
+type capacityEntry struct {
+	availableBytes int64
+	expires        time.Time
+}
+
+// capacityCache remembers the free space of shares.
+type capacityCache struct {
+	lock       sync.Mutex
+	capacities map[string]capacityEntry
+}
+
+func newCapacityCache() *capacityCache {
+	return &capacityCache{capacities: map[string]capacityEntry{}}
+}
+
+func (s *capacityCache) capacity(share string, now time.Time) (int64, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, ok := s.capacities[share]
+	if !ok || !now.Before(entry.expires) {
+		return 0, false
+	}
+	return entry.availableBytes, true
+}
+
+func (s *capacityCache) setCapacity(share string, availableBytes int64, expires time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.capacities[share] = capacityEntry{availableBytes: availableBytes, expires: expires}
+}
+
+// ReadSecretsDir reads the secrets GetCapacity mounts shares with from a directory holding one file per secret, such
+// as a Kubernetes secret mounted as a volume. Hidden entries, like the ..data link of such a volume, are skipped.
+func ReadSecretsDir(ioutilshim ioutilshim.Ioutil, dir string) (map[string]string, error) {
+	entries, err := ioutilshim.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := map[string]string{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || entry.IsDir() {
+			continue
+		}
+		data, err := ioutilshim.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		secrets[entry.Name()] = string(data)
+	}
+	return secrets, nil
+}
+
+// GetCapacity reports the free space of the share of a StorageClass. GetCapacity requests carry no secrets, so the share
+// is mounted with the CapacitySecrets of the controller. The free space is cached for the CapacityCacheTTL of the
+// controller, so that the share is not mounted for every call.
+func (c *smbControllerServer) GetCapacity(ctx context.Context, r *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	if c.config.CapacitySecrets == nil {
+		return nil, status.Error(codes.Unimplemented, "Error: the controller has no secrets to measure the capacity of shares with")
+	}
+	share := strings.TrimSuffix(r.Parameters["share"], "/")
+	if share == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "share"))
+	}
+	for _, volumeCapability := range r.VolumeCapabilities {
+		if nodeserver.ValidateVolumeCapability(volumeCapability) != nil {
+			return &csi.GetCapacityResponse{AvailableCapacity: 0}, nil
+		}
+	}
+
+	if availableBytes, ok := c.capacities.capacity(share, c.timeshim.Now()); ok {
+		return &csi.GetCapacityResponse{AvailableCapacity: availableBytes}, nil
+	}
+
+	logger := c.logger.Session("get-capacity", lager.Data{"share": share})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	volumeContext := map[string]string{"share": share}
+	if authentication, ok := r.Parameters["authentication"]; ok {
+		volumeContext["authentication"] = authentication
+	}
+	dir, err := c.mounter.Mount(ctx, volumeContext, nil, c.config.CapacitySecrets)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unmount(logger, dir)
+
+	var stats syscall.Statfs_t
+	err = c.syscallshim.Statfs(dir, &stats)
+	if err != nil {
+		logger.Error("statfs-failed", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	availableBytes := int64(stats.Bavail) * stats.Bsize
+	c.capacities.setCapacity(share, availableBytes, c.timeshim.Now().Add(c.config.CapacityCacheTTL))
+	logger.Info("measured-capacity", lager.Data{"availableBytes": availableBytes})
+	return &csi.GetCapacityResponse{AvailableCapacity: availableBytes}, nil
+}
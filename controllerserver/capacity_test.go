@@ -0,0 +1,231 @@
+package controllerserver_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/goshims/syscallshim/syscall_fake"
+	"code.cloudfoundry.org/goshims/timeshim/time_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "code.cloudfoundry.org/smb-csi-driver/controllerserver"
+	smbcsidriverfakes "code.cloudfoundry.org/smb-csi-driver/smb-csi-driverfakes"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var _ = Describe("Capacity", func() {
+	var (
+		logger           *lagertest.TestLogger
+		controllerServer csi.ControllerServer
+		ctx              context.Context
+		now              time.Time
+
+		fakeSyscall *syscall_fake.FakeSyscall
+		fakeTime    *time_fake.FakeTime
+		fakeMounter *smbcsidriverfakes.FakeShareMounter
+
+		request *csi.GetCapacityRequest
+		resp    *csi.GetCapacityResponse
+		err     error
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("capacity-test")
+		ctx = context.Background()
+		now = time.Date(2020, time.May, 4, 11, 14, 15, 0, time.UTC)
+
+		fakeSyscall = &syscall_fake.FakeSyscall{}
+		fakeSyscall.StatfsStub = func(path string, stats *syscall.Statfs_t) error {
+			stats.Bavail = 100
+			stats.Bsize = 4096
+			return nil
+		}
+		fakeTime = &time_fake.FakeTime{}
+		fakeTime.NowStub = func() time.Time { return now }
+		fakeMounter = &smbcsidriverfakes.FakeShareMounter{}
+		fakeMounter.MountReturns("/mnt/share", nil)
+
+		controllerServer = NewControllerServer(logger, &osshim.OsShim{}, &ioutilshim.IoutilShim{}, fakeSyscall, fakeTime, fakeMounter, Config{CapacityCacheTTL: time.Minute, CapacitySecrets: map[string]string{"username": "capacity-user", "password": "capacity-pass"}})
+
+		request = &csi.GetCapacityRequest{
+			VolumeCapabilities: []*csi.VolumeCapability{multiNodeMultiWriter},
+			Parameters:         map[string]string{"share": "//server/export/", "authentication": "kerberos"},
+		}
+	})
+
+	JustBeforeEach(func() {
+		resp, err = controllerServer.GetCapacity(ctx, request)
+	})
+
+	It("should report the space available on the share", func() {
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.AvailableCapacity).To(Equal(int64(100 * 4096)))
+
+		Expect(fakeMounter.MountCallCount()).To(Equal(1))
+		_, volumeContext, mountFlags, secrets := fakeMounter.MountArgsForCall(0)
+		Expect(volumeContext).To(Equal(map[string]string{"share": "//server/export", "authentication": "kerberos"}))
+		Expect(mountFlags).To(BeEmpty())
+		Expect(secrets).To(Equal(map[string]string{"username": "capacity-user", "password": "capacity-pass"}))
+
+		Expect(fakeSyscall.StatfsCallCount()).To(Equal(1))
+		path, _ := fakeSyscall.StatfsArgsForCall(0)
+		Expect(path).To(Equal("/mnt/share"))
+
+		Expect(fakeMounter.UnmountCallCount()).To(Equal(1))
+		_, dir := fakeMounter.UnmountArgsForCall(0)
+		Expect(dir).To(Equal("/mnt/share"))
+	})
+
+	Context("when it is asked again within the cache TTL", func() {
+		It("should report the cached capacity without mounting the share", func() {
+			now = now.Add(59 * time.Second)
+			resp, err = controllerServer.GetCapacity(ctx, request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.AvailableCapacity).To(Equal(int64(100 * 4096)))
+			Expect(fakeMounter.MountCallCount()).To(Equal(1))
+			Expect(fakeSyscall.StatfsCallCount()).To(Equal(1))
+		})
+	})
+
+	Context("when it is asked again after the cache TTL", func() {
+		It("should measure the share again", func() {
+			fakeSyscall.StatfsStub = func(path string, stats *syscall.Statfs_t) error {
+				stats.Bavail = 50
+				stats.Bsize = 4096
+				return nil
+			}
+			now = now.Add(time.Minute)
+			resp, err = controllerServer.GetCapacity(ctx, request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.AvailableCapacity).To(Equal(int64(50 * 4096)))
+			Expect(fakeMounter.MountCallCount()).To(Equal(2))
+		})
+	})
+
+	Context("when a volume was provisioned on the share with other secrets", func() {
+		BeforeEach(func() {
+			_, err := controllerServer.DeleteVolume(ctx, &csi.DeleteVolumeRequest{
+				VolumeId: "//server/export#pvc-1#retain",
+				Secrets:  map[string]string{"username": "user1", "password": "pass1"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should still mount the share with the capacity secrets", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeMounter.MountCallCount()).To(Equal(2))
+			_, _, _, secrets := fakeMounter.MountArgsForCall(1)
+			Expect(secrets).To(Equal(map[string]string{"username": "capacity-user", "password": "capacity-pass"}))
+		})
+	})
+
+	Context("when the share cannot be mounted", func() {
+		BeforeEach(func() {
+			fakeMounter.MountReturns("", status.Error(codes.Internal, "Error: mount failed"))
+		})
+
+		It("should return the mount error", func() {
+			Expect(err).To(Equal(status.Error(codes.Internal, "Error: mount failed")))
+			Expect(fakeSyscall.StatfsCallCount()).To(Equal(0))
+		})
+	})
+
+	Context("when the controller has no capacity secrets", func() {
+		BeforeEach(func() {
+			controllerServer = NewControllerServer(logger, &osshim.OsShim{}, &ioutilshim.IoutilShim{}, fakeSyscall, fakeTime, fakeMounter, Config{})
+		})
+
+		It("should not advertise GetCapacity", func() {
+			resp, err := controllerServer.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Capabilities).NotTo(ContainElement(rpcCapability(csi.ControllerServiceCapability_RPC_GET_CAPACITY)))
+		})
+
+		It("should return unimplemented without mounting the share", func() {
+			Expect(status.Code(err)).To(Equal(codes.Unimplemented))
+			Expect(fakeMounter.MountCallCount()).To(Equal(0))
+		})
+	})
+
+	Context("when the share cannot be measured", func() {
+		BeforeEach(func() {
+			fakeSyscall.StatfsStub = nil
+			fakeSyscall.StatfsReturns(errors.New("statfs failed"))
+		})
+
+		It("should return an error and unmount the share", func() {
+			Expect(err).To(Equal(status.Error(codes.Internal, "statfs failed")))
+			Expect(fakeMounter.UnmountCallCount()).To(Equal(1))
+		})
+	})
+
+	Context("when the share parameter is missing", func() {
+		BeforeEach(func() {
+			request.Parameters = map[string]string{}
+		})
+
+		It("should return an error", func() {
+			Expect(err).To(Equal(status.Error(codes.InvalidArgument, "Error: a required property [share] was not provided")))
+		})
+	})
+
+	Context("when a volume capability is not supported", func() {
+		BeforeEach(func() {
+			request.VolumeCapabilities = []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+			}}
+		})
+
+		It("should report no capacity without mounting the share", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.AvailableCapacity).To(Equal(int64(0)))
+			Expect(fakeMounter.MountCallCount()).To(Equal(0))
+		})
+	})
+})
+
+var _ = Describe("ReadSecretsDir", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "secrets")
+		Expect(err).NotTo(HaveOccurred())
+
+		// The layout of a Kubernetes secret volume: the keys link into a hidden directory that is swapped on update.
+		Expect(os.Mkdir(filepath.Join(dir, "..2020_05_04"), 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "..2020_05_04", "username"), []byte("user1"), 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "..2020_05_04", "password"), []byte("pass1\n"), 0600)).To(Succeed())
+		Expect(os.Symlink("..2020_05_04", filepath.Join(dir, "..data"))).To(Succeed())
+		Expect(os.Symlink("..data/username", filepath.Join(dir, "username"))).To(Succeed())
+		Expect(os.Symlink("..data/password", filepath.Join(dir, "password"))).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("should read one secret per file and skip the hidden entries", func() {
+		secrets, err := ReadSecretsDir(&ioutilshim.IoutilShim{}, dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(secrets).To(Equal(map[string]string{"username": "user1", "password": "pass1\n"}))
+	})
+
+	Context("when the directory does not exist", func() {
+		It("should return an error", func() {
+			_, err := ReadSecretsDir(&ioutilshim.IoutilShim{}, filepath.Join(dir, "missing"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,446 @@
+package controllerserver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/goshims/syscallshim"
+	"code.cloudfoundry.org/goshims/timeshim"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/smb-csi-driver/internal/inflight"
+	"code.cloudfoundry.org/smb-csi-driver/nodeserver"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errorFmt = "Error: a required property [%s] was not provided"
+var inFlightFmt = "Error: an operation on [%s] is already in progress"
+
+// parameters lists the StorageClass parameters that are passed on to the volumes provisioned for it.
+var parameters = []string{"share", "authentication"}
+
+// shareUnmountTimeout bounds the unmount of a share once a request is done with it. The unmount policy of the mounter
+// bounds each of its steps on its own.
+const shareUnmountTimeout = 2 * time.Minute
+
+// onDeleteParameter is the StorageClass parameter that decides what DeleteVolume does with the directory of a volume.
+const onDeleteParameter = "onDelete"
+
+// controllerParameters lists the StorageClass parameters that only the controller uses.
+var controllerParameters = []string{onDeleteParameter, quotaParameter}
+
+//go:generate go run github.com/maxbrunsfeld/counterfeiter/v6 -o ../smb-csi-driverfakes/fake_share_mounter.go . ShareMounter
+type ShareMounter interface {
+	// Mount makes the share of volumeContext available as a local directory until Unmount is called with it.
+	Mount(ctx context.Context, volumeContext map[string]string, mountFlags []string, secrets map[string]string) (string, error)
+	Unmount(ctx context.Context, dir string) error
+}
+
+type Config struct {
+	// SnapshotDir is the directory of a share, relative to its root, in which snapshots of its volumes are stored.
+	SnapshotDir string
+	// CapacityCacheTTL is how long the free space of a share is reported before it is measured again.
+	CapacityCacheTTL time.Duration
+	// CapacitySecrets are the secrets GetCapacity mounts shares with. GetCapacity is not advertised when they are nil.
+	CapacitySecrets map[string]string
+}
+
+func (config Config) withDefaults() Config {
+	if config.SnapshotDir == "" {
+		config.SnapshotDir = DefaultSnapshotDir
+	}
+	if config.CapacityCacheTTL == 0 {
+		config.CapacityCacheTTL = DefaultCapacityCacheTTL
+	}
+	return config
+}
+
+type smbControllerServer struct {
+	logger      lager.Logger
+	osshim      osshim.Os
+	ioutilshim  ioutilshim.Ioutil
+	syscallshim syscallshim.Syscall
+	timeshim    timeshim.Time
+	mounter     ShareMounter
+	config      Config
+	locks       *inflight.Locks
+	capacities  *capacityCache
+}
+
+// NewControllerServer returns a controller service that provisions every volume as a directory of the share named by
+// the share parameter of its StorageClass.
+func NewControllerServer(logger lager.Logger, osshim osshim.Os, ioutilshim ioutilshim.Ioutil, syscallshim syscallshim.Syscall, timeshim timeshim.Time, mounter ShareMounter, config Config) csi.ControllerServer {
+	return &smbControllerServer{
+		logger:      logger,
+		osshim:      osshim,
+		ioutilshim:  ioutilshim,
+		syscallshim: syscallshim,
+		timeshim:    timeshim,
+		mounter:     mounter,
+		config:      config.withDefaults(),
+		locks:       inflight.New(),
+		capacities:  newCapacityCache(),
+	}
+}
+
+// ValidateSnapshotDir checks the SnapshotDir of a Config.
+func ValidateSnapshotDir(dir string) error {
+	if !validSnapshotDir(dir) {
+		return fmt.Errorf("invalid snapshot dir '%s', expected a path relative to the root of the share", dir)
+	}
+	return nil
+}
+
+func (c *smbControllerServer) CreateVolume(ctx context.Context, r *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if r.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "Name"))
+	}
+	if len(r.VolumeCapabilities) == 0 {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "VolumeCapabilities"))
+	}
+	for _, volumeCapability := range r.VolumeCapabilities {
+		err := nodeserver.ValidateVolumeCapability(volumeCapability)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.Parameters["share"] == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "share"))
+	}
+	volumeContext, err := volumeContextFrom(r.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	onDelete := onDeleteDelete
+	if value, ok := r.Parameters[onDeleteParameter]; ok {
+		onDelete, err = parseOnDeletePolicy(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	quotaEnabled := false
+	if value, ok := r.Parameters[quotaParameter]; ok {
+		quotaEnabled, err = parseQuotaParameter(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if quotaEnabled && quotaBytes(r.CapacityRange) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Error: volumes with a soft quota need a CapacityRange")
+	}
+	if !validDirectoryName(r.Name) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Error: invalid volume name '%s'", r.Name))
+	}
+	volumeContext["share"] = strings.TrimSuffix(volumeContext["share"], "/")
+	id := volumeID{share: volumeContext["share"], subDir: r.Name, onDelete: onDelete}
+	if _, err := parseVolumeID(id.String()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Error: invalid share parameter '%s', expected //server/share", r.Parameters["share"]))
+	}
+
+	if !c.locks.TryAcquire(r.Name) {
+		return nil, status.Error(codes.Aborted, fmt.Sprintf(inFlightFmt, r.Name))
+	}
+	defer c.locks.Release(r.Name)
+
+	logger := c.logger.Session("create-volume", lager.Data{"name": r.Name, "share": volumeContext["share"]})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	dir, err := c.mounter.Mount(ctx, volumeContext, r.VolumeCapabilities[0].GetMount().GetMountFlags(), r.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unmount(logger, dir)
+
+	// The record is written before the directory, so that a conflicting retry is refused even when this request fails
+	// halfway.
+	record := volumeRecordFrom(r)
+	err = c.checkVolumeRecord(logger, dir, r.Name, record)
+	if err != nil {
+		return nil, err
+	}
+	err = c.writeVolumeRecord(logger, dir, r.Name, record)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.VolumeContentSource == nil {
+		err = c.osshim.Mkdir(filepath.Join(dir, r.Name), os.ModePerm)
+		if err != nil && !os.IsExist(err) {
+			logger.Error("create-volume-dir-failed", err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else {
+		err = c.populateVolume(ctx, logger, dir, id, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = c.recordQuota(logger, dir, r.Name, quotaEnabled, quotaBytes(r.CapacityRange))
+	if err != nil {
+		return nil, err
+	}
+
+	nodeVolumeContext := map[string]string{"subDir": id.subDir}
+	for key, value := range volumeContext {
+		nodeVolumeContext[key] = value
+	}
+	capacityBytes := r.GetCapacityRange().GetRequiredBytes()
+	if quotaEnabled {
+		capacityBytes = quotaBytes(r.CapacityRange)
+		nodeVolumeContext["quotaDir"] = path.Join(quotaDir, r.Name)
+	}
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      id.String(),
+			CapacityBytes: capacityBytes,
+			VolumeContext: nodeVolumeContext,
+			ContentSource: r.VolumeContentSource,
+		},
+	}, nil
+}
+
+// DeleteVolume deletes, archives or retains the directory of the volume, as its onDelete policy says, and drops its
+// quota and record. Volumes that are already gone, or were never provisioned by this driver, are deleted successfully.
+func (c *smbControllerServer) DeleteVolume(ctx context.Context, r *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	if r.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "VolumeId"))
+	}
+
+	logger := c.logger.Session("delete-volume", lager.Data{"volumeId": r.VolumeId})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	id, err := parseVolumeID(r.VolumeId)
+	if err != nil {
+		logger.Info("not-a-provisioned-volume", lager.Data{"reason": err.Error()})
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	if !c.locks.TryAcquire(id.subDir) {
+		return nil, status.Error(codes.Aborted, fmt.Sprintf(inFlightFmt, id.subDir))
+	}
+	defer c.locks.Release(id.subDir)
+
+	dir, err := c.mounter.Mount(ctx, map[string]string{"share": id.share}, nil, r.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unmount(logger, dir)
+
+	err = c.reclaim(logger, dir, id)
+	if err != nil {
+		return nil, err
+	}
+	err = c.removeQuota(logger, dir, id.subDir)
+	if err != nil {
+		return nil, err
+	}
+	err = c.removeVolumeRecord(logger, dir, id.subDir)
+	if err != nil {
+		return nil, err
+	}
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+func (c *smbControllerServer) ValidateVolumeCapabilities(ctx context.Context, r *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if r.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "VolumeId"))
+	}
+	if len(r.VolumeCapabilities) == 0 {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "VolumeCapabilities"))
+	}
+	id, err := parseVolumeID(r.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	logger := c.logger.Session("validate-volume-capabilities", lager.Data{"volumeId": r.VolumeId})
+	dir, err := c.mounter.Mount(ctx, map[string]string{"share": id.share}, nil, r.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unmount(logger, dir)
+
+	_, err = c.osshim.Stat(filepath.Join(dir, id.subDir))
+	if os.IsNotExist(err) {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("Error: volume '%s' does not exist", r.VolumeId))
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	for _, volumeCapability := range r.VolumeCapabilities {
+		if err := nodeserver.ValidateVolumeCapability(volumeCapability); err != nil {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: status.Convert(err).Message()}, nil
+		}
+	}
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      r.VolumeContext,
+			VolumeCapabilities: r.VolumeCapabilities,
+			Parameters:         r.Parameters,
+		},
+	}, nil
+}
+
+func (c *smbControllerServer) ControllerGetCapabilities(context.Context, *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	capabilities := []*csi.ControllerServiceCapability{
+		controllerServiceCapability(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME),
+		controllerServiceCapability(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT),
+		controllerServiceCapability(csi.ControllerServiceCapability_RPC_CLONE_VOLUME),
+		controllerServiceCapability(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME),
+	}
+	if c.config.CapacitySecrets != nil {
+		capabilities = append(capabilities, controllerServiceCapability(csi.ControllerServiceCapability_RPC_GET_CAPACITY))
+	}
+	return &csi.ControllerGetCapabilitiesResponse{Capabilities: capabilities}, nil
+}
+
+func (c *smbControllerServer) ControllerPublishVolume(context.Context, *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (c *smbControllerServer) ControllerUnpublishVolume(context.Context, *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (c *smbControllerServer) ListVolumes(context.Context, *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (c *smbControllerServer) ControllerGetVolume(context.Context, *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+// populateVolume creates the directory of a volume as a copy of its content source, a snapshot or another volume. A
+// volume whose directory already exists was populated by an earlier request. A content source larger than the limit of
+// the CapacityRange is refused.
+func (c *smbControllerServer) populateVolume(ctx context.Context, logger lager.Logger, dir string, id volumeID, r *csi.CreateVolumeRequest) error {
+	_, err := c.osshim.Stat(filepath.Join(dir, id.subDir))
+	if err == nil {
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	var share, sourcePath string
+	var snapshot *snapshotID
+	switch source := r.VolumeContentSource.Type.(type) {
+	case *csi.VolumeContentSource_Snapshot:
+		id, err := parseSnapshotID(source.Snapshot.GetSnapshotId())
+		if err != nil {
+			return status.Error(codes.NotFound, err.Error())
+		}
+		snapshot = &id
+		share, sourcePath = snapshot.share, filepath.Join(snapshot.dir, snapshot.name)
+		logger = logger.WithData(lager.Data{"snapshotId": snapshot.String()})
+	case *csi.VolumeContentSource_Volume:
+		volume, err := parseVolumeID(source.Volume.GetVolumeId())
+		if err != nil {
+			return status.Error(codes.NotFound, err.Error())
+		}
+		share, sourcePath = volume.share, volume.subDir
+		logger = logger.WithData(lager.Data{"sourceVolumeId": source.Volume.GetVolumeId()})
+	default:
+		return status.Error(codes.InvalidArgument, "Error: volumes can only be created from snapshots and volumes")
+	}
+
+	sourceDir := dir
+	if share != id.share {
+		sourceDir, err = c.mounter.Mount(ctx, map[string]string{"share": share}, nil, r.Secrets)
+		if err != nil {
+			return err
+		}
+		defer c.unmount(logger, sourceDir)
+	}
+
+	var sourceBytes int64
+	if snapshot != nil {
+		// Only snapshots with metadata are complete.
+		csiSnapshot, err := c.readSnapshot(sourceDir, *snapshot)
+		if err != nil {
+			return err
+		}
+		sourceBytes = csiSnapshot.SizeBytes
+	} else {
+		_, err = c.osshim.Stat(filepath.Join(sourceDir, sourcePath))
+		if os.IsNotExist(err) {
+			return status.Error(codes.NotFound, fmt.Sprintf("Error: volume '%s' does not exist", r.VolumeContentSource.GetVolume().GetVolumeId()))
+		}
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		sourceBytes, err = c.treeSize(ctx, filepath.Join(sourceDir, sourcePath))
+		if err != nil {
+			logger.Error("measure-source-volume-failed", err)
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+	if limitBytes := r.GetCapacityRange().GetLimitBytes(); limitBytes > 0 && sourceBytes > limitBytes {
+		return status.Error(codes.OutOfRange, fmt.Sprintf("Error: the content source holds %d bytes, more than the limit of %d bytes", sourceBytes, limitBytes))
+	}
+
+	_, err = c.populate(ctx, logger, dir, id.subDir, filepath.Join(sourceDir, sourcePath))
+	return err
+}
+
+// unmount unmounts a share mounted by mount. It does not use the context of the request, which may be cancelled or past
+// its deadline by now: an unmount that is never run leaves the share mounted in the work dir for good.
+func (c *smbControllerServer) unmount(logger lager.Logger, dir string) {
+	ctx, cancel := context.WithTimeout(context.Background(), shareUnmountTimeout)
+	defer cancel()
+
+	err := c.mounter.Unmount(ctx, dir)
+	if err != nil {
+		logger.Error("unmount-share-failed", err, lager.Data{"dir": dir})
+	}
+}
+
+// volumeContextFrom copies the StorageClass parameters the node server needs to mount the volumes provisioned for it.
+func volumeContextFrom(params map[string]string) (map[string]string, error) {
+	volumeContext := map[string]string{}
+	for key, value := range params {
+		known := false
+		for _, parameter := range controllerParameters {
+			if key == parameter {
+				known = true
+			}
+		}
+		if known {
+			continue
+		}
+		for _, parameter := range parameters {
+			if key == parameter {
+				known = true
+			}
+		}
+		if !known {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Error: unknown parameter '%s', expected one of [%s]", key, strings.Join(append(append([]string{}, parameters...), controllerParameters...), ", ")))
+		}
+		volumeContext[key] = value
+	}
+	return volumeContext, nil
+}
+
+// validDirectoryName accepts the names the external provisioner derives from the PVC, such as pvc-<uid>.
+func validDirectoryName(name string) bool {
+	return name != "." && name != ".." && !strings.ContainsAny(name, "/\\#\x00\n\r")
+}
+
+func controllerServiceCapability(capability csi.ControllerServiceCapability_RPC_Type) *csi.ControllerServiceCapability {
+	return &csi.ControllerServiceCapability{
+		Type: &csi.ControllerServiceCapability_Rpc{
+			Rpc: &csi.ControllerServiceCapability_RPC{Type: capability},
+		},
+	}
+}
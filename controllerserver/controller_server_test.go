@@ -0,0 +1,773 @@
+package controllerserver_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/goshims/syscallshim"
+	"code.cloudfoundry.org/goshims/timeshim/time_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "code.cloudfoundry.org/smb-csi-driver/controllerserver"
+	smbcsidriverfakes "code.cloudfoundry.org/smb-csi-driver/smb-csi-driverfakes"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gbytes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var multiNodeMultiWriter = &csi.VolumeCapability{
+	AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"vers=3.0"}}},
+	AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+}
+
+var _ = Describe("ControllerServer", func() {
+	var (
+		logger           *lagertest.TestLogger
+		controllerServer csi.ControllerServer
+		ctx              context.Context
+
+		fakeTime    *time_fake.FakeTime
+		fakeMounter *smbcsidriverfakes.FakeShareMounter
+		shareDir    string
+	)
+
+	BeforeEach(func() {
+		var err error
+		shareDir, err = ioutil.TempDir("", "share")
+		Expect(err).NotTo(HaveOccurred())
+
+		logger = lagertest.NewTestLogger("controller-server-test")
+		ctx = context.Background()
+		fakeTime = &time_fake.FakeTime{}
+		fakeTime.NowReturns(time.Date(2020, time.May, 4, 13, 14, 15, 0, time.FixedZone("CEST", 2*60*60)))
+		fakeMounter = &smbcsidriverfakes.FakeShareMounter{}
+		fakeMounter.MountReturns(shareDir, nil)
+
+		controllerServer = NewControllerServer(logger, &osshim.OsShim{}, &ioutilshim.IoutilShim{}, &syscallshim.SyscallShim{}, fakeTime, fakeMounter, Config{})
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(shareDir)).To(Succeed())
+	})
+
+	Describe("#CreateVolume", func() {
+		var (
+			request *csi.CreateVolumeRequest
+			resp    *csi.CreateVolumeResponse
+			err     error
+		)
+
+		BeforeEach(func() {
+			request = &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: 1024},
+				VolumeCapabilities: []*csi.VolumeCapability{multiNodeMultiWriter},
+				Parameters:         map[string]string{"share": "//server/export/"},
+				Secrets:            map[string]string{"username": "user1", "password": "pass1"},
+			}
+		})
+
+		JustBeforeEach(func() {
+			resp, err = controllerServer.CreateVolume(ctx, request)
+		})
+
+		It("should create a directory for the volume in the share", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(shareDir, "pvc-1")).To(BeADirectory())
+		})
+
+		It("should return a volume id encoding the share and the directory", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Volume).To(Equal(&csi.Volume{
+				VolumeId:      "//server/export#pvc-1",
+				CapacityBytes: 1024,
+				VolumeContext: map[string]string{"share": "//server/export", "subDir": "pvc-1"},
+			}))
+		})
+
+		It("should mount the share with the mount flags and secrets of the request and unmount it afterwards", func() {
+			Expect(fakeMounter.MountCallCount()).To(Equal(1))
+			_, volumeContext, mountFlags, secrets := fakeMounter.MountArgsForCall(0)
+			Expect(volumeContext).To(Equal(map[string]string{"share": "//server/export"}))
+			Expect(mountFlags).To(Equal([]string{"vers=3.0"}))
+			Expect(secrets).To(Equal(request.Secrets))
+
+			Expect(fakeMounter.UnmountCallCount()).To(Equal(1))
+			_, dir := fakeMounter.UnmountArgsForCall(0)
+			Expect(dir).To(Equal(shareDir))
+		})
+
+		Context("when the volume already exists", func() {
+			BeforeEach(func() {
+				Expect(os.Mkdir(filepath.Join(shareDir, "pvc-1"), os.ModePerm)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(shareDir, "pvc-1", "data"), []byte("data"), 0644)).To(Succeed())
+			})
+
+			It("should succeed and keep its contents", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.Volume.VolumeId).To(Equal("//server/export#pvc-1"))
+				Expect(filepath.Join(shareDir, "pvc-1", "data")).To(BeARegularFile())
+			})
+		})
+
+		Context("when the volume was already created by an earlier request", func() {
+			BeforeEach(func() {
+				_, err := controllerServer.CreateVolume(ctx, request)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Join(shareDir, ".volumes", "pvc-1.json")).To(BeARegularFile())
+			})
+
+			It("should succeed for the same request", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.Volume.VolumeId).To(Equal("//server/export#pvc-1"))
+			})
+
+			Context("when the request asks for another capacity", func() {
+				BeforeEach(func() {
+					request.CapacityRange = &csi.CapacityRange{RequiredBytes: 2048}
+				})
+
+				It("should return already exists", func() {
+					Expect(err).To(Equal(status.Error(codes.AlreadyExists, "Error: volume 'pvc-1' already exists with a different capacity, parameters or content source")))
+				})
+			})
+
+			Context("when the request has other parameters", func() {
+				BeforeEach(func() {
+					request.Parameters = map[string]string{"share": "//server/export/", "onDelete": "retain"}
+				})
+
+				It("should return already exists", func() {
+					Expect(status.Code(err)).To(Equal(codes.AlreadyExists))
+				})
+			})
+
+			Context("when the directory of the volume was deleted meanwhile", func() {
+				BeforeEach(func() {
+					Expect(os.Remove(filepath.Join(shareDir, "pvc-1"))).To(Succeed())
+					request.CapacityRange = &csi.CapacityRange{RequiredBytes: 2048}
+				})
+
+				It("should create it again and record the new request", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(filepath.Join(shareDir, "pvc-1")).To(BeADirectory())
+					Expect(ioutil.ReadFile(filepath.Join(shareDir, ".volumes", "pvc-1.json"))).To(MatchJSON(`{"requiredBytes": 2048, "limitBytes": 0, "parameters": {"share": "//server/export/"}}`))
+				})
+			})
+		})
+
+		Context("when the StorageClass asks for kerberos authentication", func() {
+			BeforeEach(func() {
+				request.Parameters["authentication"] = "kerberos"
+			})
+
+			It("should pass it on to the node server", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.Volume.VolumeContext).To(HaveKeyWithValue("authentication", "kerberos"))
+			})
+		})
+
+		Context("when the StorageClass archives or retains deleted volumes", func() {
+			BeforeEach(func() {
+				request.Parameters["onDelete"] = "archive"
+			})
+
+			It("should record the policy in the volume id only", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.Volume.VolumeId).To(Equal("//server/export#pvc-1#archive"))
+				Expect(resp.Volume.VolumeContext).NotTo(HaveKey("onDelete"))
+			})
+		})
+
+		Context("when the StorageClass explicitly deletes the directories of deleted volumes", func() {
+			BeforeEach(func() {
+				request.Parameters["onDelete"] = "delete"
+			})
+
+			It("should return the plain volume id", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.Volume.VolumeId).To(Equal("//server/export#pvc-1"))
+			})
+		})
+
+		Context("when the onDelete parameter is invalid", func() {
+			BeforeEach(func() {
+				request.Parameters["onDelete"] = "recycle"
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(Equal(status.Error(codes.InvalidArgument, "Error: invalid onDelete parameter 'recycle', expected one of [delete, archive, retain]")))
+				Expect(fakeMounter.MountCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the name is missing", func() {
+			BeforeEach(func() {
+				request.Name = ""
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(Equal(status.Error(codes.InvalidArgument, "Error: a required property [Name] was not provided")))
+				Expect(fakeMounter.MountCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the name is not a valid directory name", func() {
+			BeforeEach(func() {
+				request.Name = "../pvc-1"
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(Equal(status.Error(codes.InvalidArgument, "Error: invalid volume name '../pvc-1'")))
+			})
+		})
+
+		Context("when the volume capabilities are missing", func() {
+			BeforeEach(func() {
+				request.VolumeCapabilities = nil
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(Equal(status.Error(codes.InvalidArgument, "Error: a required property [VolumeCapabilities] was not provided")))
+			})
+		})
+
+		Context("when a block volume is requested", func() {
+			BeforeEach(func() {
+				request.VolumeCapabilities = append(request.VolumeCapabilities, &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+					AccessMode: multiNodeMultiWriter.AccessMode,
+				})
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(Equal(status.Error(codes.InvalidArgument, "Error: block volumes are not supported")))
+				Expect(fakeMounter.MountCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the share parameter is missing", func() {
+			BeforeEach(func() {
+				delete(request.Parameters, "share")
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(Equal(status.Error(codes.InvalidArgument, "Error: a required property [share] was not provided")))
+			})
+		})
+
+		Context("when the share parameter is not a share", func() {
+			BeforeEach(func() {
+				request.Parameters["share"] = "server/export"
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(Equal(status.Error(codes.InvalidArgument, "Error: invalid share parameter 'server/export', expected //server/share")))
+			})
+		})
+
+		Context("when the StorageClass has an unknown parameter", func() {
+			BeforeEach(func() {
+				request.Parameters["shares"] = "//server/other"
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(Equal(status.Error(codes.InvalidArgument, "Error: unknown parameter 'shares', expected one of [share, authentication, onDelete, quota]")))
+			})
+		})
+
+		Context("when the share cannot be mounted", func() {
+			BeforeEach(func() {
+				fakeMounter.MountReturns("", status.Error(codes.Internal, "mount error(13): Permission denied"))
+			})
+
+			It("should return the mount error", func() {
+				Expect(err).To(Equal(status.Error(codes.Internal, "mount error(13): Permission denied")))
+				Expect(fakeMounter.UnmountCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when cloning a volume", func() {
+			BeforeEach(func() {
+				Expect(os.MkdirAll(filepath.Join(shareDir, "pvc-source", "nested"), 0750)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(shareDir, "pvc-source", "data"), []byte("data"), 0640)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(shareDir, "pvc-source", "nested", "more-data"), []byte("more data"), 0600)).To(Succeed())
+				Expect(os.Chmod(filepath.Join(shareDir, "pvc-source", "nested"), 0750)).To(Succeed())
+
+				request.VolumeContentSource = &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Volume{
+						Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "//server/export#pvc-source"},
+					},
+				}
+			})
+
+			It("should create the volume as a copy of the source volume", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ioutil.ReadFile(filepath.Join(shareDir, "pvc-1", "data"))).To(Equal([]byte("data")))
+				Expect(ioutil.ReadFile(filepath.Join(shareDir, "pvc-1", "nested", "more-data"))).To(Equal([]byte("more data")))
+				Expect(filepath.Join(shareDir, ".pvc-1.partial")).NotTo(BeAnExistingFile())
+				Expect(resp.Volume.ContentSource).To(Equal(request.VolumeContentSource))
+			})
+
+			It("should preserve the modes of the copied files", func() {
+				Expect(err).NotTo(HaveOccurred())
+				info, statErr := os.Stat(filepath.Join(shareDir, "pvc-1", "data"))
+				Expect(statErr).NotTo(HaveOccurred())
+				Expect(info.Mode().Perm()).To(Equal(os.FileMode(0640)))
+				info, statErr = os.Stat(filepath.Join(shareDir, "pvc-1", "nested"))
+				Expect(statErr).NotTo(HaveOccurred())
+				Expect(info.Mode().Perm()).To(Equal(os.FileMode(0750)))
+			})
+
+			It("should log what it copied", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(logger.Buffer()).To(Say(`copy-started.*"sourceVolumeId":"//server/export#pvc-source"`))
+				Expect(logger.Buffer()).To(Say(`copy-finished.*"bytesCopied":13,"filesCopied":4`))
+			})
+
+			Context("when the copy takes a while", func() {
+				BeforeEach(func() {
+					now := time.Now()
+					fakeTime.NowStub = func() time.Time {
+						now = now.Add(6 * time.Second)
+						return now
+					}
+				})
+
+				It("should log its progress", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(logger.Buffer()).To(Say(`copy-progress.*"filesCopied":2`))
+					Expect(logger.Buffer()).To(Say(`copy-progress.*"filesCopied":4`))
+				})
+			})
+
+			Context("when the source volume is on another share", func() {
+				var otherShareDir string
+
+				BeforeEach(func() {
+					var tempErr error
+					otherShareDir, tempErr = ioutil.TempDir("", "other-share")
+					Expect(tempErr).NotTo(HaveOccurred())
+					fakeMounter.MountReturnsOnCall(0, otherShareDir, nil)
+					request.Parameters["share"] = "//server/other"
+				})
+
+				AfterEach(func() {
+					Expect(os.RemoveAll(otherShareDir)).To(Succeed())
+				})
+
+				It("should mount the share of the source volume as well", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeMounter.MountCallCount()).To(Equal(2))
+					_, volumeContext, _, _ := fakeMounter.MountArgsForCall(1)
+					Expect(volumeContext).To(Equal(map[string]string{"share": "//server/export"}))
+					Expect(ioutil.ReadFile(filepath.Join(otherShareDir, "pvc-1", "data"))).To(Equal([]byte("data")))
+					Expect(fakeMounter.UnmountCallCount()).To(Equal(2))
+				})
+			})
+
+			Context("when a file cannot be copied", func() {
+				BeforeEach(func() {
+					controllerServer = NewControllerServer(logger, &failingOs{failOn: "more-data"}, &ioutilshim.IoutilShim{}, &syscallshim.SyscallShim{}, fakeTime, fakeMounter, Config{})
+				})
+
+				It("should say where and how far the copy got, and leave nothing behind", func() {
+					Expect(err).To(Equal(status.Error(codes.Internal, "Error: copy failed after 1 files and 4 bytes: nested/more-data: input/output error")))
+					Expect(filepath.Join(shareDir, "pvc-1")).NotTo(BeAnExistingFile())
+					Expect(filepath.Join(shareDir, ".pvc-1.partial")).NotTo(BeAnExistingFile())
+				})
+			})
+
+			Context("when the source volume is larger than the limit of the capacity range", func() {
+				BeforeEach(func() {
+					request.CapacityRange = &csi.CapacityRange{LimitBytes: 12}
+				})
+
+				It("should return out of range and create nothing", func() {
+					Expect(err).To(Equal(status.Error(codes.OutOfRange, "Error: the content source holds 13 bytes, more than the limit of 12 bytes")))
+					Expect(filepath.Join(shareDir, "pvc-1")).NotTo(BeAnExistingFile())
+					Expect(filepath.Join(shareDir, ".pvc-1.partial")).NotTo(BeAnExistingFile())
+				})
+			})
+
+			Context("when the source volume fits the limit of the capacity range", func() {
+				BeforeEach(func() {
+					request.CapacityRange = &csi.CapacityRange{LimitBytes: 13}
+				})
+
+				It("should create the volume", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(ioutil.ReadFile(filepath.Join(shareDir, "pvc-1", "data"))).To(Equal([]byte("data")))
+				})
+			})
+
+			Context("when the source volume does not exist", func() {
+				BeforeEach(func() {
+					request.VolumeContentSource.GetVolume().VolumeId = "//server/export#pvc-2"
+				})
+
+				It("should return not found and create nothing", func() {
+					Expect(err).To(Equal(status.Error(codes.NotFound, "Error: volume '//server/export#pvc-2' does not exist")))
+					Expect(filepath.Join(shareDir, "pvc-1")).NotTo(BeAnExistingFile())
+				})
+			})
+
+			Context("when the source volume id is not one of the driver", func() {
+				BeforeEach(func() {
+					request.VolumeContentSource.GetVolume().VolumeId = "some-static-volume"
+				})
+
+				It("should return not found", func() {
+					Expect(err).To(Equal(status.Error(codes.NotFound, "Error: volume id 'some-static-volume' is not of the form //server/share#directory")))
+				})
+			})
+		})
+
+		Context("when the share cannot be unmounted", func() {
+			BeforeEach(func() {
+				fakeMounter.UnmountReturns(errors.New("target is busy"))
+			})
+
+			It("should still create the volume and log the failure", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(logger.Buffer()).To(Say("unmount-share-failed"))
+			})
+		})
+
+		Context("when the request is cancelled before the share is unmounted", func() {
+			var unmountCtxErr error
+
+			BeforeEach(func() {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(context.Background())
+				cancel()
+
+				unmountCtxErr = errors.New("not unmounted")
+				fakeMounter.UnmountStub = func(unmountCtx context.Context, dir string) error {
+					unmountCtxErr = unmountCtx.Err()
+					return nil
+				}
+			})
+
+			It("should still unmount the share with a live context", func() {
+				Expect(fakeMounter.UnmountCallCount()).To(Equal(1))
+				Expect(unmountCtxErr).NotTo(HaveOccurred())
+				unmountCtx, _ := fakeMounter.UnmountArgsForCall(0)
+				_, ok := unmountCtx.Deadline()
+				Expect(ok).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("#DeleteVolume", func() {
+		var (
+			request *csi.DeleteVolumeRequest
+			err     error
+		)
+
+		BeforeEach(func() {
+			request = &csi.DeleteVolumeRequest{
+				VolumeId: "//server/export#pvc-1",
+				Secrets:  map[string]string{"username": "user1", "password": "pass1"},
+			}
+			Expect(os.MkdirAll(filepath.Join(shareDir, "pvc-1", "nested"), os.ModePerm)).To(Succeed())
+			Expect(os.Mkdir(filepath.Join(shareDir, ".volumes"), os.ModePerm)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(shareDir, ".volumes", "pvc-1.json"), []byte(`{"parameters": {}}`), 0644)).To(Succeed())
+		})
+
+		JustBeforeEach(func() {
+			_, err = controllerServer.DeleteVolume(ctx, request)
+		})
+
+		It("should remove the directory of the volume and everything in it", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(shareDir, "pvc-1")).NotTo(BeAnExistingFile())
+			Expect(shareDir).To(BeADirectory())
+		})
+
+		It("should remove the record of the volume", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(shareDir, ".volumes", "pvc-1.json")).NotTo(BeAnExistingFile())
+		})
+
+		It("should mount the share of the volume id with the secrets of the request", func() {
+			Expect(fakeMounter.MountCallCount()).To(Equal(1))
+			_, volumeContext, _, secrets := fakeMounter.MountArgsForCall(0)
+			Expect(volumeContext).To(Equal(map[string]string{"share": "//server/export"}))
+			Expect(secrets).To(Equal(request.Secrets))
+			Expect(fakeMounter.UnmountCallCount()).To(Equal(1))
+		})
+
+		Context("when the volume is already gone", func() {
+			BeforeEach(func() {
+				request.VolumeId = "//server/export#pvc-2"
+			})
+
+			It("should succeed", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Join(shareDir, "pvc-1")).To(BeADirectory())
+			})
+		})
+
+		Context("when the volume is archived on delete", func() {
+			BeforeEach(func() {
+				request.VolumeId = "//server/export#pvc-1#archive"
+			})
+
+			It("should rename the directory of the volume with the time it was archived", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Join(shareDir, "pvc-1")).NotTo(BeAnExistingFile())
+				Expect(filepath.Join(shareDir, "archived-pvc-1-20200504T111415Z", "nested")).To(BeADirectory())
+			})
+
+			Context("when the volume is already gone", func() {
+				BeforeEach(func() {
+					Expect(os.RemoveAll(filepath.Join(shareDir, "pvc-1"))).To(Succeed())
+				})
+
+				It("should succeed", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(filepath.Join(shareDir, "archived-pvc-1-20200504T111415Z")).NotTo(BeAnExistingFile())
+				})
+			})
+		})
+
+		Context("when the volume is retained on delete", func() {
+			BeforeEach(func() {
+				request.VolumeId = "//server/export#pvc-1#retain"
+			})
+
+			It("should leave the directory of the volume as it is", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Join(shareDir, "pvc-1", "nested")).To(BeADirectory())
+			})
+		})
+
+		Context("when another operation on the volume is in progress", func() {
+			var (
+				unblock chan struct{}
+				done    chan struct{}
+			)
+
+			BeforeEach(func() {
+				unblock = make(chan struct{})
+				done = make(chan struct{})
+				blocked := unblock
+				fakeMounter.MountStub = func(context.Context, map[string]string, []string, map[string]string) (string, error) {
+					<-blocked
+					return shareDir, nil
+				}
+
+				go func() {
+					defer close(done)
+					_, _ = controllerServer.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+						VolumeId:      "//server/export#pvc-1",
+						CapacityRange: &csi.CapacityRange{RequiredBytes: 1024},
+					})
+				}()
+				Eventually(fakeMounter.MountCallCount).Should(Equal(1))
+			})
+
+			AfterEach(func() {
+				close(unblock)
+				Eventually(done).Should(BeClosed())
+			})
+
+			It("should return aborted without touching the share", func() {
+				Expect(err).To(Equal(status.Error(codes.Aborted, "Error: an operation on [pvc-1] is already in progress")))
+				Expect(fakeMounter.MountCallCount()).To(Equal(1))
+				Expect(filepath.Join(shareDir, "pvc-1", "nested")).To(BeADirectory())
+			})
+		})
+
+		Context("when the volume id has an unknown onDelete policy", func() {
+			BeforeEach(func() {
+				request.VolumeId = "//server/export#pvc-1#recycle"
+			})
+
+			It("should succeed without touching the share", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeMounter.MountCallCount()).To(Equal(0))
+				Expect(filepath.Join(shareDir, "pvc-1")).To(BeADirectory())
+			})
+		})
+
+		Context("when the volume id was not provisioned by the driver", func() {
+			BeforeEach(func() {
+				request.VolumeId = "some-static-volume"
+			})
+
+			It("should succeed without mounting anything", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeMounter.MountCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the volume id is missing", func() {
+			BeforeEach(func() {
+				request.VolumeId = ""
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(Equal(status.Error(codes.InvalidArgument, "Error: a required property [VolumeId] was not provided")))
+			})
+		})
+
+		Context("when the share cannot be mounted", func() {
+			BeforeEach(func() {
+				fakeMounter.MountReturns("", status.Error(codes.Internal, "mount error(13): Permission denied"))
+			})
+
+			It("should return the mount error so that the delete is retried", func() {
+				Expect(err).To(Equal(status.Error(codes.Internal, "mount error(13): Permission denied")))
+			})
+		})
+	})
+
+	Describe("#ValidateVolumeCapabilities", func() {
+		var (
+			request *csi.ValidateVolumeCapabilitiesRequest
+			resp    *csi.ValidateVolumeCapabilitiesResponse
+			err     error
+		)
+
+		BeforeEach(func() {
+			request = &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           "//server/export#pvc-1",
+				VolumeContext:      map[string]string{"share": "//server/export", "subDir": "pvc-1"},
+				VolumeCapabilities: []*csi.VolumeCapability{multiNodeMultiWriter},
+				Secrets:            map[string]string{"username": "user1", "password": "pass1"},
+			}
+			Expect(os.Mkdir(filepath.Join(shareDir, "pvc-1"), os.ModePerm)).To(Succeed())
+		})
+
+		JustBeforeEach(func() {
+			resp, err = controllerServer.ValidateVolumeCapabilities(ctx, request)
+		})
+
+		It("should confirm supported capabilities", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Confirmed.VolumeCapabilities).To(Equal(request.VolumeCapabilities))
+			Expect(resp.Confirmed.VolumeContext).To(Equal(request.VolumeContext))
+		})
+
+		It("should look for the volume in its share with the secrets of the request", func() {
+			Expect(fakeMounter.MountCallCount()).To(Equal(1))
+			_, volumeContext, _, secrets := fakeMounter.MountArgsForCall(0)
+			Expect(volumeContext).To(Equal(map[string]string{"share": "//server/export"}))
+			Expect(secrets).To(Equal(request.Secrets))
+			Expect(fakeMounter.UnmountCallCount()).To(Equal(1))
+		})
+
+		Context("when the directory of the volume does not exist", func() {
+			BeforeEach(func() {
+				Expect(os.Remove(filepath.Join(shareDir, "pvc-1"))).To(Succeed())
+			})
+
+			It("should return not found", func() {
+				Expect(err).To(Equal(status.Error(codes.NotFound, "Error: volume '//server/export#pvc-1' does not exist")))
+				Expect(fakeMounter.UnmountCallCount()).To(Equal(1))
+			})
+		})
+
+		Context("when the share cannot be mounted", func() {
+			BeforeEach(func() {
+				fakeMounter.MountReturns("", status.Error(codes.Internal, "Error: mount failed"))
+			})
+
+			It("should return the mount error", func() {
+				Expect(err).To(Equal(status.Error(codes.Internal, "Error: mount failed")))
+			})
+		})
+
+		Context("when a capability is not supported", func() {
+			BeforeEach(func() {
+				request.VolumeCapabilities = []*csi.VolumeCapability{{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+					AccessMode: multiNodeMultiWriter.AccessMode,
+				}}
+			})
+
+			It("should not confirm them and say why", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.Confirmed).To(BeNil())
+				Expect(resp.Message).To(Equal("Error: fsType 'ext4' is not supported, expected cifs"))
+			})
+		})
+
+		Context("when the volume id is not one of the driver", func() {
+			BeforeEach(func() {
+				request.VolumeId = "//server#pvc-1"
+			})
+
+			It("should return not found", func() {
+				Expect(err).To(Equal(status.Error(codes.NotFound, "Error: volume id '//server#pvc-1' is not of the form //server/share#directory")))
+			})
+		})
+
+		Context("when the volume capabilities are missing", func() {
+			BeforeEach(func() {
+				request.VolumeCapabilities = nil
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(Equal(status.Error(codes.InvalidArgument, "Error: a required property [VolumeCapabilities] was not provided")))
+			})
+		})
+	})
+
+	Describe("#ControllerGetCapabilities", func() {
+		It("should advertise volumes, snapshots, clones and expansion", func() {
+			resp, err := controllerServer.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Capabilities).To(ConsistOf(
+				rpcCapability(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME),
+				rpcCapability(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT),
+				rpcCapability(csi.ControllerServiceCapability_RPC_CLONE_VOLUME),
+				rpcCapability(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME),
+			))
+		})
+
+		Context("when the controller has secrets to measure the capacity of shares with", func() {
+			BeforeEach(func() {
+				controllerServer = NewControllerServer(logger, &osshim.OsShim{}, &ioutilshim.IoutilShim{}, &syscallshim.SyscallShim{}, fakeTime, fakeMounter, Config{CapacitySecrets: map[string]string{}})
+			})
+
+			It("should advertise capacity as well", func() {
+				resp, err := controllerServer.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.Capabilities).To(ContainElement(rpcCapability(csi.ControllerServiceCapability_RPC_GET_CAPACITY)))
+			})
+		})
+	})
+})
+
+func rpcCapability(capability csi.ControllerServiceCapability_RPC_Type) *csi.ControllerServiceCapability {
+	return &csi.ControllerServiceCapability{
+		Type: &csi.ControllerServiceCapability_Rpc{
+			Rpc: &csi.ControllerServiceCapability_RPC{Type: capability},
+		},
+	}
+}
+
+// failingOs fails to open the files named failOn, as a share that loses its connection would.
+type failingOs struct {
+	osshim.OsShim
+	failOn string
+}
+
+func (f *failingOs) Open(name string) (osshim.File, error) {
+	if filepath.Base(name) == f.failOn {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EIO}
+	}
+	return f.OsShim.Open(name)
+}
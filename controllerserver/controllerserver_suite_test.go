@@ -0,0 +1,13 @@
+package controllerserver_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestControllerserver(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Controllerserver Suite")
+}
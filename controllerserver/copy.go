@@ -0,0 +1,229 @@
+package controllerserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// copyProgressInterval is how often a running copy logs how far it got.
+const copyProgressInterval = 10 * time.Second
+
+// copier copies the directory tree src and keeps track of its progress.
+type copier struct {
+	server *smbControllerServer
+	logger lager.Logger
+	ctx    context.Context
+	src    string
+
+	files      int64
+	bytes      int64
+	lastReport time.Time
+}
+
+// copyFailure records where in the tree a copy failed. Its message names the path relative to the root of the copy,
+// rather than the path the share happens to be mounted at.
+type copyFailure struct {
+	path string
+	err  error
+}
+
+func (f *copyFailure) Error() string {
+	err := f.err
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	}
+	return fmt.Sprintf("%s: %s", f.path, err.Error())
+}
+
+// copyTree copies src to dst, which must not exist yet. Modes, owners and modification times are copied on a best
+// effort basis, as shares mounted without unix extensions do not keep them. The copy stops when ctx is done.
+func (c *copier) copyTree(dst string) error {
+	c.lastReport = c.server.timeshim.Now()
+
+	info, err := c.server.osshim.Lstat(c.src)
+	if err != nil {
+		return &copyFailure{path: ".", err: err}
+	}
+	return c.copyEntry(".", dst, info)
+}
+
+func (c *copier) copyEntry(relativePath, dst string, info os.FileInfo) error {
+	if err := c.ctx.Err(); err != nil {
+		return &copyFailure{path: relativePath, err: err}
+	}
+	src := filepath.Join(c.src, relativePath)
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := c.server.osshim.Readlink(src)
+		if err == nil {
+			err = c.server.osshim.Symlink(target, dst)
+		}
+		if err != nil {
+			return &copyFailure{path: relativePath, err: err}
+		}
+		c.preserveOwner(relativePath, dst, info)
+		c.copied(relativePath)
+		return nil
+
+	case info.IsDir():
+		err := c.server.osshim.Mkdir(dst, 0700)
+		if err != nil {
+			return &copyFailure{path: relativePath, err: err}
+		}
+		entries, err := c.server.ioutilshim.ReadDir(src)
+		if err != nil {
+			return &copyFailure{path: relativePath, err: err}
+		}
+		for _, entry := range entries {
+			err := c.copyEntry(filepath.Join(relativePath, entry.Name()), filepath.Join(dst, entry.Name()), entry)
+			if err != nil {
+				return err
+			}
+		}
+
+	case info.Mode().IsRegular():
+		n, err := c.copyFile(src, dst)
+		c.bytes += n
+		if err != nil {
+			return &copyFailure{path: relativePath, err: err}
+		}
+
+	default:
+		c.logger.Info("skipping-special-file", lager.Data{"path": relativePath, "mode": info.Mode().String()})
+		return nil
+	}
+
+	c.preserveOwner(relativePath, dst, info)
+	if err := c.server.osshim.Chmod(dst, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		c.logger.Debug("preserve-mode-failed", lager.Data{"path": relativePath, "error": err.Error()})
+	}
+	if err := c.server.osshim.Chtimes(dst, info.ModTime(), info.ModTime()); err != nil {
+		c.logger.Debug("preserve-modification-time-failed", lager.Data{"path": relativePath, "error": err.Error()})
+	}
+	c.copied(relativePath)
+	return nil
+}
+
+func (c *copier) copyFile(src, dst string) (int64, error) {
+	in, err := c.server.osshim.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := c.server.osshim.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(out, in)
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// preserveOwner gives dst the owner of the file it is a copy of. Only shares mounted with unix extensions keep owners.
+func (c *copier) preserveOwner(relativePath, dst string, info os.FileInfo) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	if err := c.server.osshim.Lchown(dst, int(stat.Uid), int(stat.Gid)); err != nil {
+		c.logger.Debug("preserve-owner-failed", lager.Data{"path": relativePath, "error": err.Error()})
+	}
+}
+
+func (c *copier) copied(relativePath string) {
+	c.files++
+
+	now := c.server.timeshim.Now()
+	if now.Sub(c.lastReport) < copyProgressInterval {
+		return
+	}
+	c.lastReport = now
+	c.logger.Info("copy-progress", lager.Data{"src": c.src, "filesCopied": c.files, "bytesCopied": c.bytes, "path": relativePath})
+}
+
+// populate fills the new directory name of dir with a copy of src and returns the number of bytes copied. The copy is
+// made under a hidden name and only renamed to name once it is complete, so a directory named name is always a
+// complete copy.
+func (c *smbControllerServer) populate(ctx context.Context, logger lager.Logger, dir, name, src string) (int64, error) {
+	partial := filepath.Join(dir, "."+name+".partial")
+	err := c.osshim.RemoveAll(partial)
+	if err != nil {
+		logger.Error("remove-partial-copy-failed", err, lager.Data{"dir": partial})
+		return 0, status.Error(codes.Internal, err.Error())
+	}
+
+	copier := &copier{server: c, logger: logger, ctx: ctx, src: src}
+	logger.Info("copy-started", lager.Data{"src": src})
+	err = copier.copyTree(partial)
+	if err != nil {
+		logger.Error("copy-failed", err, lager.Data{"src": src, "filesCopied": copier.files, "bytesCopied": copier.bytes})
+		if removeErr := c.osshim.RemoveAll(partial); removeErr != nil {
+			logger.Error("remove-partial-copy-failed", removeErr, lager.Data{"dir": partial})
+		}
+		return 0, copyError(ctx, copier, err)
+	}
+	logger.Info("copy-finished", lager.Data{"src": src, "filesCopied": copier.files, "bytesCopied": copier.bytes})
+
+	err = c.osshim.Rename(partial, filepath.Join(dir, name))
+	if err != nil {
+		logger.Error("rename-copy-failed", err)
+		return 0, status.Error(codes.Internal, err.Error())
+	}
+	return copier.bytes, nil
+}
+
+// treeSize adds up the sizes of the regular files under dir, which is what a copy of dir writes. It stops when ctx is
+// done.
+func (c *smbControllerServer) treeSize(ctx context.Context, dir string) (int64, error) {
+	entries, err := c.ioutilshim.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		switch {
+		case entry.IsDir():
+			n, err := c.treeSize(ctx, filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return 0, err
+			}
+			size += n
+		case entry.Mode().IsRegular():
+			size += entry.Size()
+		}
+	}
+	return size, nil
+}
+
+func copyError(ctx context.Context, copier *copier, err error) error {
+	progress := fmt.Sprintf("after %d files and %d bytes", copier.files, copier.bytes)
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, fmt.Sprintf("Error: copy did not complete before the deadline %s: %s", progress, err.Error()))
+	case context.Canceled:
+		return status.Error(codes.Canceled, fmt.Sprintf("Error: copy was cancelled %s: %s", progress, err.Error()))
+	}
+	return status.Error(codes.Internal, fmt.Sprintf("Error: copy failed %s: %s", progress, err.Error()))
+}
@@ -0,0 +1,67 @@
+package controllerserver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/lager"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// onDeletePolicy decides what happens to the directory of a volume when it is deleted. It is set by the onDelete
+// parameter of the StorageClass.
+type onDeletePolicy string
+
+const (
+	// onDeleteDelete removes the directory and everything in it.
+	onDeleteDelete onDeletePolicy = "delete"
+	// onDeleteArchive renames the directory to archived-<name>-<timestamp>.
+	onDeleteArchive onDeletePolicy = "archive"
+	// onDeleteRetain leaves the directory as it is.
+	onDeleteRetain onDeletePolicy = "retain"
+)
+
+const archiveTimestampFormat = "20060102T150405Z"
+
+func parseOnDeletePolicy(value string) (onDeletePolicy, error) {
+	switch policy := onDeletePolicy(value); policy {
+	case onDeleteDelete, onDeleteArchive, onDeleteRetain:
+		return policy, nil
+	}
+	return "", status.Error(codes.InvalidArgument, fmt.Sprintf("Error: invalid onDelete parameter '%s', expected one of [delete, archive, retain]", value))
+}
+
+// reclaim applies the onDelete policy of a volume to its directory in the share mounted at dir. A directory that is
+// already gone has nothing left to reclaim.
+func (c *smbControllerServer) reclaim(logger lager.Logger, dir string, id volumeID) error {
+	volumeDir := filepath.Join(dir, id.subDir)
+
+	switch id.onDelete {
+	case onDeleteRetain:
+		logger.Info("retaining-volume-dir", lager.Data{"dir": id.subDir})
+		return nil
+
+	case onDeleteArchive:
+		archiveName := fmt.Sprintf("archived-%s-%s", id.subDir, c.timeshim.Now().UTC().Format(archiveTimestampFormat))
+		err := c.osshim.Rename(volumeDir, filepath.Join(dir, archiveName))
+		if os.IsNotExist(err) {
+			logger.Info("volume-dir-already-gone", lager.Data{"dir": id.subDir})
+			return nil
+		}
+		if err != nil {
+			logger.Error("archive-volume-dir-failed", err)
+			return status.Error(codes.Internal, err.Error())
+		}
+		logger.Info("archived-volume-dir", lager.Data{"dir": id.subDir, "archive": archiveName})
+		return nil
+	}
+
+	err := c.osshim.RemoveAll(volumeDir)
+	if err != nil {
+		logger.Error("remove-volume-dir-failed", err)
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package controllerserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/smb-csi-driver/nodeserver"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// quotaParameter is the StorageClass parameter that gives the volumes of the StorageClass a soft quota. A soft quota
+// is recorded next to the volume, and the nodes report volumes that use more than their quota, but it does not stop
+// writes.
+const quotaParameter = "quota"
+
+// quotaDir is the directory of a share, relative to its root, in which the quotas of its volumes are recorded, one
+// directory per volume name. It is outside every volume directory, so pods cannot change the quota of their volume;
+// the nodes mount the record of a volume read-only, apart from the volume itself.
+const quotaDir = ".quotas"
+
+const softQuota = "soft"
+
+func parseQuotaParameter(value string) (bool, error) {
+	switch value {
+	case softQuota:
+		return true, nil
+	case "none":
+		return false, nil
+	}
+	return false, status.Error(codes.InvalidArgument, fmt.Sprintf("Error: invalid quota parameter '%s', expected one of [soft, none]", value))
+}
+
+// quotaBytes is the quota of a volume with the given capacity range.
+func quotaBytes(capacityRange *csi.CapacityRange) int64 {
+	if capacityRange.GetRequiredBytes() > 0 {
+		return capacityRange.GetRequiredBytes()
+	}
+	return capacityRange.GetLimitBytes()
+}
+
+// quotaRecordDir is the directory of the share mounted at dir that records the quota of the volume name.
+func quotaRecordDir(dir, name string) string {
+	return filepath.Join(dir, quotaDir, name)
+}
+
+// readQuota reads the quota recorded in recordDir, if there is one.
+func (c *smbControllerServer) readQuota(recordDir string) (nodeserver.Quota, bool, error) {
+	var quota nodeserver.Quota
+	data, err := c.ioutilshim.ReadFile(filepath.Join(recordDir, nodeserver.QuotaFileName))
+	if os.IsNotExist(err) {
+		return quota, false, nil
+	}
+	if err != nil {
+		return quota, false, err
+	}
+	err = json.Unmarshal(data, &quota)
+	if err != nil {
+		return quota, false, err
+	}
+	return quota, true, nil
+}
+
+// writeQuota records the quota of a volume in recordDir, replacing any quota it had.
+func (c *smbControllerServer) writeQuota(recordDir string, quota nodeserver.Quota) error {
+	data, err := json.Marshal(quota)
+	if err != nil {
+		return err
+	}
+
+	err = c.osshim.MkdirAll(recordDir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	partial := filepath.Join(recordDir, "."+nodeserver.QuotaFileName+".partial")
+	err = c.ioutilshim.WriteFile(partial, data, 0644)
+	if err != nil {
+		return err
+	}
+	return c.osshim.Rename(partial, filepath.Join(recordDir, nodeserver.QuotaFileName))
+}
+
+// recordQuota gives a new volume the quota of its StorageClass, and drops any quota left behind by an earlier volume
+// of the same name when its StorageClass has none.
+func (c *smbControllerServer) recordQuota(logger lager.Logger, dir string, name string, quotaEnabled bool, limitBytes int64) error {
+	if quotaEnabled {
+		err := c.writeQuota(quotaRecordDir(dir, name), nodeserver.Quota{LimitBytes: limitBytes})
+		if err != nil {
+			logger.Error("write-quota-failed", err)
+			return status.Error(codes.Internal, err.Error())
+		}
+		return nil
+	}
+	return c.removeQuota(logger, dir, name)
+}
+
+// removeQuota drops the quota record of the volume name, if it has one.
+func (c *smbControllerServer) removeQuota(logger lager.Logger, dir string, name string) error {
+	err := c.osshim.RemoveAll(quotaRecordDir(dir, name))
+	if err != nil {
+		logger.Error("remove-quota-failed", err)
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// ControllerExpandVolume raises the quota of a volume with a soft quota. Volumes without a quota are not limited by the
+// driver, so they can grow to the size of their share without any change.
+func (c *smbControllerServer) ControllerExpandVolume(ctx context.Context, r *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	if r.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "VolumeId"))
+	}
+	capacityBytes := quotaBytes(r.CapacityRange)
+	if capacityBytes == 0 {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "CapacityRange"))
+	}
+	id, err := parseVolumeID(r.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	if !c.locks.TryAcquire(id.subDir) {
+		return nil, status.Error(codes.Aborted, fmt.Sprintf(inFlightFmt, id.subDir))
+	}
+	defer c.locks.Release(id.subDir)
+
+	logger := c.logger.Session("expand-volume", lager.Data{"volumeId": r.VolumeId, "capacityBytes": capacityBytes})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	dir, err := c.mounter.Mount(ctx, map[string]string{"share": id.share}, nil, r.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unmount(logger, dir)
+
+	volumeDir := filepath.Join(dir, id.subDir)
+	_, err = c.osshim.Stat(volumeDir)
+	if os.IsNotExist(err) {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("Error: volume '%s' does not exist", r.VolumeId))
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	quota, found, err := c.readQuota(quotaRecordDir(dir, id.subDir))
+	if err != nil {
+		logger.Error("read-quota-failed", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !found {
+		logger.Info("volume-has-no-quota")
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: capacityBytes}, nil
+	}
+
+	// Quotas only grow, so a retried request for a smaller size leaves the quota as it is.
+	if quota.LimitBytes >= capacityBytes {
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: quota.LimitBytes}, nil
+	}
+	err = c.writeQuota(quotaRecordDir(dir, id.subDir), nodeserver.Quota{LimitBytes: capacityBytes})
+	if err != nil {
+		logger.Error("write-quota-failed", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	logger.Info("expanded-quota", lager.Data{"previousLimitBytes": quota.LimitBytes})
+	return &csi.ControllerExpandVolumeResponse{CapacityBytes: capacityBytes}, nil
+}
@@ -0,0 +1,311 @@
+package controllerserver_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/goshims/syscallshim"
+	"code.cloudfoundry.org/goshims/timeshim/time_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "code.cloudfoundry.org/smb-csi-driver/controllerserver"
+	"code.cloudfoundry.org/smb-csi-driver/nodeserver"
+	smbcsidriverfakes "code.cloudfoundry.org/smb-csi-driver/smb-csi-driverfakes"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var _ = Describe("Quotas", func() {
+	var (
+		logger           *lagertest.TestLogger
+		controllerServer csi.ControllerServer
+		ctx              context.Context
+
+		fakeTime    *time_fake.FakeTime
+		fakeMounter *smbcsidriverfakes.FakeShareMounter
+		shareDir    string
+	)
+
+	BeforeEach(func() {
+		var err error
+		shareDir, err = ioutil.TempDir("", "share")
+		Expect(err).NotTo(HaveOccurred())
+
+		logger = lagertest.NewTestLogger("quotas-test")
+		ctx = context.Background()
+		fakeTime = &time_fake.FakeTime{}
+		fakeTime.NowReturns(time.Date(2020, time.May, 4, 11, 14, 15, 0, time.UTC))
+		fakeMounter = &smbcsidriverfakes.FakeShareMounter{}
+		fakeMounter.MountReturns(shareDir, nil)
+
+		controllerServer = NewControllerServer(logger, &osshim.OsShim{}, &ioutilshim.IoutilShim{}, &syscallshim.SyscallShim{}, fakeTime, fakeMounter, Config{})
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(shareDir)).To(Succeed())
+	})
+
+	quotaPath := func(name string) string {
+		return filepath.Join(shareDir, ".quotas", name, nodeserver.QuotaFileName)
+	}
+
+	readQuota := func(name string) string {
+		data, err := ioutil.ReadFile(quotaPath(name))
+		Expect(err).NotTo(HaveOccurred())
+		return string(data)
+	}
+
+	writeQuota := func(name string, quota string) {
+		Expect(os.MkdirAll(filepath.Dir(quotaPath(name)), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(quotaPath(name), []byte(quota), 0644)).To(Succeed())
+	}
+
+	Describe("#CreateVolume", func() {
+		var (
+			request *csi.CreateVolumeRequest
+			resp    *csi.CreateVolumeResponse
+			err     error
+		)
+
+		BeforeEach(func() {
+			request = &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: 1024},
+				VolumeCapabilities: []*csi.VolumeCapability{multiNodeMultiWriter},
+				Parameters:         map[string]string{"share": "//server/export", "quota": "soft"},
+			}
+		})
+
+		JustBeforeEach(func() {
+			resp, err = controllerServer.CreateVolume(ctx, request)
+		})
+
+		It("should record the quota outside the volume directory", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(readQuota("pvc-1")).To(MatchJSON(`{"limitBytes": 1024}`))
+			Expect(filepath.Join(shareDir, "pvc-1", nodeserver.QuotaFileName)).NotTo(BeAnExistingFile())
+			Expect(resp.Volume.CapacityBytes).To(Equal(int64(1024)))
+		})
+
+		It("should tell the nodes where the quota is recorded", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Volume.VolumeContext).To(HaveKeyWithValue("quotaDir", ".quotas/pvc-1"))
+			Expect(resp.Volume.VolumeContext).NotTo(HaveKey("quota"))
+		})
+
+		Context("when the StorageClass has no quota", func() {
+			BeforeEach(func() {
+				request.Parameters["quota"] = "none"
+				writeQuota("pvc-1", `{"limitBytes":512}`)
+			})
+
+			It("should drop the quota left behind by an earlier volume of the same name", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Dir(quotaPath("pvc-1"))).NotTo(BeADirectory())
+				Expect(resp.Volume.VolumeContext).NotTo(HaveKey("quotaDir"))
+			})
+		})
+
+		Context("when only a limit is requested", func() {
+			BeforeEach(func() {
+				request.CapacityRange = &csi.CapacityRange{LimitBytes: 2048}
+			})
+
+			It("should use the limit as the quota", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(readQuota("pvc-1")).To(MatchJSON(`{"limitBytes": 2048}`))
+				Expect(resp.Volume.CapacityBytes).To(Equal(int64(2048)))
+			})
+		})
+
+		Context("when no capacity is requested", func() {
+			BeforeEach(func() {
+				request.CapacityRange = nil
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(Equal(status.Error(codes.InvalidArgument, "Error: volumes with a soft quota need a CapacityRange")))
+				Expect(fakeMounter.MountCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the quota parameter is invalid", func() {
+			BeforeEach(func() {
+				request.Parameters["quota"] = "hard"
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(Equal(status.Error(codes.InvalidArgument, "Error: invalid quota parameter 'hard', expected one of [soft, none]")))
+				Expect(fakeMounter.MountCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the volume is cloned from a volume with a quota", func() {
+			BeforeEach(func() {
+				Expect(os.Mkdir(filepath.Join(shareDir, "pvc-0"), 0755)).To(Succeed())
+				writeQuota("pvc-0", `{"limitBytes":512}`)
+				request.VolumeContentSource = &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "//server/export#pvc-0"}},
+				}
+			})
+
+			It("should record the quota of its own StorageClass", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(readQuota("pvc-1")).To(MatchJSON(`{"limitBytes": 1024}`))
+				Expect(readQuota("pvc-0")).To(MatchJSON(`{"limitBytes": 512}`))
+			})
+		})
+	})
+
+	Describe("#DeleteVolume", func() {
+		BeforeEach(func() {
+			Expect(os.Mkdir(filepath.Join(shareDir, "pvc-1"), 0755)).To(Succeed())
+			writeQuota("pvc-1", `{"limitBytes":1024}`)
+		})
+
+		It("should drop the quota of the volume", func() {
+			_, err := controllerServer.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "//server/export#pvc-1"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Dir(quotaPath("pvc-1"))).NotTo(BeADirectory())
+		})
+
+		It("should drop the quota of a retained volume too", func() {
+			_, err := controllerServer.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "//server/export#pvc-1#retain"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(shareDir, "pvc-1")).To(BeADirectory())
+			Expect(filepath.Dir(quotaPath("pvc-1"))).NotTo(BeADirectory())
+		})
+	})
+
+	Describe("#ControllerExpandVolume", func() {
+		var (
+			request *csi.ControllerExpandVolumeRequest
+			resp    *csi.ControllerExpandVolumeResponse
+			err     error
+		)
+
+		BeforeEach(func() {
+			Expect(os.Mkdir(filepath.Join(shareDir, "pvc-1"), 0755)).To(Succeed())
+			writeQuota("pvc-1", `{"limitBytes":1024}`)
+
+			request = &csi.ControllerExpandVolumeRequest{
+				VolumeId:      "//server/export#pvc-1",
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 4096},
+				Secrets:       map[string]string{"username": "user1", "password": "pass1"},
+			}
+		})
+
+		JustBeforeEach(func() {
+			resp, err = controllerServer.ControllerExpandVolume(ctx, request)
+		})
+
+		It("should raise the quota of the volume", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.CapacityBytes).To(Equal(int64(4096)))
+			Expect(resp.NodeExpansionRequired).To(BeFalse())
+			Expect(readQuota("pvc-1")).To(MatchJSON(`{"limitBytes": 4096}`))
+			Expect(filepath.Join(shareDir, ".quotas", "pvc-1", "."+nodeserver.QuotaFileName+".partial")).NotTo(BeAnExistingFile())
+		})
+
+		It("should mount the share of the volume with the secrets of the request", func() {
+			Expect(fakeMounter.MountCallCount()).To(Equal(1))
+			_, volumeContext, _, secrets := fakeMounter.MountArgsForCall(0)
+			Expect(volumeContext).To(Equal(map[string]string{"share": "//server/export"}))
+			Expect(secrets).To(Equal(request.Secrets))
+			Expect(fakeMounter.UnmountCallCount()).To(Equal(1))
+		})
+
+		Context("when the volume id has an onDelete policy", func() {
+			BeforeEach(func() {
+				request.VolumeId = "//server/export#pvc-1#archive"
+			})
+
+			It("should raise the quota of the volume", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(readQuota("pvc-1")).To(MatchJSON(`{"limitBytes": 4096}`))
+			})
+		})
+
+		Context("when the quota is already at least as large", func() {
+			BeforeEach(func() {
+				request.CapacityRange.RequiredBytes = 512
+			})
+
+			It("should leave the quota as it is", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.CapacityBytes).To(Equal(int64(1024)))
+				Expect(readQuota("pvc-1")).To(MatchJSON(`{"limitBytes": 1024}`))
+			})
+		})
+
+		Context("when the volume has no quota", func() {
+			BeforeEach(func() {
+				Expect(os.RemoveAll(filepath.Dir(quotaPath("pvc-1")))).To(Succeed())
+			})
+
+			It("should succeed without recording a quota", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.CapacityBytes).To(Equal(int64(4096)))
+				Expect(quotaPath("pvc-1")).NotTo(BeAnExistingFile())
+			})
+		})
+
+		Context("when the volume does not exist", func() {
+			BeforeEach(func() {
+				request.VolumeId = "//server/export#pvc-2"
+			})
+
+			It("should return not found", func() {
+				Expect(err).To(Equal(status.Error(codes.NotFound, "Error: volume '//server/export#pvc-2' does not exist")))
+			})
+		})
+
+		Context("when the volume id is invalid", func() {
+			BeforeEach(func() {
+				request.VolumeId = "pvc-1"
+			})
+
+			It("should return not found", func() {
+				Expect(status.Code(err)).To(Equal(codes.NotFound))
+				Expect(fakeMounter.MountCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the capacity range is missing", func() {
+			BeforeEach(func() {
+				request.CapacityRange = nil
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(Equal(status.Error(codes.InvalidArgument, "Error: a required property [CapacityRange] was not provided")))
+			})
+		})
+
+		Context("when the volume id is missing", func() {
+			BeforeEach(func() {
+				request.VolumeId = ""
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(Equal(status.Error(codes.InvalidArgument, "Error: a required property [VolumeId] was not provided")))
+			})
+		})
+
+		Context("when the share cannot be mounted", func() {
+			BeforeEach(func() {
+				fakeMounter.MountReturns("", status.Error(codes.Internal, "Error: mount failed"))
+			})
+
+			It("should return the mount error", func() {
+				Expect(err).To(Equal(status.Error(codes.Internal, "Error: mount failed")))
+			})
+		})
+	})
+})
@@ -0,0 +1,354 @@
+package controllerserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultSnapshotDir is the directory of the share that snapshots of its volumes are stored in.
+const DefaultSnapshotDir = ".snapshots"
+
+// snapshotID identifies a snapshot by the share it lives on, the snapshot dir of that share and its name, as in
+// //server/share#.snapshots/snapshot-1234.
+type snapshotID struct {
+	share string
+	dir   string
+	name  string
+}
+
+func (s snapshotID) String() string {
+	return s.share + "#" + path.Join(s.dir, s.name)
+}
+
+func parseSnapshotID(id string) (snapshotID, error) {
+	parts := strings.Split(id, "#")
+	if len(parts) != 2 || !validShare(parts[0]) || !validSnapshotDir(path.Dir(parts[1])) || !validDirectoryName(path.Base(parts[1])) || path.Clean(parts[1]) != parts[1] {
+		return snapshotID{}, fmt.Errorf("Error: snapshot id '%s' is not of the form //server/share#directory/snapshot", id)
+	}
+	return snapshotID{share: parts[0], dir: path.Dir(parts[1]), name: path.Base(parts[1])}, nil
+}
+
+// validSnapshotDir accepts relative paths inside the share, such as .snapshots or backup/snapshots.
+func validSnapshotDir(dir string) bool {
+	if dir == "" || dir == "." || path.IsAbs(dir) || strings.ContainsAny(dir, "\\#\x00\n\r") {
+		return false
+	}
+	for _, element := range strings.Split(dir, "/") {
+		if element == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// snapshotMetadata is stored next to the copy of a snapshot, in <name>.json. It is written once the copy is complete.
+type snapshotMetadata struct {
+	SourceVolumeID string    `json:"sourceVolumeId"`
+	CreationTime   time.Time `json:"creationTime"`
+	SizeBytes      int64     `json:"sizeBytes"`
+}
+
+func (c *smbControllerServer) CreateSnapshot(ctx context.Context, r *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if r.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "Name"))
+	}
+	if r.SourceVolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "SourceVolumeId"))
+	}
+	if !validDirectoryName(r.Name) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Error: invalid snapshot name '%s'", r.Name))
+	}
+	for key := range r.Parameters {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Error: unknown parameter '%s', snapshots take no parameters", key))
+	}
+	source, err := parseVolumeID(r.SourceVolumeId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	if !c.locks.TryAcquire(r.Name) {
+		return nil, status.Error(codes.Aborted, fmt.Sprintf(inFlightFmt, r.Name))
+	}
+	defer c.locks.Release(r.Name)
+
+	id := snapshotID{share: source.share, dir: c.config.SnapshotDir, name: r.Name}
+	logger := c.logger.Session("create-snapshot", lager.Data{"snapshotId": id.String(), "sourceVolumeId": r.SourceVolumeId})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	dir, err := c.mounter.Mount(ctx, map[string]string{"share": source.share}, nil, r.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unmount(logger, dir)
+
+	snapshot, err := c.readSnapshot(dir, id)
+	if err == nil {
+		if snapshot.SourceVolumeId != r.SourceVolumeId {
+			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("Error: snapshot '%s' already exists for volume '%s'", r.Name, snapshot.SourceVolumeId))
+		}
+		return &csi.CreateSnapshotResponse{Snapshot: snapshot}, nil
+	}
+	if status.Code(err) != codes.NotFound {
+		return nil, err
+	}
+
+	sourceDir := filepath.Join(dir, source.subDir)
+	if _, err := c.osshim.Stat(sourceDir); err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Error(codes.NotFound, fmt.Sprintf("Error: volume '%s' does not exist", r.SourceVolumeId))
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	snapshotDir := filepath.Join(dir, id.dir)
+	err = c.osshim.MkdirAll(snapshotDir, os.ModePerm)
+	if err != nil {
+		logger.Error("create-snapshot-dir-failed", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// A copy without metadata is left over from an earlier attempt that did not complete.
+	err = c.osshim.RemoveAll(filepath.Join(snapshotDir, id.name))
+	if err != nil {
+		logger.Error("remove-incomplete-snapshot-failed", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	creationTime := c.timeshim.Now().UTC()
+	size, err := c.populate(ctx, logger, snapshotDir, id.name, sourceDir)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := snapshotMetadata{SourceVolumeID: r.SourceVolumeId, CreationTime: creationTime, SizeBytes: size}
+	err = c.writeSnapshotMetadata(snapshotDir, id.name, metadata)
+	if err != nil {
+		logger.Error("write-snapshot-metadata-failed", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	snapshot, err = csiSnapshot(id, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return &csi.CreateSnapshotResponse{Snapshot: snapshot}, nil
+}
+
+// DeleteSnapshot removes the copy and the metadata of a snapshot. Snapshots that are already gone, or were never
+// created by this driver, are deleted successfully.
+func (c *smbControllerServer) DeleteSnapshot(ctx context.Context, r *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if r.SnapshotId == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "SnapshotId"))
+	}
+
+	logger := c.logger.Session("delete-snapshot", lager.Data{"snapshotId": r.SnapshotId})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	id, err := parseSnapshotID(r.SnapshotId)
+	if err != nil {
+		logger.Info("not-a-snapshot", lager.Data{"reason": err.Error()})
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	// A snapshot that is still being created is only renamed into place once its copy is complete, so deleting it now
+	// would remove nothing and let it reappear.
+	if !c.locks.TryAcquire(id.name) {
+		return nil, status.Error(codes.Aborted, fmt.Sprintf(inFlightFmt, id.name))
+	}
+	defer c.locks.Release(id.name)
+
+	dir, err := c.mounter.Mount(ctx, map[string]string{"share": id.share}, nil, r.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unmount(logger, dir)
+
+	// The metadata goes first, so that a snapshot that is only partially removed is no longer listed.
+	snapshotDir := filepath.Join(dir, id.dir)
+	err = c.osshim.Remove(filepath.Join(snapshotDir, id.name+".json"))
+	if err != nil && !os.IsNotExist(err) {
+		logger.Error("remove-snapshot-metadata-failed", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	err = c.osshim.RemoveAll(filepath.Join(snapshotDir, id.name))
+	if err != nil {
+		logger.Error("remove-snapshot-failed", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// ListSnapshots lists a single snapshot, or the snapshots of a single volume. The driver does not know every share its
+// volumes live on, so it cannot list all snapshots, and does not advertise LIST_SNAPSHOTS; a request without either
+// filter is refused rather than answered with an empty list.
+func (c *smbControllerServer) ListSnapshots(ctx context.Context, r *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	start := 0
+	if r.StartingToken != "" {
+		var err error
+		start, err = strconv.Atoi(r.StartingToken)
+		if err != nil || start < 0 {
+			return nil, status.Error(codes.Aborted, fmt.Sprintf("Error: invalid starting token '%s'", r.StartingToken))
+		}
+	}
+
+	logger := c.logger.Session("list-snapshots", lager.Data{"snapshotId": r.SnapshotId, "sourceVolumeId": r.SourceVolumeId})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	var snapshots []*csi.Snapshot
+	var err error
+	switch {
+	case r.SnapshotId != "":
+		snapshots, err = c.listSnapshot(ctx, logger, r.SnapshotId, r.SourceVolumeId, r.Secrets)
+	case r.SourceVolumeId != "":
+		snapshots, err = c.listVolumeSnapshots(ctx, logger, r.SourceVolumeId, r.Secrets)
+	default:
+		return nil, status.Error(codes.Unimplemented, "Error: snapshots can only be listed by snapshot or source volume id")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if start > len(snapshots) {
+		return nil, status.Error(codes.Aborted, fmt.Sprintf("Error: invalid starting token '%s'", r.StartingToken))
+	}
+	snapshots = snapshots[start:]
+
+	resp := &csi.ListSnapshotsResponse{}
+	if r.MaxEntries > 0 && int(r.MaxEntries) < len(snapshots) {
+		snapshots = snapshots[:r.MaxEntries]
+		resp.NextToken = strconv.Itoa(start + int(r.MaxEntries))
+	}
+	for _, snapshot := range snapshots {
+		resp.Entries = append(resp.Entries, &csi.ListSnapshotsResponse_Entry{Snapshot: snapshot})
+	}
+	return resp, nil
+}
+
+func (c *smbControllerServer) listSnapshot(ctx context.Context, logger lager.Logger, snapshotId, sourceVolumeId string, secrets map[string]string) ([]*csi.Snapshot, error) {
+	id, err := parseSnapshotID(snapshotId)
+	if err != nil {
+		return nil, nil
+	}
+
+	dir, err := c.mounter.Mount(ctx, map[string]string{"share": id.share}, nil, secrets)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unmount(logger, dir)
+
+	snapshot, err := c.readSnapshot(dir, id)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sourceVolumeId != "" && snapshot.SourceVolumeId != sourceVolumeId {
+		return nil, nil
+	}
+	return []*csi.Snapshot{snapshot}, nil
+}
+
+func (c *smbControllerServer) listVolumeSnapshots(ctx context.Context, logger lager.Logger, sourceVolumeId string, secrets map[string]string) ([]*csi.Snapshot, error) {
+	source, err := parseVolumeID(sourceVolumeId)
+	if err != nil {
+		return nil, nil
+	}
+
+	dir, err := c.mounter.Mount(ctx, map[string]string{"share": source.share}, nil, secrets)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unmount(logger, dir)
+
+	entries, err := c.ioutilshim.ReadDir(filepath.Join(dir, c.config.SnapshotDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		logger.Error("read-snapshot-dir-failed", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	snapshots := []*csi.Snapshot{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !validDirectoryName(entry.Name()) || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		snapshot, err := c.readSnapshot(dir, snapshotID{share: source.share, dir: c.config.SnapshotDir, name: entry.Name()})
+		if status.Code(err) == codes.NotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if snapshot.SourceVolumeId == sourceVolumeId {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].SnapshotId < snapshots[j].SnapshotId })
+	return snapshots, nil
+}
+
+// readSnapshot returns the snapshot id of the share mounted at dir, or NotFound if it does not exist or is incomplete.
+func (c *smbControllerServer) readSnapshot(dir string, id snapshotID) (*csi.Snapshot, error) {
+	data, err := c.ioutilshim.ReadFile(filepath.Join(dir, id.dir, id.name+".json"))
+	if os.IsNotExist(err) {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("Error: snapshot '%s' does not exist", id.String()))
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	var metadata snapshotMetadata
+	err = json.Unmarshal(data, &metadata)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Error: invalid metadata of snapshot '%s': %s", id.String(), err.Error()))
+	}
+	return csiSnapshot(id, metadata)
+}
+
+func (c *smbControllerServer) writeSnapshotMetadata(snapshotDir, name string, metadata snapshotMetadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	partial := filepath.Join(snapshotDir, "."+name+".json.partial")
+	err = c.ioutilshim.WriteFile(partial, data, 0644)
+	if err != nil {
+		return err
+	}
+	return c.osshim.Rename(partial, filepath.Join(snapshotDir, name+".json"))
+}
+
+func csiSnapshot(id snapshotID, metadata snapshotMetadata) (*csi.Snapshot, error) {
+	creationTime, err := ptypes.TimestampProto(metadata.CreationTime)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.Snapshot{
+		SnapshotId:     id.String(),
+		SourceVolumeId: metadata.SourceVolumeID,
+		SizeBytes:      metadata.SizeBytes,
+		CreationTime:   creationTime,
+		ReadyToUse:     true,
+	}, nil
+}
@@ -0,0 +1,633 @@
+package controllerserver_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/goshims/syscallshim"
+	"code.cloudfoundry.org/goshims/timeshim/time_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "code.cloudfoundry.org/smb-csi-driver/controllerserver"
+	smbcsidriverfakes "code.cloudfoundry.org/smb-csi-driver/smb-csi-driverfakes"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var _ = Describe("Snapshots", func() {
+	var (
+		logger           *lagertest.TestLogger
+		controllerServer csi.ControllerServer
+		ctx              context.Context
+		config           Config
+
+		fakeTime    *time_fake.FakeTime
+		fakeMounter *smbcsidriverfakes.FakeShareMounter
+		shareDir    string
+		snapshotAt  time.Time
+	)
+
+	BeforeEach(func() {
+		var err error
+		shareDir, err = ioutil.TempDir("", "share")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(os.MkdirAll(filepath.Join(shareDir, "pvc-1", "nested"), 0750)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(shareDir, "pvc-1", "data"), []byte("data"), 0640)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(shareDir, "pvc-1", "nested", "more-data"), []byte("more data"), 0600)).To(Succeed())
+		Expect(os.Symlink("data", filepath.Join(shareDir, "pvc-1", "link"))).To(Succeed())
+		Expect(os.Chmod(filepath.Join(shareDir, "pvc-1", "nested"), 0750)).To(Succeed())
+
+		logger = lagertest.NewTestLogger("snapshots-test")
+		ctx = context.Background()
+		config = Config{}
+		snapshotAt = time.Date(2020, time.May, 4, 11, 14, 15, 0, time.UTC)
+		fakeTime = &time_fake.FakeTime{}
+		fakeTime.NowReturns(snapshotAt)
+		fakeMounter = &smbcsidriverfakes.FakeShareMounter{}
+		fakeMounter.MountReturns(shareDir, nil)
+	})
+
+	JustBeforeEach(func() {
+		controllerServer = NewControllerServer(logger, &osshim.OsShim{}, &ioutilshim.IoutilShim{}, &syscallshim.SyscallShim{}, fakeTime, fakeMounter, config)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(shareDir)).To(Succeed())
+	})
+
+	createSnapshot := func(name, sourceVolumeId string) *csi.Snapshot {
+		resp, err := controllerServer.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: name, SourceVolumeId: sourceVolumeId})
+		Expect(err).NotTo(HaveOccurred())
+		return resp.Snapshot
+	}
+
+	Describe("#CreateSnapshot", func() {
+		var (
+			request *csi.CreateSnapshotRequest
+			resp    *csi.CreateSnapshotResponse
+			err     error
+		)
+
+		BeforeEach(func() {
+			request = &csi.CreateSnapshotRequest{
+				Name:           "snapshot-1",
+				SourceVolumeId: "//server/export#pvc-1",
+				Secrets:        map[string]string{"username": "user1", "password": "pass1"},
+			}
+		})
+
+		JustBeforeEach(func() {
+			resp, err = controllerServer.CreateSnapshot(ctx, request)
+		})
+
+		It("should copy the directory of the volume into the snapshot dir of its share", func() {
+			Expect(err).NotTo(HaveOccurred())
+
+			snapshotDir := filepath.Join(shareDir, ".snapshots", "snapshot-1")
+			Expect(ioutil.ReadFile(filepath.Join(snapshotDir, "data"))).To(Equal([]byte("data")))
+			Expect(ioutil.ReadFile(filepath.Join(snapshotDir, "nested", "more-data"))).To(Equal([]byte("more data")))
+			Expect(os.Readlink(filepath.Join(snapshotDir, "link"))).To(Equal("data"))
+		})
+
+		It("should preserve the modes of the copied files", func() {
+			Expect(err).NotTo(HaveOccurred())
+
+			snapshotDir := filepath.Join(shareDir, ".snapshots", "snapshot-1")
+			info, statErr := os.Stat(filepath.Join(snapshotDir, "data"))
+			Expect(statErr).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0640)))
+			info, statErr = os.Stat(filepath.Join(snapshotDir, "nested"))
+			Expect(statErr).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0750)))
+		})
+
+		It("should return a snapshot that is ready to use", func() {
+			Expect(err).NotTo(HaveOccurred())
+
+			creationTime, _ := ptypes.TimestampProto(snapshotAt)
+			Expect(resp.Snapshot).To(Equal(&csi.Snapshot{
+				SnapshotId:     "//server/export#.snapshots/snapshot-1",
+				SourceVolumeId: "//server/export#pvc-1",
+				SizeBytes:      int64(len("data") + len("more data")),
+				CreationTime:   creationTime,
+				ReadyToUse:     true,
+			}))
+		})
+
+		It("should mount the share of the volume with the secrets of the request and unmount it afterwards", func() {
+			Expect(fakeMounter.MountCallCount()).To(Equal(1))
+			_, volumeContext, _, secrets := fakeMounter.MountArgsForCall(0)
+			Expect(volumeContext).To(Equal(map[string]string{"share": "//server/export"}))
+			Expect(secrets).To(Equal(request.Secrets))
+			Expect(fakeMounter.UnmountCallCount()).To(Equal(1))
+		})
+
+		It("should leave no partial copies behind", func() {
+			Expect(err).NotTo(HaveOccurred())
+			entries, readErr := ioutil.ReadDir(filepath.Join(shareDir, ".snapshots"))
+			Expect(readErr).NotTo(HaveOccurred())
+			names := []string{}
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			Expect(names).To(ConsistOf("snapshot-1", "snapshot-1.json"))
+		})
+
+		Context("when the snapshot already exists", func() {
+			var first *csi.Snapshot
+
+			BeforeEach(func() {
+				controllerServer = NewControllerServer(logger, &osshim.OsShim{}, &ioutilshim.IoutilShim{}, &syscallshim.SyscallShim{}, fakeTime, fakeMounter, config)
+				first = createSnapshot("snapshot-1", "//server/export#pvc-1")
+				fakeTime.NowReturns(snapshotAt.Add(time.Hour))
+				Expect(ioutil.WriteFile(filepath.Join(shareDir, "pvc-1", "data"), []byte("changed data"), 0640)).To(Succeed())
+			})
+
+			It("should return it without copying the volume again", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.Snapshot).To(Equal(first))
+				Expect(ioutil.ReadFile(filepath.Join(shareDir, ".snapshots", "snapshot-1", "data"))).To(Equal([]byte("data")))
+			})
+
+			Context("for another volume", func() {
+				BeforeEach(func() {
+					request.SourceVolumeId = "//server/export#pvc-2"
+				})
+
+				It("should return an error", func() {
+					Expect(err).To(Equal(status.Error(codes.AlreadyExists, "Error: snapshot 'snapshot-1' already exists for volume '//server/export#pvc-1'")))
+				})
+			})
+		})
+
+		Context("when an earlier attempt left an incomplete copy behind", func() {
+			BeforeEach(func() {
+				Expect(os.MkdirAll(filepath.Join(shareDir, ".snapshots", "snapshot-1"), os.ModePerm)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(shareDir, ".snapshots", "snapshot-1", "stale"), []byte("stale"), 0644)).To(Succeed())
+				Expect(os.MkdirAll(filepath.Join(shareDir, ".snapshots", ".snapshot-1.partial"), os.ModePerm)).To(Succeed())
+			})
+
+			It("should replace it", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Join(shareDir, ".snapshots", "snapshot-1", "stale")).NotTo(BeAnExistingFile())
+				Expect(filepath.Join(shareDir, ".snapshots", "snapshot-1", "data")).To(BeARegularFile())
+				Expect(filepath.Join(shareDir, ".snapshots", ".snapshot-1.partial")).NotTo(BeAnExistingFile())
+			})
+		})
+
+		Context("when a snapshot dir is configured", func() {
+			BeforeEach(func() {
+				config.SnapshotDir = "backup/snapshots"
+			})
+
+			It("should store the snapshot there", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.Snapshot.SnapshotId).To(Equal("//server/export#backup/snapshots/snapshot-1"))
+				Expect(filepath.Join(shareDir, "backup", "snapshots", "snapshot-1", "data")).To(BeARegularFile())
+			})
+		})
+
+		Context("when the request is cancelled", func() {
+			BeforeEach(func() {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				cancel()
+			})
+
+			It("should return an error and leave nothing behind", func() {
+				Expect(err).To(MatchError(ContainSubstring("Error: copy was cancelled")))
+				Expect(status.Code(err)).To(Equal(codes.Canceled))
+				Expect(filepath.Join(shareDir, ".snapshots", "snapshot-1")).NotTo(BeAnExistingFile())
+				Expect(filepath.Join(shareDir, ".snapshots", ".snapshot-1.partial")).NotTo(BeAnExistingFile())
+			})
+		})
+
+		Context("when the source volume does not exist", func() {
+			BeforeEach(func() {
+				request.SourceVolumeId = "//server/export#pvc-2"
+			})
+
+			It("should return not found", func() {
+				Expect(err).To(Equal(status.Error(codes.NotFound, "Error: volume '//server/export#pvc-2' does not exist")))
+			})
+		})
+
+		Context("when the source volume id is not one of the driver", func() {
+			BeforeEach(func() {
+				request.SourceVolumeId = "some-static-volume"
+			})
+
+			It("should return not found", func() {
+				Expect(err).To(Equal(status.Error(codes.NotFound, "Error: volume id 'some-static-volume' is not of the form //server/share#directory")))
+				Expect(fakeMounter.MountCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the name is missing", func() {
+			BeforeEach(func() {
+				request.Name = ""
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(Equal(status.Error(codes.InvalidArgument, "Error: a required property [Name] was not provided")))
+			})
+		})
+
+		Context("when the source volume id is missing", func() {
+			BeforeEach(func() {
+				request.SourceVolumeId = ""
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(Equal(status.Error(codes.InvalidArgument, "Error: a required property [SourceVolumeId] was not provided")))
+			})
+		})
+
+		Context("when the VolumeSnapshotClass has parameters", func() {
+			BeforeEach(func() {
+				request.Parameters = map[string]string{"format": "tar"}
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(Equal(status.Error(codes.InvalidArgument, "Error: unknown parameter 'format', snapshots take no parameters")))
+			})
+		})
+
+		Context("when the share cannot be mounted", func() {
+			BeforeEach(func() {
+				fakeMounter.MountReturns("", status.Error(codes.Internal, "mount error(13): Permission denied"))
+			})
+
+			It("should return the mount error", func() {
+				Expect(err).To(Equal(status.Error(codes.Internal, "mount error(13): Permission denied")))
+			})
+		})
+	})
+
+	Describe("#DeleteSnapshot", func() {
+		var (
+			request *csi.DeleteSnapshotRequest
+			err     error
+		)
+
+		BeforeEach(func() {
+			request = &csi.DeleteSnapshotRequest{SnapshotId: "//server/export#.snapshots/snapshot-1"}
+		})
+
+		JustBeforeEach(func() {
+			createSnapshot("snapshot-1", "//server/export#pvc-1")
+			_, err = controllerServer.DeleteSnapshot(ctx, request)
+		})
+
+		It("should remove the copy and the metadata of the snapshot", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(shareDir, ".snapshots", "snapshot-1")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(shareDir, ".snapshots", "snapshot-1.json")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(shareDir, "pvc-1", "data")).To(BeARegularFile())
+		})
+
+		Context("when the snapshot is already gone", func() {
+			BeforeEach(func() {
+				request.SnapshotId = "//server/export#.snapshots/snapshot-2"
+			})
+
+			It("should succeed", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Join(shareDir, ".snapshots", "snapshot-1")).To(BeADirectory())
+			})
+		})
+
+		Context("when the snapshot id is not one of the driver", func() {
+			BeforeEach(func() {
+				request.SnapshotId = "//server/export#../snapshot-1"
+			})
+
+			It("should succeed without mounting the share again", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeMounter.MountCallCount()).To(Equal(1))
+				Expect(filepath.Join(shareDir, ".snapshots", "snapshot-1")).To(BeADirectory())
+			})
+		})
+
+		Context("when the snapshot id is missing", func() {
+			BeforeEach(func() {
+				request.SnapshotId = ""
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(Equal(status.Error(codes.InvalidArgument, "Error: a required property [SnapshotId] was not provided")))
+			})
+		})
+	})
+
+	Describe("#DeleteSnapshot while the snapshot is being created", func() {
+		var (
+			unblock chan struct{}
+			done    chan struct{}
+			err     error
+		)
+
+		JustBeforeEach(func() {
+			unblock = make(chan struct{})
+			done = make(chan struct{})
+			blocked := unblock
+			fakeMounter.MountStub = func(context.Context, map[string]string, []string, map[string]string) (string, error) {
+				<-blocked
+				return shareDir, nil
+			}
+
+			go func() {
+				defer close(done)
+				_, _ = controllerServer.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snapshot-1", SourceVolumeId: "//server/export#pvc-1"})
+			}()
+			Eventually(fakeMounter.MountCallCount).Should(Equal(1))
+
+			_, err = controllerServer.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: "//server/export#.snapshots/snapshot-1"})
+		})
+
+		AfterEach(func() {
+			close(unblock)
+			Eventually(done).Should(BeClosed())
+		})
+
+		It("should return aborted without touching the share", func() {
+			Expect(err).To(Equal(status.Error(codes.Aborted, "Error: an operation on [snapshot-1] is already in progress")))
+			Expect(fakeMounter.MountCallCount()).To(Equal(1))
+		})
+	})
+
+	Describe("#ListSnapshots", func() {
+		var (
+			request *csi.ListSnapshotsRequest
+			resp    *csi.ListSnapshotsResponse
+			err     error
+		)
+
+		BeforeEach(func() {
+			Expect(os.MkdirAll(filepath.Join(shareDir, "pvc-2"), os.ModePerm)).To(Succeed())
+			request = &csi.ListSnapshotsRequest{}
+		})
+
+		JustBeforeEach(func() {
+			createSnapshot("snapshot-b", "//server/export#pvc-1")
+			createSnapshot("snapshot-a", "//server/export#pvc-1")
+			createSnapshot("snapshot-c", "//server/export#pvc-2")
+			resp, err = controllerServer.ListSnapshots(ctx, request)
+		})
+
+		snapshotIds := func(resp *csi.ListSnapshotsResponse) []string {
+			ids := []string{}
+			for _, entry := range resp.Entries {
+				ids = append(ids, entry.Snapshot.SnapshotId)
+			}
+			return ids
+		}
+
+		Context("by snapshot id", func() {
+			BeforeEach(func() {
+				request.SnapshotId = "//server/export#.snapshots/snapshot-c"
+			})
+
+			It("should list the snapshot", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.Entries).To(HaveLen(1))
+				Expect(resp.Entries[0].Snapshot.SourceVolumeId).To(Equal("//server/export#pvc-2"))
+				Expect(resp.Entries[0].Snapshot.ReadyToUse).To(BeTrue())
+			})
+
+			Context("when the snapshot does not exist", func() {
+				BeforeEach(func() {
+					request.SnapshotId = "//server/export#.snapshots/snapshot-d"
+				})
+
+				It("should list nothing", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(resp.Entries).To(BeEmpty())
+				})
+			})
+
+			Context("when the snapshot is not of the requested volume", func() {
+				BeforeEach(func() {
+					request.SourceVolumeId = "//server/export#pvc-1"
+				})
+
+				It("should list nothing", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(resp.Entries).To(BeEmpty())
+				})
+			})
+		})
+
+		Context("by source volume id", func() {
+			BeforeEach(func() {
+				request.SourceVolumeId = "//server/export#pvc-1"
+			})
+
+			It("should list the snapshots of the volume in order", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(snapshotIds(resp)).To(Equal([]string{
+					"//server/export#.snapshots/snapshot-a",
+					"//server/export#.snapshots/snapshot-b",
+				}))
+				Expect(resp.NextToken).To(BeEmpty())
+			})
+
+			Context("when the snapshots are listed in pages", func() {
+				BeforeEach(func() {
+					request.MaxEntries = 1
+				})
+
+				It("should return a token for the next page", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(snapshotIds(resp)).To(Equal([]string{"//server/export#.snapshots/snapshot-a"}))
+					Expect(resp.NextToken).To(Equal("1"))
+
+					request.StartingToken = resp.NextToken
+					resp, err = controllerServer.ListSnapshots(ctx, request)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(snapshotIds(resp)).To(Equal([]string{"//server/export#.snapshots/snapshot-b"}))
+					Expect(resp.NextToken).To(BeEmpty())
+				})
+			})
+
+			Context("when the starting token is invalid", func() {
+				BeforeEach(func() {
+					request.StartingToken = "5"
+				})
+
+				It("should return aborted", func() {
+					Expect(err).To(Equal(status.Error(codes.Aborted, "Error: invalid starting token '5'")))
+				})
+			})
+
+			Context("when the volume has no snapshots", func() {
+				BeforeEach(func() {
+					request.SourceVolumeId = "//server/export#pvc-3"
+				})
+
+				It("should list nothing", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(resp.Entries).To(BeEmpty())
+				})
+			})
+
+			Context("when the share has no snapshot dir", func() {
+				var emptyShareDir string
+
+				BeforeEach(func() {
+					var tempErr error
+					emptyShareDir, tempErr = ioutil.TempDir("", "empty-share")
+					Expect(tempErr).NotTo(HaveOccurred())
+					fakeMounter.MountReturnsOnCall(3, emptyShareDir, nil)
+				})
+
+				AfterEach(func() {
+					Expect(os.RemoveAll(emptyShareDir)).To(Succeed())
+				})
+
+				It("should list nothing", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(resp.Entries).To(BeEmpty())
+				})
+			})
+		})
+
+		Context("without a filter", func() {
+			It("should refuse to list all snapshots, as the shares of the driver are unknown", func() {
+				Expect(err).To(Equal(status.Error(codes.Unimplemented, "Error: snapshots can only be listed by snapshot or source volume id")))
+				Expect(fakeMounter.MountCallCount()).To(Equal(3), "only the snapshots should have been mounted")
+			})
+		})
+	})
+
+	Describe("#CreateVolume from a snapshot", func() {
+		var (
+			request *csi.CreateVolumeRequest
+			resp    *csi.CreateVolumeResponse
+			err     error
+		)
+
+		BeforeEach(func() {
+			request = &csi.CreateVolumeRequest{
+				Name:               "pvc-restored",
+				VolumeCapabilities: []*csi.VolumeCapability{multiNodeMultiWriter},
+				Parameters:         map[string]string{"share": "//server/export"},
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Snapshot{
+						Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "//server/export#.snapshots/snapshot-1"},
+					},
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			createSnapshot("snapshot-1", "//server/export#pvc-1")
+			Expect(ioutil.WriteFile(filepath.Join(shareDir, "pvc-1", "data"), []byte("changed data"), 0640)).To(Succeed())
+			resp, err = controllerServer.CreateVolume(ctx, request)
+		})
+
+		It("should create the volume as a copy of the snapshot", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.ReadFile(filepath.Join(shareDir, "pvc-restored", "data"))).To(Equal([]byte("data")))
+			Expect(ioutil.ReadFile(filepath.Join(shareDir, "pvc-restored", "nested", "more-data"))).To(Equal([]byte("more data")))
+			Expect(filepath.Join(shareDir, ".pvc-restored.partial")).NotTo(BeAnExistingFile())
+		})
+
+		It("should return the content source of the volume", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Volume.VolumeId).To(Equal("//server/export#pvc-restored"))
+			Expect(resp.Volume.ContentSource).To(Equal(request.VolumeContentSource))
+		})
+
+		Context("when the volume was already restored", func() {
+			BeforeEach(func() {
+				Expect(os.MkdirAll(filepath.Join(shareDir, "pvc-restored"), os.ModePerm)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(shareDir, "pvc-restored", "new-data"), []byte("new data"), 0644)).To(Succeed())
+			})
+
+			It("should leave it as it is", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Join(shareDir, "pvc-restored", "new-data")).To(BeARegularFile())
+				Expect(filepath.Join(shareDir, "pvc-restored", "data")).NotTo(BeAnExistingFile())
+			})
+		})
+
+		Context("when the snapshot is on another share", func() {
+			var otherShareDir string
+
+			BeforeEach(func() {
+				otherShareDir, err = ioutil.TempDir("", "other-share")
+				Expect(err).NotTo(HaveOccurred())
+				fakeMounter.MountReturnsOnCall(1, otherShareDir, nil)
+				fakeMounter.MountReturnsOnCall(2, shareDir, nil)
+				request.Parameters["share"] = "//server/other"
+			})
+
+			AfterEach(func() {
+				Expect(os.RemoveAll(otherShareDir)).To(Succeed())
+			})
+
+			It("should mount the share of the snapshot as well", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeMounter.MountCallCount()).To(Equal(3))
+				_, volumeContext, _, _ := fakeMounter.MountArgsForCall(2)
+				Expect(volumeContext).To(Equal(map[string]string{"share": "//server/export"}))
+				Expect(ioutil.ReadFile(filepath.Join(otherShareDir, "pvc-restored", "data"))).To(Equal([]byte("data")))
+				Expect(fakeMounter.UnmountCallCount()).To(Equal(3))
+			})
+		})
+
+		Context("when the snapshot is larger than the limit of the capacity range", func() {
+			BeforeEach(func() {
+				request.CapacityRange = &csi.CapacityRange{LimitBytes: 12}
+			})
+
+			It("should return out of range and create nothing", func() {
+				Expect(err).To(Equal(status.Error(codes.OutOfRange, "Error: the content source holds 13 bytes, more than the limit of 12 bytes")))
+				Expect(filepath.Join(shareDir, "pvc-restored")).NotTo(BeAnExistingFile())
+				Expect(filepath.Join(shareDir, ".pvc-restored.partial")).NotTo(BeAnExistingFile())
+			})
+		})
+
+		Context("when the snapshot fits the limit of the capacity range", func() {
+			BeforeEach(func() {
+				request.CapacityRange = &csi.CapacityRange{LimitBytes: 13}
+			})
+
+			It("should restore it", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ioutil.ReadFile(filepath.Join(shareDir, "pvc-restored", "data"))).To(Equal([]byte("data")))
+			})
+		})
+
+		Context("when the snapshot does not exist", func() {
+			BeforeEach(func() {
+				request.VolumeContentSource.GetSnapshot().SnapshotId = "//server/export#.snapshots/snapshot-2"
+			})
+
+			It("should return not found and create nothing", func() {
+				Expect(err).To(Equal(status.Error(codes.NotFound, "Error: snapshot '//server/export#.snapshots/snapshot-2' does not exist")))
+				Expect(filepath.Join(shareDir, "pvc-restored")).NotTo(BeAnExistingFile())
+			})
+		})
+
+		Context("when the snapshot id is not one of the driver", func() {
+			BeforeEach(func() {
+				request.VolumeContentSource.GetSnapshot().SnapshotId = "snapshot-1"
+			})
+
+			It("should return not found", func() {
+				Expect(err).To(Equal(status.Error(codes.NotFound, "Error: snapshot id 'snapshot-1' is not of the form //server/share#directory/snapshot")))
+			})
+		})
+	})
+})
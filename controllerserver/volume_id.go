@@ -0,0 +1,48 @@
+package controllerserver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// volumeID identifies a provisioned volume by the share it lives on and its directory on that share, as in
+// //server/share#pvc-1234. The server is the first element of the share. Volumes that are not deleted with their PV
+// carry their onDelete policy in a third element, as in //server/share#pvc-1234#archive.
+type volumeID struct {
+	share    string
+	subDir   string
+	onDelete onDeletePolicy
+}
+
+func (v volumeID) String() string {
+	if v.onDelete == "" || v.onDelete == onDeleteDelete {
+		return v.share + "#" + v.subDir
+	}
+	return v.share + "#" + v.subDir + "#" + string(v.onDelete)
+}
+
+func parseVolumeID(id string) (volumeID, error) {
+	parts := strings.Split(id, "#")
+	if len(parts) != 2 && len(parts) != 3 || !validShare(parts[0]) || !validDirectoryName(parts[1]) || parts[1] == "" {
+		return volumeID{}, fmt.Errorf("Error: volume id '%s' is not of the form //server/share#directory", id)
+	}
+
+	onDelete := onDeleteDelete
+	if len(parts) == 3 {
+		var err error
+		onDelete, err = parseOnDeletePolicy(parts[2])
+		if err != nil {
+			return volumeID{}, fmt.Errorf("Error: volume id '%s' is not of the form //server/share#directory", id)
+		}
+	}
+	return volumeID{share: parts[0], subDir: parts[1], onDelete: onDelete}, nil
+}
+
+// validShare accepts shares of the form //server/share.
+func validShare(share string) bool {
+	if !strings.HasPrefix(share, "//") {
+		return false
+	}
+	server := strings.SplitN(strings.TrimPrefix(share, "//"), "/", 2)
+	return len(server) == 2 && server[0] != "" && server[1] != ""
+}
@@ -0,0 +1,110 @@
+package controllerserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// volumeRecordDir is the directory of a share, relative to its root, in which the controller records the request each
+// of its volumes was created with, in <name>.json. A retried CreateVolume is compared against it, so that a request
+// for an existing volume with another capacity, other parameters or another content source is refused.
+const volumeRecordDir = ".volumes"
+
+type volumeRecord struct {
+	RequiredBytes int64             `json:"requiredBytes"`
+	LimitBytes    int64             `json:"limitBytes"`
+	Parameters    map[string]string `json:"parameters"`
+	ContentSource string            `json:"contentSource,omitempty"`
+}
+
+func volumeRecordFrom(r *csi.CreateVolumeRequest) volumeRecord {
+	record := volumeRecord{
+		RequiredBytes: r.GetCapacityRange().GetRequiredBytes(),
+		LimitBytes:    r.GetCapacityRange().GetLimitBytes(),
+		Parameters:    r.Parameters,
+	}
+	if record.Parameters == nil {
+		record.Parameters = map[string]string{}
+	}
+	switch source := r.GetVolumeContentSource().GetType().(type) {
+	case *csi.VolumeContentSource_Snapshot:
+		record.ContentSource = "snapshot:" + source.Snapshot.GetSnapshotId()
+	case *csi.VolumeContentSource_Volume:
+		record.ContentSource = "volume:" + source.Volume.GetVolumeId()
+	}
+	return record
+}
+
+func volumeRecordPath(dir, name string) string {
+	return filepath.Join(dir, volumeRecordDir, name+".json")
+}
+
+// checkVolumeRecord refuses a CreateVolume for a volume whose directory already exists in the share mounted at dir, but
+// that was created with a different request. A directory without a record, e.g. one whose creation was interrupted
+// before the record was written, is taken over by the request.
+func (c *smbControllerServer) checkVolumeRecord(logger lager.Logger, dir, name string, record volumeRecord) error {
+	_, err := c.osshim.Stat(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	data, err := c.ioutilshim.ReadFile(volumeRecordPath(dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		logger.Error("read-volume-record-failed", err)
+		return status.Error(codes.Internal, err.Error())
+	}
+	var existing volumeRecord
+	err = json.Unmarshal(data, &existing)
+	if err != nil {
+		logger.Error("parse-volume-record-failed", err)
+		return status.Error(codes.Internal, err.Error())
+	}
+	if !reflect.DeepEqual(existing, record) {
+		return status.Error(codes.AlreadyExists, fmt.Sprintf("Error: volume '%s' already exists with a different capacity, parameters or content source", name))
+	}
+	return nil
+}
+
+// writeVolumeRecord records the request a volume is created with, replacing any record it had.
+func (c *smbControllerServer) writeVolumeRecord(logger lager.Logger, dir, name string, record volumeRecord) error {
+	data, err := json.Marshal(record)
+	if err == nil {
+		err = c.osshim.MkdirAll(filepath.Join(dir, volumeRecordDir), os.ModePerm)
+	}
+	partial := filepath.Join(dir, volumeRecordDir, "."+name+".json.partial")
+	if err == nil {
+		err = c.ioutilshim.WriteFile(partial, data, 0644)
+	}
+	if err == nil {
+		err = c.osshim.Rename(partial, volumeRecordPath(dir, name))
+	}
+	if err != nil {
+		logger.Error("write-volume-record-failed", err)
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// removeVolumeRecord drops the record of the volume name, if it has one.
+func (c *smbControllerServer) removeVolumeRecord(logger lager.Logger, dir, name string) error {
+	err := c.osshim.Remove(volumeRecordPath(dir, name))
+	if err != nil && !os.IsNotExist(err) {
+		logger.Error("remove-volume-record-failed", err)
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
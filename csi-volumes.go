@@ -5,6 +5,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	_ "github.com/onsi/gomega"
 	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/kubernetes/test/e2e/framework"
 	"k8s.io/kubernetes/test/e2e/framework/volume"
@@ -13,6 +14,7 @@ import (
 	"k8s.io/kubernetes/test/e2e/storage/utils"
 	local_k8s_cluster "code.cloudfoundry.org/smb-volume-k8s-local-cluster"
 	"os"
+	"strconv"
 )
 
 var CSITestSuites = []func() testsuites.TestSuite{
@@ -48,21 +50,15 @@ type smbVolume struct {
 var _ testsuites.TestDriver = &noopTestDriver{}
 var _ testsuites.PreprovisionedVolumeTestDriver = &noopTestDriver{}
 var _ testsuites.PreprovisionedPVTestDriver = &noopTestDriver{}
+var _ testsuites.DynamicPVTestDriver = &noopTestDriver{}
 
+// GetPersistentVolumeSource returns a pre-provisioned PV with only a nodePublishSecretRef, as PVs were written before the
+// driver staged volumes, so that the suites cover volumes that are mounted for every pod rather than staged.
 func (n noopTestDriver) GetPersistentVolumeSource(readOnly bool, fsType string, testVolume testsuites.TestVolume) (*v1.PersistentVolumeSource, *v1.VolumeNodeAffinity) {
 	vol, _ := testVolume.(*smbVolume)
 
 	share := fmt.Sprintf("//%s/example1", vol.serverIP)
-
-	local_k8s_cluster.Kubectl(
-		"create",
-		"secret",
-		"generic",
-		"secretref",
-		fmt.Sprintf("--from-literal=username=%s", vol.username),
-		fmt.Sprintf("--from-literal=password=%s", vol.password),
-		"-n", vol.namespace,
-		)
+	createSecret(vol)
 
 	return &v1.PersistentVolumeSource{
 		CSI: &v1.CSIPersistentVolumeSource{
@@ -72,7 +68,7 @@ func (n noopTestDriver) GetPersistentVolumeSource(readOnly bool, fsType string,
 				"username": vol.username,
 				"password": vol.password,
 				"share":    share,
-				"readOnly": "true",
+				"readOnly": strconv.FormatBool(readOnly),
 			},
 			NodePublishSecretRef: &v1.SecretReference{
 				Name: "secretref",
@@ -82,6 +78,36 @@ func (n noopTestDriver) GetPersistentVolumeSource(readOnly bool, fsType string,
 	}, nil
 }
 
+// GetDynamicProvisionStorageClass starts an SMB server for the test, as CreateVolume does for pre-provisioned volumes,
+// and returns a StorageClass that provisions volumes in its share. The server is removed with the namespace of the
+// test, after the volumes provisioned in it are deleted.
+func (n noopTestDriver) GetDynamicProvisionStorageClass(config *testsuites.PerTestConfig, fsType string) *storagev1.StorageClass {
+	vol, _ := n.CreateVolume(config, testpatterns.DynamicPV).(*smbVolume)
+	createSecret(vol)
+
+	parameters := map[string]string{
+		"share": fmt.Sprintf("//%s/example1", vol.serverIP),
+		"csi.storage.k8s.io/provisioner-secret-name":      "secretref",
+		"csi.storage.k8s.io/provisioner-secret-namespace": vol.namespace,
+		"csi.storage.k8s.io/node-stage-secret-name":       "secretref",
+		"csi.storage.k8s.io/node-stage-secret-namespace":  vol.namespace,
+	}
+	return testsuites.GetStorageClass("org.cloudfoundry.smb", parameters, nil, config.Framework.Namespace.Name, config.Prefix)
+}
+
+// createSecret stores the credentials of the SMB server of vol in the secret "secretref" of its namespace.
+func createSecret(vol *smbVolume) {
+	local_k8s_cluster.Kubectl(
+		"create",
+		"secret",
+		"generic",
+		"secretref",
+		fmt.Sprintf("--from-literal=username=%s", vol.username),
+		fmt.Sprintf("--from-literal=password=%s", vol.password),
+		"-n", vol.namespace,
+		)
+}
+
 func (n noopTestDriver) GetDriverInfo() *testsuites.DriverInfo {
 	return &testsuites.DriverInfo{
 		Name:            "org.cloudfoundry.smb",
@@ -94,9 +120,6 @@ func (n noopTestDriver) GetDriverInfo() *testsuites.DriverInfo {
 }
 
 func (n noopTestDriver) SkipUnsupportedTest(pattern testpatterns.TestPattern) {
-	if pattern.VolType == testpatterns.DynamicPV {
-		framework.Skipf("SMB Driver does not support dynamic provisioning -- skipping")
-	}
 }
 
 func (n noopTestDriver) PrepareTest(f *framework.Framework) (*testsuites.PerTestConfig, func()) {
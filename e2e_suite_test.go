@@ -50,6 +50,11 @@ var _ = BeforeSuite(func() {
 		return local_k8s_cluster.Kubectl("get", "pod", "-l", "app=csi-nodeplugin-smbplugin", "-n", namespace)
 	}, 10 * time.Minute, 1 * time.Second).Should(ContainSubstring("Running"))
 
+	// The dynamically provisioned volumes of the tests are created by the controller
+	Eventually(func()string{
+		return local_k8s_cluster.Kubectl("get", "pod", "-l", "app=csi-controller-smbplugin", "-n", namespace)
+	}, 10 * time.Minute, 1 * time.Second).Should(ContainSubstring("Running"))
+
 	By("pulling the image into the docker daemon", func() {
 		local_k8s_cluster.Docker("pull", "localhost:5000/cfpersi/smb-csi-driver:local-test")
 	})
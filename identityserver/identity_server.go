@@ -2,14 +2,54 @@ package identityserver
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/goshims/execshim"
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+// The run modes of the driver.
+const (
+	NodeMode       = "node"
+	ControllerMode = "controller"
 )
 
+const filesystemsPath = "/proc/filesystems"
+const kernelReleasePath = "/proc/sys/kernel/osrelease"
+const modulesDir = "/lib/modules"
+
+type Config struct {
+	// Mode is the run mode of the driver, NodeMode or ControllerMode.
+	Mode string
+	// SocketDir is the directory of the unix socket the driver serves on. It is not checked when it is empty.
+	SocketDir string
+}
+
 type smbIdentityServer struct {
+	logger     lager.Logger
+	execshim   execshim.Exec
+	ioutilshim ioutilshim.Ioutil
+	osshim     osshim.Os
+	config     Config
 }
 
-func NewSmbIdentityServer()  csi.IdentityServer{
-	return &smbIdentityServer{}
+// NewSmbIdentityServer returns an identity service that advertises the services of the run mode of the driver, and
+// probes whether the node can mount shares.
+func NewSmbIdentityServer(logger lager.Logger, execshim execshim.Exec, ioutilshim ioutilshim.Ioutil, osshim osshim.Os, config Config) csi.IdentityServer {
+	return &smbIdentityServer{
+		logger:     logger,
+		execshim:   execshim,
+		ioutilshim: ioutilshim,
+		osshim:     osshim,
+		config:     config,
+	}
 }
 
 func (*smbIdentityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
@@ -17,11 +57,90 @@ func (*smbIdentityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginI
 		Name: "org.cloudfoundry.smb",
 	}, nil
 }
-func (*smbIdentityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
-	return &csi.GetPluginCapabilitiesResponse{}, nil
+
+// GetPluginCapabilities advertises the controller service, and the online expansion of its volumes, in ControllerMode.
+// Volumes are not constrained to any topology, as every node can reach the shares, so the driver does not advertise
+// VOLUME_ACCESSIBILITY_CONSTRAINTS.
+func (s *smbIdentityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	resp := &csi.GetPluginCapabilitiesResponse{}
+	if s.config.Mode == ControllerMode {
+		resp.Capabilities = []*csi.PluginCapability{
+			{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{Type: csi.PluginCapability_Service_CONTROLLER_SERVICE},
+				},
+			},
+			{
+				Type: &csi.PluginCapability_VolumeExpansion_{
+					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{Type: csi.PluginCapability_VolumeExpansion_ONLINE},
+				},
+			},
+		}
+	}
+	return resp, nil
 }
 
-func (*smbIdentityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	return &csi.ProbeResponse{}, nil
+// Probe reports the driver as not ready when shares cannot be mounted, because the kernel has no cifs module or
+// mount.cifs is not installed, or when the directory of its socket is gone.
+func (s *smbIdentityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	ready := true
+	for _, check := range []func() error{s.checkSocketDir, s.checkMountHelper, s.checkCifsModule} {
+		if err := check(); err != nil {
+			s.logger.Error("probe-not-ready", err)
+			ready = false
+		}
+	}
+	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: ready}}, nil
 }
 
+func (s *smbIdentityServer) checkSocketDir() error {
+	if s.config.SocketDir == "" {
+		return nil
+	}
+	info, err := s.osshim.Stat(s.config.SocketDir)
+	if err != nil {
+		return fmt.Errorf("socket dir unavailable: %s", err.Error())
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("socket dir unavailable: %s is not a directory", s.config.SocketDir)
+	}
+	return nil
+}
+
+func (s *smbIdentityServer) checkMountHelper() error {
+	_, err := s.execshim.LookPath("mount.cifs")
+	if err != nil {
+		return fmt.Errorf("mount.cifs unavailable: %s", err.Error())
+	}
+	return nil
+}
+
+// checkCifsModule accepts a kernel that has the cifs filesystem loaded, or a cifs module it loads on the first mount.
+func (s *smbIdentityServer) checkCifsModule() error {
+	filesystems, err := s.ioutilshim.ReadFile(filesystemsPath)
+	if err != nil {
+		return fmt.Errorf("cifs kernel module unavailable: %s", err.Error())
+	}
+	for _, line := range strings.Split(string(filesystems), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[len(fields)-1] == "cifs" {
+			return nil
+		}
+	}
+
+	release, err := s.ioutilshim.ReadFile(kernelReleasePath)
+	if err != nil {
+		return fmt.Errorf("cifs kernel module unavailable: %s", err.Error())
+	}
+	modules, err := s.ioutilshim.ReadFile(filepath.Join(modulesDir, strings.TrimSpace(string(release)), "modules.dep"))
+	if err != nil {
+		return fmt.Errorf("cifs kernel module unavailable: it is not loaded and %s", err.Error())
+	}
+	for _, line := range strings.Split(string(modules), "\n") {
+		module := strings.SplitN(line, ":", 2)[0]
+		if strings.HasPrefix(filepath.Base(module), "cifs.ko") {
+			return nil
+		}
+	}
+	return errors.New("cifs kernel module unavailable: it is neither loaded nor installed")
+}
@@ -1,22 +1,59 @@
 package identityserver_test
 
 import (
-	. "code.cloudfoundry.org/smb-csi-driver/identityserver"
 	"context"
+	"errors"
+	"os"
+
+	"code.cloudfoundry.org/goshims/execshim/exec_fake"
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "code.cloudfoundry.org/smb-csi-driver/identityserver"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gbytes"
 )
 
 var _ = Describe("IdentityServer", func() {
 	var (
 		ctx    context.Context
+		logger *lagertest.TestLogger
 		server csi.IdentityServer
+		config Config
+
+		fakeExec   *exec_fake.FakeExec
+		fakeIoutil *ioutil_fake.FakeIoutil
+		fakeOs     *os_fake.FakeOs
+		files      map[string]string
 	)
 
 	BeforeEach(func() {
 		ctx = context.Background()
-		server = NewSmbIdentityServer()
+		logger = lagertest.NewTestLogger("identity-server-test")
+		config = Config{Mode: NodeMode, SocketDir: "/plugin"}
+
+		fakeExec = &exec_fake.FakeExec{}
+		fakeExec.LookPathReturns("/sbin/mount.cifs", nil)
+		files = map[string]string{
+			"/proc/filesystems": "nodev\tsysfs\nnodev\tproc\n\text4\nnodev\tcifs\n",
+		}
+		fakeIoutil = &ioutil_fake.FakeIoutil{}
+		fakeIoutil.ReadFileStub = func(path string) ([]byte, error) {
+			content, ok := files[path]
+			if !ok {
+				return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+			}
+			return []byte(content), nil
+		}
+		fakeOs = &os_fake.FakeOs{}
+		fakeOs.StatReturns(&fakeDirInfo{}, nil)
+	})
+
+	JustBeforeEach(func() {
+		server = NewSmbIdentityServer(logger, fakeExec, fakeIoutil, fakeOs, config)
 	})
 
 	Describe("#GetPluginInfo", func() {
@@ -35,14 +72,145 @@ var _ = Describe("IdentityServer", func() {
 			Expect(err).NotTo(HaveOccurred())
 			Expect(resp).To(Equal(&csi.GetPluginCapabilitiesResponse{}))
 		})
+
+		Context("when the driver runs the controller service", func() {
+			BeforeEach(func() {
+				config.Mode = ControllerMode
+			})
+
+			It("should advertise the controller service and online volume expansion", func() {
+				resp, err := server.GetPluginCapabilities(ctx, &csi.GetPluginCapabilitiesRequest{})
+
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.Capabilities).To(ConsistOf(
+					&csi.PluginCapability{
+						Type: &csi.PluginCapability_Service_{
+							Service: &csi.PluginCapability_Service{Type: csi.PluginCapability_Service_CONTROLLER_SERVICE},
+						},
+					},
+					&csi.PluginCapability{
+						Type: &csi.PluginCapability_VolumeExpansion_{
+							VolumeExpansion: &csi.PluginCapability_VolumeExpansion{Type: csi.PluginCapability_VolumeExpansion_ONLINE},
+						},
+					},
+				))
+			})
+		})
 	})
 
 	Describe("#Probe", func() {
-		It("should return a 'normal' status", func() {
-			resp, err := server.Probe(ctx, &csi.ProbeRequest{})
+		var (
+			resp *csi.ProbeResponse
+			err  error
+		)
+
+		JustBeforeEach(func() {
+			resp, err = server.Probe(ctx, &csi.ProbeRequest{})
+		})
 
+		It("should report ready", func() {
 			Expect(err).NotTo(HaveOccurred())
-			Expect(resp).To(Equal(&csi.ProbeResponse{}))
+			Expect(resp).To(Equal(&csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}))
+		})
+
+		It("should check the socket dir and mount.cifs", func() {
+			Expect(fakeOs.StatCallCount()).To(Equal(1))
+			Expect(fakeOs.StatArgsForCall(0)).To(Equal("/plugin"))
+			Expect(fakeExec.LookPathCallCount()).To(Equal(1))
+			Expect(fakeExec.LookPathArgsForCall(0)).To(Equal("mount.cifs"))
+		})
+
+		Context("when the socket dir is gone", func() {
+			BeforeEach(func() {
+				fakeOs.StatReturns(nil, &os.PathError{Op: "stat", Path: "/plugin", Err: os.ErrNotExist})
+			})
+
+			It("should report not ready", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.GetReady().GetValue()).To(BeFalse())
+				Expect(logger).To(Say("socket dir unavailable: stat /plugin: file does not exist"))
+			})
+		})
+
+		Context("when the socket dir is not a directory", func() {
+			BeforeEach(func() {
+				fakeOs.StatReturns(&fakeFileInfo{}, nil)
+			})
+
+			It("should report not ready", func() {
+				Expect(resp.GetReady().GetValue()).To(BeFalse())
+				Expect(logger).To(Say("socket dir unavailable: /plugin is not a directory"))
+			})
+		})
+
+		Context("when the driver serves on tcp", func() {
+			BeforeEach(func() {
+				config.SocketDir = ""
+			})
+
+			It("should not check a socket dir", func() {
+				Expect(resp.GetReady().GetValue()).To(BeTrue())
+				Expect(fakeOs.StatCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when mount.cifs is not installed", func() {
+			BeforeEach(func() {
+				fakeExec.LookPathReturns("", errors.New(`exec: "mount.cifs": executable file not found in $PATH`))
+			})
+
+			It("should report not ready", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.GetReady().GetValue()).To(BeFalse())
+				Expect(logger).To(Say("mount.cifs unavailable"))
+			})
+		})
+
+		Context("when the cifs module is not loaded", func() {
+			BeforeEach(func() {
+				files["/proc/filesystems"] = "nodev\tsysfs\nnodev\tproc\n\text4\n"
+				files["/proc/sys/kernel/osrelease"] = "5.4.0-42-generic\n"
+			})
+
+			Context("when the kernel can load it", func() {
+				BeforeEach(func() {
+					files["/lib/modules/5.4.0-42-generic/modules.dep"] = "kernel/fs/ext4/ext4.ko: kernel/lib/crc16.ko\nkernel/fs/cifs/cifs.ko: kernel/fs/fscache/fscache.ko\n"
+				})
+
+				It("should report ready", func() {
+					Expect(resp.GetReady().GetValue()).To(BeTrue())
+				})
+			})
+
+			Context("when the kernel has no cifs module", func() {
+				BeforeEach(func() {
+					files["/lib/modules/5.4.0-42-generic/modules.dep"] = "kernel/fs/ext4/ext4.ko: kernel/lib/crc16.ko\n"
+				})
+
+				It("should report not ready", func() {
+					Expect(resp.GetReady().GetValue()).To(BeFalse())
+					Expect(logger).To(Say("cifs kernel module unavailable: it is neither loaded nor installed"))
+				})
+			})
+
+			Context("when the modules of the kernel cannot be read", func() {
+				It("should report not ready", func() {
+					Expect(resp.GetReady().GetValue()).To(BeFalse())
+					Expect(logger).To(Say("cifs kernel module unavailable: it is not loaded and open /lib/modules/5.4.0-42-generic/modules.dep: file does not exist"))
+				})
+			})
 		})
 	})
 })
+
+type fakeFileInfo struct {
+	os.FileInfo
+}
+
+func (fakeFileInfo) IsDir() bool { return false }
+
+type fakeDirInfo struct {
+	os.FileInfo
+}
+
+func (fakeDirInfo) IsDir() bool { return true }
@@ -0,0 +1,34 @@
+// Package inflight refuses a second operation on a key while the first one is still in progress.
+package inflight
+
+import "sync"
+
+// Locks tracks the keys that have an operation in progress, e.g. the target paths and volume ids of the node server or
+// the volume and snapshot names of the controller. Operations on other keys are never blocked, and a second operation
+// on the same key is refused rather than queued, so that a retry never runs concurrently with the request it retries.
+type Locks struct {
+	lock sync.Mutex
+	keys map[string]struct{}
+}
+
+func New() *Locks {
+	return &Locks{keys: map[string]struct{}{}}
+}
+
+func (l *Locks) TryAcquire(key string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, ok := l.keys[key]; ok {
+		return false
+	}
+	l.keys[key] = struct{}{}
+	return true
+}
+
+func (l *Locks) Release(key string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.keys, key)
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"code.cloudfoundry.org/goshims/execshim"
+	"code.cloudfoundry.org/goshims/ioutilshim"
 	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/goshims/syscallshim"
+	"code.cloudfoundry.org/goshims/timeshim"
 	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/smb-csi-driver/controllerserver"
 	"code.cloudfoundry.org/smb-csi-driver/identityserver"
 	"code.cloudfoundry.org/smb-csi-driver/nodeserver"
 	"flag"
@@ -12,9 +16,11 @@ import (
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -24,7 +30,23 @@ type unaryInterceptor struct {
 
 func main() {
 	var endpoint = flag.String("endpoint", "", "")
+	var mode = flag.String("mode", "node", "service to run: node, or controller to provision volumes as directories of shares")
+	var workDir = flag.String("workdir", "/var/lib/smb-csi-driver", "directory in which the controller mounts the shares it provisions volumes in")
+	var capacityCacheTTL = flag.Duration("capacitycachettl", controllerserver.DefaultCapacityCacheTTL, "how long the controller reports the free space of a share before it measures it again")
+	var capacitySecretsDir = flag.String("capacitysecretsdir", "", "directory with one file per secret, e.g. a mounted Kubernetes secret, that the controller mounts shares with to report their free space (default: do not report capacity)")
+	var snapshotDir = flag.String("snapshotdir", controllerserver.DefaultSnapshotDir, "directory of a share, relative to its root, in which the controller stores snapshots of its volumes")
 	var nodeId = flag.String("nodeid", "", "")
+	var mountTimeout = flag.Duration("mounttimeout", nodeserver.DefaultMountTimeout, "maximum time a mount or kinit command may run when the request carries no earlier deadline")
+	var credentialsDir = flag.String("credentialsdir", nodeserver.DefaultCredentialsDir, "tmpfs-backed directory for the credentials files passed to mount.cifs")
+	var kerberosCacheDir = flag.String("krb5cachedir", nodeserver.DefaultKerberosCacheDir, "directory for the kerberos credential caches of mounted volumes")
+	var kerberosRenewInterval = flag.Duration("krb5renewinterval", nodeserver.DefaultKerberosRenewInterval, "how often the node renews the ticket of its kerberos mounts in the default credential cache, 0 to not renew it and accept krb5ccache secrets")
+	var storePath = flag.String("storepath", "", "file in which to persist published volumes across restarts (default: keep them in memory only)")
+	var namespacePoliciesPath = flag.String("namespacepolicies", "", "JSON file restricting the servers, uid and gid of the shares mounted for pods by namespace")
+	var unmountTimeout = flag.Duration("unmounttimeout", nodeserver.DefaultUnmountTimeout, "maximum time each unmount step may run when the request carries no earlier deadline")
+	var unmountPolicy = flag.String("unmountpolicy", "normal,force,lazy", "unmount steps to escalate through when an unmount fails or times out")
+	var quotaMountDir = flag.String("quotamountdir", nodeserver.DefaultQuotaMountDir, "directory for the read-only mounts of the quotas of staged volumes, a host path with bidirectional mount propagation so that they survive a restart")
+	var quotaScanInterval = flag.Duration("quotascaninterval", nodeserver.DefaultQuotaScanInterval, "how often the node measures the usage of volumes with a soft quota, 0 to not measure it")
+	var mountOptions = flag.String("mountoptions", "", "changes to the allowed mount options, e.g. \"-vers,noperm:flag,echo_interval:int,cache:enum=strict|none\"")
 	flag.Parse()
 
 	logger := lager.NewLogger("smb-csi-driver")
@@ -33,13 +55,19 @@ func main() {
 
 	logger.Info(fmt.Sprintf("node-id: %s", *nodeId))
 
+	if *mode != identityserver.NodeMode && *mode != identityserver.ControllerMode {
+		logger.Fatal("invalid mode", fmt.Errorf("unknown mode '%s', expected node or controller", *mode))
+	}
+
 	proto, addr, err := ParseEndpoint(*endpoint)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
+	socketDir := ""
 	if proto == "unix" {
 		addr = "/" + addr
+		socketDir = filepath.Dir(addr)
 		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
 			log.Fatalf("Failed to remove %s, error: %s", addr, err.Error())
 		}
@@ -60,9 +88,107 @@ func main() {
 		grpc.UnaryInterceptor(interceptor.logGRPC),
 	}
 
+	err = os.MkdirAll(*credentialsDir, 0700)
+	if err != nil {
+		logger.Fatal("failed to create credentials dir", err, lager.Data{"credentialsDir": *credentialsDir})
+	}
+
+	err = os.MkdirAll(*kerberosCacheDir, 0700)
+	if err != nil {
+		logger.Fatal("failed to create kerberos cache dir", err, lager.Data{"kerberosCacheDir": *kerberosCacheDir})
+	}
+
+	mountOptionSchema, err := nodeserver.ParseMountOptionSchema(nodeserver.DefaultMountOptionSchema(), *mountOptions)
+	if err != nil {
+		logger.Fatal("invalid mount options", err, lager.Data{"mountOptions": *mountOptions})
+	}
+
+	var namespacePolicies nodeserver.NamespacePolicies
+	if *namespacePoliciesPath != "" {
+		data, err := ioutil.ReadFile(*namespacePoliciesPath)
+		if err != nil {
+			logger.Fatal("failed to read namespace policies", err, lager.Data{"namespacePolicies": *namespacePoliciesPath})
+		}
+		namespacePolicies, err = nodeserver.ParseNamespacePolicies(data)
+		if err != nil {
+			logger.Fatal("invalid namespace policies", err, lager.Data{"namespacePolicies": *namespacePoliciesPath})
+		}
+	}
+
+	unmountSteps, err := nodeserver.ParseUnmountPolicy(*unmountPolicy)
+	if err != nil {
+		logger.Fatal("invalid unmount policy", err, lager.Data{"unmountPolicy": *unmountPolicy})
+	}
+
+	config := nodeserver.Config{
+		MountTimeout:      *mountTimeout,
+		CredentialsDir:    *credentialsDir,
+		KerberosCacheDir:  *kerberosCacheDir,
+		QuotaMountDir:     *quotaMountDir,
+		UnmountTimeout:    *unmountTimeout,
+		UnmountPolicy:     unmountSteps,
+		MountOptions:      mountOptionSchema,
+		NamespacePolicies: namespacePolicies,
+	}
+
 	grpcServer := grpc.NewServer(opts...)
-	csi.RegisterIdentityServer(grpcServer, identityserver.NewSmbIdentityServer())
-	csi.RegisterNodeServer(grpcServer, nodeserver.NewNodeServer(logger, &execshim.ExecShim{}, &osshim.OsShim{}, nodeserver.NewStore()))
+	csi.RegisterIdentityServer(grpcServer, identityserver.NewSmbIdentityServer(logger, &execshim.ExecShim{}, &ioutilshim.IoutilShim{}, &osshim.OsShim{}, identityserver.Config{
+		Mode:      *mode,
+		SocketDir: socketDir,
+	}))
+	if *mode == identityserver.ControllerMode {
+		err = controllerserver.ValidateSnapshotDir(*snapshotDir)
+		if err != nil {
+			logger.Fatal("invalid snapshot dir", err, lager.Data{"snapshotDir": *snapshotDir})
+		}
+
+		err = os.MkdirAll(*workDir, 0700)
+		if err != nil {
+			logger.Fatal("failed to create work dir", err, lager.Data{"workDir": *workDir})
+		}
+
+		var capacitySecrets map[string]string
+		if *capacitySecretsDir != "" {
+			capacitySecrets, err = controllerserver.ReadSecretsDir(&ioutilshim.IoutilShim{}, *capacitySecretsDir)
+			if err != nil {
+				logger.Fatal("failed to read capacity secrets", err, lager.Data{"capacitySecretsDir": *capacitySecretsDir})
+			}
+		}
+
+		mounter := nodeserver.NewShareMounter(logger, &execshim.ExecShim{}, &osshim.OsShim{}, &ioutilshim.IoutilShim{}, config, *workDir)
+		csi.RegisterControllerServer(grpcServer, controllerserver.NewControllerServer(logger, &osshim.OsShim{}, &ioutilshim.IoutilShim{}, &syscallshim.SyscallShim{}, &timeshim.TimeShim{}, mounter, controllerserver.Config{
+			SnapshotDir:      *snapshotDir,
+			CapacityCacheTTL: *capacityCacheTTL,
+			CapacitySecrets:  capacitySecrets,
+		}))
+	} else {
+		store := nodeserver.NewStore()
+		if *storePath != "" {
+			store, err = nodeserver.NewFileStore(logger, *storePath)
+			if err != nil {
+				logger.Fatal("failed to load store", err, lager.Data{"storePath": *storePath})
+			}
+		}
+
+		err = nodeserver.Reconcile(logger, &ioutilshim.IoutilShim{}, &osshim.OsShim{}, store, "/var/lib/kubelet/pods", "org.cloudfoundry.smb")
+		if err != nil {
+			logger.Error("failed to reconcile published volumes", err)
+		}
+
+		if *quotaScanInterval > 0 {
+			config.Quotas = nodeserver.NewQuotaScanner(logger, &osshim.OsShim{}, &ioutilshim.IoutilShim{}, *quotaScanInterval)
+			// The scanner runs for as long as the node server does.
+			go config.Quotas.Run(nil)
+		}
+
+		if *kerberosRenewInterval > 0 {
+			config.Kerberos = nodeserver.NewKerberosRenewer(logger, &execshim.ExecShim{}, &osshim.OsShim{}, &ioutilshim.IoutilShim{}, *kerberosCacheDir, *mountTimeout, *kerberosRenewInterval)
+			// The renewer runs for as long as the node server does.
+			go config.Kerberos.Run(nil)
+		}
+
+		csi.RegisterNodeServer(grpcServer, nodeserver.NewNodeServer(logger, &execshim.ExecShim{}, &osshim.OsShim{}, &ioutilshim.IoutilShim{}, &syscallshim.SyscallShim{}, store, config))
+	}
 
 	err = grpcServer.Serve(lis)
 	if err != nil {
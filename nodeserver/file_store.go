@@ -0,0 +1,149 @@
+package nodeserver
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+type storedVolumeInfo struct {
+	Hash              string `json:"hash"`
+	StagingTargetPath string `json:"stagingTargetPath,omitempty"`
+}
+
+// FileCSIDriverStore keeps the published volumes in memory and writes them to a file after every change, so that
+// a restarted node plugin still knows which target paths it has published.
+type FileCSIDriverStore struct {
+	CheckParallelCSIDriverRequests
+	logger   lager.Logger
+	path     string
+	saveLock sync.Mutex
+}
+
+func NewFileStore(logger lager.Logger, path string) (CSIDriverStore, error) {
+	f := &FileCSIDriverStore{
+		CheckParallelCSIDriverRequests: CheckParallelCSIDriverRequests{store: map[string]volumeInfo{}},
+		logger:                         logger.Session("file-store", lager.Data{"path": path}),
+		path:                           path,
+	}
+
+	err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Get adopts the options of the first publish of a recovered volume like the in-memory store does, and writes them
+// out, so that a later restart still detects a publish with other options.
+func (f *FileCSIDriverStore) Get(targetPath string, k *csi.NodePublishVolumeRequest) (bool, bool, error) {
+	f.lock.Lock()
+	recovered := f.store[targetPath].hash == unknownOptions
+	f.lock.Unlock()
+
+	exists, optionsMatch, err := f.CheckParallelCSIDriverRequests.Get(targetPath, k)
+	if err != nil || !exists || !recovered {
+		return exists, optionsMatch, err
+	}
+	return exists, optionsMatch, f.save()
+}
+
+func (f *FileCSIDriverStore) Create(targetPath string, k *csi.NodePublishVolumeRequest) error {
+	err := f.CheckParallelCSIDriverRequests.Create(targetPath, k)
+	if err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileCSIDriverStore) Delete(k string) {
+	f.CheckParallelCSIDriverRequests.Delete(k)
+	err := f.save()
+	if err != nil {
+		f.logger.Error("save-failed", err, lager.Data{"targetPath": k})
+	}
+}
+
+func (f *FileCSIDriverStore) Seed(targetPath string, stagingTargetPath string) {
+	f.CheckParallelCSIDriverRequests.Seed(targetPath, stagingTargetPath)
+	err := f.save()
+	if err != nil {
+		f.logger.Error("save-failed", err, lager.Data{"targetPath": targetPath})
+	}
+}
+
+func (f *FileCSIDriverStore) load() error {
+	contents, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	stored := map[string]storedVolumeInfo{}
+	err = json.Unmarshal(contents, &stored)
+	if err != nil {
+		return err
+	}
+
+	for targetPath, info := range stored {
+		var hash [32]byte
+		decoded, err := hex.DecodeString(info.Hash)
+		if err != nil {
+			return err
+		}
+		if len(decoded) != len(hash) {
+			return fmt.Errorf("invalid hash of %s: expected %d bytes, got %d", targetPath, len(hash), len(decoded))
+		}
+		copy(hash[:], decoded)
+		f.store[targetPath] = volumeInfo{hash, info.StagingTargetPath}
+	}
+	f.logger.Info("loaded", lager.Data{"volumes": len(f.store)})
+	return nil
+}
+
+// save writes the store to a temporary file next to the store file and renames it into place, so that a crash
+// mid-write never leaves a truncated store behind.
+func (f *FileCSIDriverStore) save() error {
+	f.saveLock.Lock()
+	defer f.saveLock.Unlock()
+
+	f.lock.Lock()
+	stored := map[string]storedVolumeInfo{}
+	for targetPath, info := range f.store {
+		stored[targetPath] = storedVolumeInfo{hex.EncodeToString(info.hash[:]), info.stagingTargetPath}
+	}
+	f.lock.Unlock()
+
+	contents, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(f.path), "."+filepath.Base(f.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(contents)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), f.path)
+}
@@ -0,0 +1,157 @@
+package nodeserver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	. "code.cloudfoundry.org/smb-csi-driver/nodeserver"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FileCSIDriverStore", func() {
+	var (
+		logger    *lagertest.TestLogger
+		stateDir  string
+		statePath string
+		store     CSIDriverStore
+		request   *csi.NodePublishVolumeRequest
+		err       error
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("file-store-test")
+		stateDir, err = ioutil.TempDir("", "file-store")
+		Expect(err).NotTo(HaveOccurred())
+		statePath = filepath.Join(stateDir, "volumes.json")
+
+		request = &csi.NodePublishVolumeRequest{
+			TargetPath:        "/tmp/target_path",
+			StagingTargetPath: "/tmp/staging_path",
+			VolumeContext: map[string]string{
+				"share": "//server/export",
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		store, err = NewFileStore(logger, statePath)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(stateDir)).To(Succeed())
+	})
+
+	It("should start empty when there is no store file", func() {
+		Expect(err).NotTo(HaveOccurred())
+		exists, _, err := store.Get(request.TargetPath, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(exists).To(BeFalse())
+	})
+
+	Context("when a volume has been published", func() {
+		JustBeforeEach(func() {
+			Expect(store.Create(request.TargetPath, request)).To(Succeed())
+		})
+
+		It("should write the store file without leaving temporary files behind", func() {
+			entries, err := ioutil.ReadDir(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Name()).To(Equal("volumes.json"))
+		})
+
+		It("should remember the volume after a restart", func() {
+			reloaded, err := NewFileStore(logger, statePath)
+			Expect(err).NotTo(HaveOccurred())
+
+			exists, optionsMatch, err := reloaded.Get(request.TargetPath, request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeTrue())
+			Expect(optionsMatch).To(BeTrue())
+			Expect(reloaded.PublishedTargetPaths("/tmp/staging_path")).To(ConsistOf("/tmp/target_path"))
+		})
+
+		It("should detect changed options after a restart", func() {
+			reloaded, err := NewFileStore(logger, statePath)
+			Expect(err).NotTo(HaveOccurred())
+
+			request.VolumeContext["share"] = "//server/other"
+			exists, optionsMatch, err := reloaded.Get(request.TargetPath, request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeTrue())
+			Expect(optionsMatch).To(BeFalse())
+		})
+
+		Context("when the volume is unpublished", func() {
+			JustBeforeEach(func() {
+				store.Delete(request.TargetPath)
+			})
+
+			It("should forget the volume after a restart", func() {
+				reloaded, err := NewFileStore(logger, statePath)
+				Expect(err).NotTo(HaveOccurred())
+
+				exists, _, err := reloaded.Get(request.TargetPath, request)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exists).To(BeFalse())
+			})
+		})
+	})
+
+	Context("when a recovered volume is published again", func() {
+		JustBeforeEach(func() {
+			store.Seed(request.TargetPath, request.StagingTargetPath)
+
+			exists, optionsMatch, err := store.Get(request.TargetPath, request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeTrue())
+			Expect(optionsMatch).To(BeTrue())
+		})
+
+		It("should remember the adopted options after a restart", func() {
+			reloaded, err := NewFileStore(logger, statePath)
+			Expect(err).NotTo(HaveOccurred())
+
+			request.VolumeContext["share"] = "//server/other"
+			exists, optionsMatch, err := reloaded.Get(request.TargetPath, request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeTrue())
+			Expect(optionsMatch).To(BeFalse())
+		})
+	})
+
+	Context("when the store file is corrupt", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(statePath, []byte("{not json"), 0600)).To(Succeed())
+		})
+
+		It("should return an error", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when a stored hash is truncated", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(statePath, []byte(`{"/tmp/target_path":{"hash":"abcd"}}`), 0600)).To(Succeed())
+		})
+
+		It("should return an error", func() {
+			Expect(err).To(MatchError("invalid hash of /tmp/target_path: expected 32 bytes, got 2"))
+		})
+	})
+
+	Context("when the store directory does not exist", func() {
+		BeforeEach(func() {
+			statePath = filepath.Join(stateDir, "missing", "volumes.json")
+		})
+
+		It("should fail to persist a published volume", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(store.Create(request.TargetPath, request)).NotTo(Succeed())
+		})
+	})
+})
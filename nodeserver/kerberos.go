@@ -0,0 +1,128 @@
+package nodeserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	kerberosAuthentication = "kerberos"
+	krb5CCacheSecret       = "krb5ccache"
+	krb5KeytabSecret       = "krb5keytab"
+)
+
+func kerberosRequested(volumeContext map[string]string, secrets map[string]string) bool {
+	return strings.EqualFold(volumeContext["authentication"], kerberosAuthentication) ||
+		secrets[krb5CCacheSecret] != "" ||
+		secrets[krb5KeytabSecret] != ""
+}
+
+// kerberosCachePath returns the private credential cache of the mount at mountPath. cifs.upcall only finds it through
+// the KRB5CCNAME environment of the mount process; a session re-established later looks for the default cache of cruid
+// instead, which the KerberosRenewer keeps valid.
+func (n smbNodeServer) kerberosCachePath(mountPath string) string {
+	return filepath.Join(n.config.KerberosCacheDir, fmt.Sprintf("krb5cc_%x", sha256.Sum256([]byte(filepath.Clean(mountPath)))))
+}
+
+// prepareKerberosCache fills the credential cache of mountPath, either with the ticket cache from the krb5ccache
+// secret or with a ticket obtained by kinit from the krb5keytab secret for the principal in the username secret. With
+// a KerberosRenewer, only the keytab is accepted, and the renewer keeps a ticket for the principal while mounted.
+func (n smbNodeServer) prepareKerberosCache(c context.Context, mountPath string, secrets map[string]string) (string, error) {
+	cachePath := n.kerberosCachePath(mountPath)
+
+	ccache := secrets[krb5CCacheSecret]
+	if ccache != "" && n.config.Kerberos != nil && secrets[krb5KeytabSecret] == "" {
+		return "", status.Error(codes.InvalidArgument, fmt.Sprintf("Error: the ticket of a [%s] secret cannot be renewed once the volume is mounted, provide a [%s] and a [username] secret", krb5CCacheSecret, krb5KeytabSecret))
+	}
+	if ccache != "" && n.config.Kerberos == nil {
+		err := writePrivateFile(n.osshim, cachePath, ccache)
+		if err != nil {
+			n.logger.Error("write-krb5-ccache-failed", err)
+			return "", status.Error(codes.Internal, err.Error())
+		}
+		return cachePath, nil
+	}
+
+	keytab := secrets[krb5KeytabSecret]
+	principal := secrets["username"]
+	if keytab == "" || principal == "" {
+		return "", status.Error(codes.InvalidArgument, fmt.Sprintf("Error: kerberos authentication requires a [%s] secret, or a [%s] and a [username] secret", krb5CCacheSecret, krb5KeytabSecret))
+	}
+
+	keytabFile, err := n.ioutilshim.TempFile(n.config.CredentialsDir, "keytab")
+	if err != nil {
+		n.logger.Error("create-keytab-failed", err)
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	defer func() {
+		err := n.osshim.Remove(keytabFile.Name())
+		if err != nil {
+			n.logger.Error("remove-keytab-failed", err)
+		}
+	}()
+
+	_, err = keytabFile.WriteString(keytab)
+	if closeErr := keytabFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		n.logger.Error("write-keytab-failed", err)
+		return "", status.Error(codes.Internal, err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(c, n.config.MountTimeout)
+	defer cancel()
+
+	n.logger.Info("started kinit", lager.Data{"principal": principal})
+	cmdshim := n.execshim.CommandContext(ctx, "kinit", "-k", "-t", keytabFile.Name(), "-c", "FILE:"+cachePath, principal)
+	combinedOutput, err := cmdshim.CombinedOutput()
+	if err != nil {
+		n.logger.Error("kinit-failed", err, lager.Data{"combinedOutput": string(combinedOutput)})
+		n.removeKerberosCache(mountPath)
+		return "", commandError(ctx, "kinit", err)
+	}
+	n.logger.Info("finished kinit", lager.Data{"principal": principal})
+
+	if n.config.Kerberos != nil {
+		err = n.config.Kerberos.keep(c, mountPath, principal, keytab)
+		if err != nil {
+			n.removeKerberosCache(mountPath)
+			return "", err
+		}
+	}
+	return cachePath, nil
+}
+
+// removeKerberosCache removes the credential cache of mountPath and stops renewing its ticket.
+func (n smbNodeServer) removeKerberosCache(mountPath string) {
+	if n.config.Kerberos != nil {
+		n.config.Kerberos.forget(mountPath)
+	}
+	err := n.osshim.Remove(n.kerberosCachePath(mountPath))
+	if err != nil && !os.IsNotExist(err) {
+		n.logger.Error("remove-krb5-ccache-failed", err, lager.Data{"mountPath": mountPath})
+	}
+}
+
+// writePrivateFile writes contents to a file only root can read.
+func writePrivateFile(osshim osshim.Os, path string, contents string) error {
+	file, err := osshim.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteString(contents)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
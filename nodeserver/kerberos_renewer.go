@@ -0,0 +1,201 @@
+package nodeserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/goshims/execshim"
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const DefaultKerberosRenewInterval = time.Hour
+
+const (
+	keytabSuffix    = ".keytab"
+	principalSuffix = ".principal"
+)
+
+// KerberosRenewer keeps a valid ticket for the principal of the kerberos mounts of the node in the default credential
+// cache of the driver, whose uid the mounts pass as cruid. cifs.upcall only finds the private credential cache of a
+// mount while mounting it; when the SMB session is re-established later, e.g. after a reconnect, it looks for a ticket
+// in that default cache instead. The keytab and principal of every mount are kept in dir for as long as it is mounted,
+// so that the ticket is still renewed after the driver restarts. The default cache holds the ticket of one principal,
+// so the kerberos mounts of a node must all use the same one.
+type KerberosRenewer struct {
+	logger     lager.Logger
+	execshim   execshim.Exec
+	osshim     osshim.Os
+	ioutilshim ioutilshim.Ioutil
+	dir        string
+	timeout    time.Duration
+	interval   time.Duration
+
+	lock sync.Mutex
+}
+
+func NewKerberosRenewer(logger lager.Logger, execshim execshim.Exec, osshim osshim.Os, ioutilshim ioutilshim.Ioutil, dir string, timeout time.Duration, interval time.Duration) *KerberosRenewer {
+	return &KerberosRenewer{
+		logger:     logger.Session("kerberos-renewer", lager.Data{"dir": dir}),
+		execshim:   execshim,
+		osshim:     osshim,
+		ioutilshim: ioutilshim,
+		dir:        dir,
+		timeout:    timeout,
+		interval:   interval,
+	}
+}
+
+// Run renews the ticket at once, e.g. for the mounts kept before a restart, and then every interval until stop is
+// closed.
+func (k *KerberosRenewer) Run(stop <-chan struct{}) {
+	k.Renew()
+
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			k.Renew()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Renew obtains a new ticket into the default credential cache for every principal of the kept mounts.
+func (k *KerberosRenewer) Renew() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	principals, err := k.principals()
+	if err != nil {
+		k.logger.Error("list-principals-failed", err)
+		return
+	}
+
+	renewed := map[string]bool{}
+	for base, principal := range principals {
+		if renewed[principal] {
+			continue
+		}
+		err := k.kinit(context.Background(), base+keytabSuffix, principal)
+		if err != nil {
+			k.logger.Error("renew-failed", err, lager.Data{"principal": principal})
+			continue
+		}
+		renewed[principal] = true
+		k.logger.Info("renewed", lager.Data{"principal": principal})
+	}
+}
+
+// keep obtains a ticket for principal into the default credential cache and keeps the keytab of the mount at mountPath
+// to renew it until the mount is forgotten. A principal other than the one of the other kept mounts is refused.
+func (k *KerberosRenewer) keep(c context.Context, mountPath string, principal string, keytab string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	base := k.basePath(mountPath)
+	principals, err := k.principals()
+	if err != nil {
+		k.logger.Error("list-principals-failed", err)
+		return status.Error(codes.Internal, err.Error())
+	}
+	for other, otherPrincipal := range principals {
+		if other != base && otherPrincipal != principal {
+			return status.Error(codes.FailedPrecondition, fmt.Sprintf("Error: the kerberos mounts of this node use the principal %s, cifs.upcall cannot renew the session of a mount for %s", otherPrincipal, principal))
+		}
+	}
+
+	err = writePrivateFile(k.osshim, base+keytabSuffix, keytab)
+	if err == nil {
+		err = writePrivateFile(k.osshim, base+principalSuffix, principal)
+	}
+	if err != nil {
+		k.logger.Error("write-keytab-failed", err, lager.Data{"mountPath": mountPath})
+		k.remove(base)
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	err = k.kinit(c, base+keytabSuffix, principal)
+	if err != nil {
+		k.remove(base)
+		return err
+	}
+	return nil
+}
+
+// forget stops renewing the ticket for the mount at mountPath, e.g. when it is unmounted.
+func (k *KerberosRenewer) forget(mountPath string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.remove(k.basePath(mountPath))
+}
+
+func (k *KerberosRenewer) basePath(mountPath string) string {
+	return filepath.Join(k.dir, fmt.Sprintf("mount_%x", sha256.Sum256([]byte(filepath.Clean(mountPath)))))
+}
+
+// principals returns the principal of every kept mount by the base path of its files.
+func (k *KerberosRenewer) principals() (map[string]string, error) {
+	entries, err := k.ioutilshim.ReadDir(k.dir)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	principals := map[string]string{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), principalSuffix) {
+			continue
+		}
+		data, err := k.ioutilshim.ReadFile(filepath.Join(k.dir, entry.Name()))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		principals[filepath.Join(k.dir, strings.TrimSuffix(entry.Name(), principalSuffix))] = string(data)
+	}
+	return principals, nil
+}
+
+// kinit obtains a ticket for principal into the default credential cache. Without -c, kinit writes to the cache that
+// cifs.upcall looks up for the cruid of the mounts.
+func (k *KerberosRenewer) kinit(c context.Context, keytabPath string, principal string) error {
+	ctx, cancel := context.WithTimeout(c, k.timeout)
+	defer cancel()
+
+	k.logger.Info("started kinit", lager.Data{"principal": principal})
+	cmdshim := k.execshim.CommandContext(ctx, "kinit", "-k", "-t", keytabPath, principal)
+	combinedOutput, err := cmdshim.CombinedOutput()
+	if err != nil {
+		k.logger.Error("kinit-failed", err, lager.Data{"principal": principal, "combinedOutput": string(combinedOutput)})
+		return commandError(ctx, "kinit", err)
+	}
+	k.logger.Info("finished kinit", lager.Data{"principal": principal})
+	return nil
+}
+
+func (k *KerberosRenewer) remove(base string) {
+	for _, path := range []string{base + principalSuffix, base + keytabSuffix} {
+		err := k.osshim.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			k.logger.Error("remove-failed", err, lager.Data{"path": path})
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package nodeserver_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/goshims/execshim/exec_fake"
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/goshims/syscallshim/syscall_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "code.cloudfoundry.org/smb-csi-driver/nodeserver"
+	smbcsidriverfakes "code.cloudfoundry.org/smb-csi-driver/smb-csi-driverfakes"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("KerberosRenewer", func() {
+	var (
+		logger     *lagertest.TestLogger
+		ctx        context.Context
+		cacheDir   string
+		fakeExec   *exec_fake.FakeExec
+		fakeCmd    *exec_fake.FakeCmd
+		fakeIoutil *ioutil_fake.FakeIoutil
+		renewer    *KerberosRenewer
+		nodeServer csi.NodeServer
+		request    *csi.NodePublishVolumeRequest
+		err        error
+	)
+
+	kinits := func() [][]string {
+		calls := [][]string{}
+		for i := 0; i < fakeExec.CommandContextCallCount(); i++ {
+			_, command, args := fakeExec.CommandContextArgsForCall(i)
+			if command == "kinit" {
+				calls = append(calls, args)
+			}
+		}
+		return calls
+	}
+
+	keptFiles := func() []string {
+		names := []string{}
+		entries, err := ioutil.ReadDir(cacheDir)
+		Expect(err).NotTo(HaveOccurred())
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("kerberos-renewer-test")
+		ctx = context.Background()
+		cacheDir, err = ioutil.TempDir("", "krb5")
+		Expect(err).NotTo(HaveOccurred())
+
+		fakeCmd = &exec_fake.FakeCmd{}
+		fakeExec = &exec_fake.FakeExec{}
+		fakeExec.CommandContextReturns(fakeCmd)
+		keytabFile := &os_fake.FakeFile{}
+		keytabFile.NameReturns("/run/smb-csi-driver/keytab123")
+		fakeIoutil = &ioutil_fake.FakeIoutil{}
+		fakeIoutil.TempFileReturns(keytabFile, nil)
+		fakeIoutil.ReadFileReturns([]byte(""), nil)
+
+		renewer = NewKerberosRenewer(logger, fakeExec, &osshim.OsShim{}, &ioutilshim.IoutilShim{}, cacheDir, time.Minute, time.Hour)
+		nodeServer = NewNodeServer(logger, fakeExec, &os_fake.FakeOs{}, fakeIoutil, &syscall_fake.FakeSyscall{}, &smbcsidriverfakes.FakeCSIDriverStore{}, Config{Kerberos: renewer, KerberosCacheDir: cacheDir})
+
+		request = &csi.NodePublishVolumeRequest{
+			VolumeId:         "volume-id",
+			TargetPath:       "/tmp/target_path",
+			VolumeCapability: &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}},
+			VolumeContext:    map[string]string{"share": "//server/export", "authentication": "kerberos"},
+			Secrets:          map[string]string{"krb5keytab": "keytab-bytes", "username": "user1@CORP.EXAMPLE.COM"},
+		}
+	})
+
+	JustBeforeEach(func() {
+		_, err = nodeServer.NodePublishVolume(ctx, request)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(cacheDir)).To(Succeed())
+	})
+
+	It("should obtain a ticket into the default credential cache of the driver", func() {
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kinits()).To(HaveLen(2))
+		args := kinits()[1]
+		Expect(args).To(HaveLen(4))
+		Expect(args[:2]).To(Equal([]string{"-k", "-t"}))
+		Expect(args[2]).To(HavePrefix(cacheDir + "/mount_"))
+		Expect(args[3]).To(Equal("user1@CORP.EXAMPLE.COM"))
+	})
+
+	It("should keep the keytab and principal of the mount", func() {
+		keytab := kinits()[1][2]
+		Expect(ioutil.ReadFile(keytab)).To(Equal([]byte("keytab-bytes")))
+		info, err := os.Stat(keytab)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		Expect(keptFiles()).To(HaveLen(2))
+	})
+
+	It("should renew the ticket of the mount", func() {
+		renewer.Renew()
+		Expect(kinits()).To(HaveLen(3))
+		Expect(kinits()[2]).To(Equal(kinits()[1]))
+		Expect(logger).To(Say("renewed"))
+	})
+
+	Context("when the driver restarts", func() {
+		It("should still renew the ticket of the mount", func() {
+			restarted := NewKerberosRenewer(logger, fakeExec, &osshim.OsShim{}, &ioutilshim.IoutilShim{}, cacheDir, time.Minute, time.Hour)
+			restarted.Renew()
+			Expect(kinits()).To(HaveLen(3))
+			Expect(kinits()[2]).To(Equal(kinits()[1]))
+		})
+	})
+
+	Context("when the volume is unpublished", func() {
+		JustBeforeEach(func() {
+			fakeIoutil.ReadFileReturns([]byte("130 25 0:52 / /tmp/target_path rw,relatime shared:70 - cifs //server/export rw,vers=3.0\n"), nil)
+			_, err := nodeServer.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "volume-id", TargetPath: "/tmp/target_path"})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should stop renewing its ticket and remove its keytab", func() {
+			Expect(keptFiles()).To(BeEmpty())
+			renewer.Renew()
+			Expect(kinits()).To(HaveLen(2))
+		})
+	})
+
+	Context("when another volume is published for a different principal", func() {
+		It("should refuse it, as the default credential cache holds a single principal", func() {
+			Expect(err).NotTo(HaveOccurred())
+			calls := fakeExec.CommandContextCallCount()
+
+			other := &csi.NodePublishVolumeRequest{
+				VolumeId:         "other-volume-id",
+				TargetPath:       "/tmp/other_target_path",
+				VolumeCapability: request.VolumeCapability,
+				VolumeContext:    request.VolumeContext,
+				Secrets:          map[string]string{"krb5keytab": "other-keytab-bytes", "username": "user2@CORP.EXAMPLE.COM"},
+			}
+			_, err := nodeServer.NodePublishVolume(ctx, other)
+			Expect(err).To(MatchError("rpc error: code = FailedPrecondition desc = Error: the kerberos mounts of this node use the principal user1@CORP.EXAMPLE.COM, cifs.upcall cannot renew the session of a mount for user2@CORP.EXAMPLE.COM"))
+			Expect(fakeExec.CommandContextCallCount()).To(Equal(calls + 1))
+			Expect(keptFiles()).To(HaveLen(2))
+		})
+	})
+
+	Context("when the ticket cannot be obtained into the default credential cache", func() {
+		BeforeEach(func() {
+			fakeCmd.CombinedOutputReturnsOnCall(1, []byte("kinit: Preauthentication failed"), errors.New("exit status 1"))
+		})
+
+		It("should return an error without mounting or keeping the keytab", func() {
+			Expect(err).To(MatchError("rpc error: code = Internal desc = exit status 1"))
+			Expect(fakeExec.CommandContextCallCount()).To(Equal(2))
+			Expect(keptFiles()).To(BeEmpty())
+		})
+	})
+
+	Context("when only a ticket cache is provided", func() {
+		BeforeEach(func() {
+			request.Secrets = map[string]string{"krb5ccache": "ticket-cache-bytes"}
+		})
+
+		It("should refuse it, as the ticket cannot be renewed", func() {
+			Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: the ticket of a [krb5ccache] secret cannot be renewed once the volume is mounted, provide a [krb5keytab] and a [username] secret"))
+			Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+			Expect(keptFiles()).To(BeEmpty())
+		})
+	})
+})
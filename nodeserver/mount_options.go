@@ -0,0 +1,176 @@
+package nodeserver
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type MountOptionType int
+
+const (
+	// IntegerOption takes a non-negative decimal value, as in rsize=65536.
+	IntegerOption MountOptionType = iota
+	// ModeOption takes an octal file mode, as in file_mode=0644.
+	ModeOption
+	// EnumOption takes one of a fixed set of values, as in cache=strict.
+	EnumOption
+	// FlagOption takes no value, as in nobrl.
+	FlagOption
+)
+
+var mountOptionTypeNames = map[MountOptionType]string{
+	IntegerOption: "int",
+	ModeOption:    "mode",
+	EnumOption:    "enum",
+	FlagOption:    "flag",
+}
+
+type MountOption struct {
+	Type MountOptionType
+	// Values lists the values an EnumOption accepts.
+	Values []string
+}
+
+// MountOptionSchema maps the CIFS mount options that volumes may set to the values they accept.
+type MountOptionSchema map[string]MountOption
+
+// reservedMountOptions are set by the driver itself and cannot be added to a schema.
+var reservedMountOptions = []string{"credentials", "cred", "username", "user", "password", "pass", "domain", "dom", "workgroup", "sec", "cruid", "ro", "rw"}
+
+func DefaultMountOptionSchema() MountOptionSchema {
+	return MountOptionSchema{
+		"uid":         {Type: IntegerOption},
+		"gid":         {Type: IntegerOption},
+		"vers":        {Type: EnumOption, Values: []string{"1.0", "2.0", "2.1", "3", "3.0", "3.02", "3.1.1", "3.11", "default"}},
+		"file_mode":   {Type: ModeOption},
+		"dir_mode":    {Type: ModeOption},
+		"cache":       {Type: EnumOption, Values: []string{"strict", "loose", "none", "ro", "singleclient"}},
+		"actimeo":     {Type: IntegerOption},
+		"nobrl":       {Type: FlagOption},
+		"rsize":       {Type: IntegerOption},
+		"wsize":       {Type: IntegerOption},
+		"noserverino": {Type: FlagOption},
+		"mfsymlinks":  {Type: FlagOption},
+	}
+}
+
+// ParseMountOptionSchema applies spec to a copy of schema. spec is a comma separated list of entries: "name:int",
+// "name:mode", "name:flag" and "name:enum=value1|value2" add or replace an option, and "-name" removes one.
+func ParseMountOptionSchema(schema MountOptionSchema, spec string) (MountOptionSchema, error) {
+	result := MountOptionSchema{}
+	for name, option := range schema {
+		result[name] = option
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if strings.HasPrefix(entry, "-") {
+			delete(result, entry[1:])
+			continue
+		}
+
+		nameType := strings.SplitN(entry, ":", 2)
+		if len(nameType) != 2 || nameType[0] == "" {
+			return nil, fmt.Errorf("invalid mount option schema entry '%s', expected name:type", entry)
+		}
+		name := nameType[0]
+		for _, reserved := range reservedMountOptions {
+			if name == reserved {
+				return nil, fmt.Errorf("mount option '%s' is set by the driver and cannot be allowed", name)
+			}
+		}
+
+		typeValues := strings.SplitN(nameType[1], "=", 2)
+		switch typeValues[0] {
+		case "int":
+			result[name] = MountOption{Type: IntegerOption}
+		case "mode":
+			result[name] = MountOption{Type: ModeOption}
+		case "flag":
+			result[name] = MountOption{Type: FlagOption}
+		case "enum":
+			if len(typeValues) != 2 || typeValues[1] == "" {
+				return nil, fmt.Errorf("mount option '%s' of type enum requires values, as in %s:enum=value1|value2", name, name)
+			}
+			result[name] = MountOption{Type: EnumOption, Values: strings.Split(typeValues[1], "|")}
+		default:
+			return nil, fmt.Errorf("mount option '%s' has unknown type '%s', expected one of [int, mode, enum, flag]", name, nameType[1])
+		}
+	}
+	return result, nil
+}
+
+// Validate checks a single mount flag of a volume against the schema.
+func (s MountOptionSchema) Validate(flag string) error {
+	if strings.Contains(flag, ",") {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("Error: invalid mountOption value for '%s'", flag))
+	}
+
+	keyValue := strings.SplitN(flag, "=", 2)
+	key := keyValue[0]
+	option, ok := s[key]
+	if !ok {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("Error: mountOption '%s' is not allowed, allowed options are [%s]", key, strings.Join(s.names(), ", ")))
+	}
+
+	if option.Type == FlagOption {
+		if len(keyValue) != 1 {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("Error: mountOption '%s' is a flag and does not take a value", key))
+		}
+		return nil
+	}
+
+	if len(keyValue) != 2 || keyValue[1] == "" {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("Error: mountOption '%s' requires a value of type %s", key, mountOptionTypeNames[option.Type]))
+	}
+	value := keyValue[1]
+
+	switch option.Type {
+	case IntegerOption:
+		if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("Error: invalid mountOption value for '%s', expected a non-negative integer", flag))
+		}
+	case ModeOption:
+		if mode, err := strconv.ParseUint(value, 8, 32); err != nil || mode > 07777 {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("Error: invalid mountOption value for '%s', expected an octal mode between 0000 and 7777", flag))
+		}
+	case EnumOption:
+		for _, v := range option.Values {
+			if value == v {
+				return nil
+			}
+		}
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("Error: invalid mountOption value for '%s', allowed values are [%s]", flag, strings.Join(option.Values, ", ")))
+	}
+	return nil
+}
+
+func (s MountOptionSchema) names() []string {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (n smbNodeServer) cifsMountOptions(mountFlags []string) ([]string, error) {
+	mountOptions := []string{}
+	for _, option := range mountFlags {
+		err := n.config.MountOptions.Validate(option)
+		if err != nil {
+			return nil, err
+		}
+		mountOptions = append(mountOptions, option)
+	}
+	return mountOptions, nil
+}
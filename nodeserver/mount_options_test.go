@@ -0,0 +1,92 @@
+package nodeserver_test
+
+import (
+	. "code.cloudfoundry.org/smb-csi-driver/nodeserver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MountOptionSchema", func() {
+	var schema MountOptionSchema
+
+	BeforeEach(func() {
+		schema = DefaultMountOptionSchema()
+	})
+
+	Describe("#Validate", func() {
+		It("should accept valid options of every type", func() {
+			for _, option := range []string{"uid=1000", "file_mode=0644", "dir_mode=755", "cache=loose", "vers=3.1.1", "nobrl", "rsize=65536", "mfsymlinks"} {
+				Expect(schema.Validate(option)).To(Succeed(), option)
+			}
+		})
+
+		It("should name the allowed options when an option is unknown", func() {
+			Expect(schema.Validate("foo=bar")).To(MatchError("rpc error: code = InvalidArgument desc = Error: mountOption 'foo' is not allowed, allowed options are [actimeo, cache, dir_mode, file_mode, gid, mfsymlinks, nobrl, noserverino, rsize, uid, vers, wsize]"))
+		})
+
+		It("should name the allowed values of an enum", func() {
+			Expect(schema.Validate("cache=fast")).To(MatchError("rpc error: code = InvalidArgument desc = Error: invalid mountOption value for 'cache=fast', allowed values are [strict, loose, none, ro, singleclient]"))
+		})
+
+		It("should reject values that are not integers", func() {
+			Expect(schema.Validate("actimeo=-1")).To(MatchError("rpc error: code = InvalidArgument desc = Error: invalid mountOption value for 'actimeo=-1', expected a non-negative integer"))
+		})
+
+		It("should reject modes that are not octal", func() {
+			Expect(schema.Validate("file_mode=0899")).To(MatchError("rpc error: code = InvalidArgument desc = Error: invalid mountOption value for 'file_mode=0899', expected an octal mode between 0000 and 7777"))
+			Expect(schema.Validate("file_mode=17777")).To(HaveOccurred())
+		})
+
+		It("should reject flags with a value", func() {
+			Expect(schema.Validate("nobrl=1")).To(MatchError("rpc error: code = InvalidArgument desc = Error: mountOption 'nobrl' is a flag and does not take a value"))
+		})
+
+		It("should reject options without a value", func() {
+			Expect(schema.Validate("uid")).To(MatchError("rpc error: code = InvalidArgument desc = Error: mountOption 'uid' requires a value of type int"))
+			Expect(schema.Validate("uid=")).To(HaveOccurred())
+		})
+
+		It("should reject options containing a comma", func() {
+			Expect(schema.Validate("uid=1000,password=secret")).To(MatchError("rpc error: code = InvalidArgument desc = Error: invalid mountOption value for 'uid=1000,password=secret'"))
+		})
+	})
+
+	Describe("ParseMountOptionSchema", func() {
+		It("should add, replace and remove options", func() {
+			parsed, err := ParseMountOptionSchema(schema, "-vers, noperm:flag,echo_interval:int,cache:enum=strict|none")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(parsed).NotTo(HaveKey("vers"))
+			Expect(parsed).To(HaveKeyWithValue("noperm", MountOption{Type: FlagOption}))
+			Expect(parsed).To(HaveKeyWithValue("echo_interval", MountOption{Type: IntegerOption}))
+			Expect(parsed).To(HaveKeyWithValue("cache", MountOption{Type: EnumOption, Values: []string{"strict", "none"}}))
+			Expect(parsed).To(HaveKey("uid"))
+		})
+
+		It("should leave the original schema unchanged", func() {
+			_, err := ParseMountOptionSchema(schema, "-uid")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(schema).To(HaveKey("uid"))
+		})
+
+		It("should refuse options the driver sets itself", func() {
+			_, err := ParseMountOptionSchema(schema, "password:flag")
+			Expect(err).To(MatchError("mount option 'password' is set by the driver and cannot be allowed"))
+		})
+
+		It("should refuse unknown types", func() {
+			_, err := ParseMountOptionSchema(schema, "noperm:bool")
+			Expect(err).To(MatchError("mount option 'noperm' has unknown type 'bool', expected one of [int, mode, enum, flag]"))
+		})
+
+		It("should refuse enums without values", func() {
+			_, err := ParseMountOptionSchema(schema, "cache:enum")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should refuse entries without a type", func() {
+			_, err := ParseMountOptionSchema(schema, "noperm")
+			Expect(err).To(MatchError("invalid mount option schema entry 'noperm', expected name:type"))
+		})
+	})
+})
@@ -0,0 +1,116 @@
+package nodeserver
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const mountInfoPath = "/proc/self/mountinfo"
+
+type mountInfo struct {
+	device     string
+	root       string
+	mountPoint string
+	fsType     string
+	source     string
+}
+
+// parseMountInfo parses the contents of /proc/<pid>/mountinfo as described in proc(5).
+func parseMountInfo(data []byte) []mountInfo {
+	mounts := []mountInfo{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 7 {
+			continue
+		}
+
+		separator := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				separator = i
+				break
+			}
+		}
+		if separator == -1 || len(fields) < separator+3 {
+			continue
+		}
+
+		mounts = append(mounts, mountInfo{
+			device:     fields[2],
+			root:       unescapeMountInfoField(fields[3]),
+			mountPoint: unescapeMountInfoField(fields[4]),
+			fsType:     fields[separator+1],
+			source:     unescapeMountInfoField(fields[separator+2]),
+		})
+	}
+	return mounts
+}
+
+// unescapeMountInfoField reverses the octal escaping the kernel applies to spaces, tabs, newlines and backslashes.
+func unescapeMountInfoField(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+4 <= len(field) {
+			if c, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
+
+func (n smbNodeServer) mounts() ([]mountInfo, error) {
+	data, err := n.ioutilshim.ReadFile(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	return parseMountInfo(data), nil
+}
+
+func (n smbNodeServer) mountAt(path string) (mountInfo, bool, error) {
+	mounts, err := n.mounts()
+	if err != nil {
+		return mountInfo{}, false, err
+	}
+
+	mount, found := findMount(mounts, path)
+	return mount, found, nil
+}
+
+// sharesSuperblock reports whether another mount point has the same superblock as the mount at path, e.g. because it
+// is a bind mount of a staging mount.
+func (n smbNodeServer) sharesSuperblock(path string) bool {
+	mounts, err := n.mounts()
+	if err != nil {
+		return false
+	}
+	mount, found := findMount(mounts, path)
+	if !found {
+		return false
+	}
+	for _, m := range mounts {
+		if m.device == mount.device && m.mountPoint != mount.mountPoint {
+			return true
+		}
+	}
+	return false
+}
+
+// findMount returns the topmost mount at path.
+func findMount(mounts []mountInfo, path string) (mountInfo, bool) {
+	path = filepath.Clean(path)
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if mounts[i].mountPoint == path {
+			return mounts[i], true
+		}
+	}
+	return mountInfo{}, false
+}
@@ -6,25 +6,70 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"code.cloudfoundry.org/goshims/execshim"
+	"code.cloudfoundry.org/goshims/ioutilshim"
 	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/goshims/syscallshim"
 	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/smb-csi-driver/internal/inflight"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 var errorFmt = "Error: a required property [%s] was not provided"
+var inFlightFmt = "Error: an operation on [%s] is already in progress"
 var defaultMountOptions = "uid=1000,gid=1000"
+var volumeHealthProbeTimeout = 5 * time.Second
+
+const DefaultMountTimeout = time.Minute
+const ephemeralContextKey = "csi.storage.k8s.io/ephemeral"
+const DefaultCredentialsDir = "/run/smb-csi-driver"
+const DefaultKerberosCacheDir = "/var/lib/smb-csi-driver/krb5"
+
+// Config holds the tunables of the node server. Zero values are replaced by their defaults.
+type Config struct {
+	// MountTimeout bounds every mount and kinit command, unless the request deadline is sooner.
+	MountTimeout time.Duration
+	// UnmountTimeout bounds every step of the unmount policy, unless the request deadline is sooner.
+	UnmountTimeout time.Duration
+	// UnmountPolicy lists the unmount steps to escalate through. It defaults to DefaultUnmountPolicy.
+	UnmountPolicy []UnmountStep
+	// CredentialsDir holds the short-lived SMB credentials files. It should be backed by tmpfs.
+	CredentialsDir string
+	// KerberosCacheDir holds the credential caches of kerberos mounts for as long as they are mounted.
+	KerberosCacheDir string
+	// Kerberos keeps the tickets of kerberos mounts valid for as long as they are mounted. When it is set, kerberos
+	// mounts need a keytab; a credential cache alone expires and cannot be renewed.
+	Kerberos *KerberosRenewer
+	// MountOptions lists the mount options volumes may set. It defaults to DefaultMountOptionSchema.
+	MountOptions MountOptionSchema
+	// NamespacePolicies restricts the shares pods may mount by the namespace kubelet passes with the pod info.
+	NamespacePolicies NamespacePolicies
+	// Quotas measures the usage of volumes with a soft quota for NodeGetVolumeStats. Volumes are not measured when it
+	// is nil.
+	Quotas *QuotaScanner
+	// QuotaMountDir holds the read-only mounts of the quota directories of staged volumes.
+	QuotaMountDir string
+}
 
 //go:generate go run github.com/maxbrunsfeld/counterfeiter/v6 -o ../smb-csi-driverfakes/fake_csi_driver_store.go . CSIDriverStore
 type CSIDriverStore interface {
 	Create(string, *csi.NodePublishVolumeRequest) error
 	Delete(string)
 	Get(string, *csi.NodePublishVolumeRequest) (exists bool, optionsMatch bool, err error)
+	PublishedTargetPaths(stagingTargetPath string) []string
+	Seed(targetPath string, stagingTargetPath string)
+	TargetPaths() []string
+	StagingTargetPath(targetPath string) (string, bool)
 }
 
 func NewStore() CSIDriverStore {
@@ -32,21 +77,32 @@ func NewStore() CSIDriverStore {
 }
 
 type volumeInfo struct {
-	hash [32]byte
+	hash              [32]byte
+	stagingTargetPath string
 }
 
+// unknownOptions marks a volume that was recovered from the mount table rather than published by this process.
+var unknownOptions [32]byte
+
 type CheckParallelCSIDriverRequests struct {
+	lock  sync.Mutex
 	store map[string]volumeInfo
 }
 
 func (c *CheckParallelCSIDriverRequests) Get(targetPath string, k *csi.NodePublishVolumeRequest) (exists bool, optionsMatch bool, err error) {
-	options, err := json.Marshal(k.VolumeContext)
+	hash, err := publishOptionsHash(k)
 	if err != nil {
 		return true, true, err
 	}
-	hash := sha256.Sum256(options)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
 	if val, ok := c.store[targetPath]; ok {
+		if val.hash == unknownOptions {
+			c.store[targetPath] = volumeInfo{hash, val.stagingTargetPath}
+			return ok, true, nil
+		}
 		if val.hash == hash {
 			return ok, true, nil
 		}
@@ -56,63 +112,259 @@ func (c *CheckParallelCSIDriverRequests) Get(targetPath string, k *csi.NodePubli
 }
 
 func (c *CheckParallelCSIDriverRequests) Create(targetPath string, k *csi.NodePublishVolumeRequest) error {
-	options, err := json.Marshal(k.VolumeContext)
+	hash, err := publishOptionsHash(k)
 	if err != nil {
 		return err
 	}
-	hash := sha256.Sum256(options)
-	c.store[targetPath] = volumeInfo{hash}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.store[targetPath] = volumeInfo{hash, k.StagingTargetPath}
 	return nil
 }
 
+// publishOptionsHash identifies the options of a publish: its volume context and whether it is read-only. Read-write
+// publishes hash the volume context alone, as they always have.
+func publishOptionsHash(k *csi.NodePublishVolumeRequest) ([32]byte, error) {
+	options, err := json.Marshal(k.VolumeContext)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	if readOnly, _ := publishReadOnly(k); readOnly {
+		options = append(options, []byte(",ro")...)
+	}
+	return sha256.Sum256(options), nil
+}
+
 func (c *CheckParallelCSIDriverRequests) Delete(k string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	delete(c.store, k)
 }
 
+// Seed records a target path that is already mounted. The options of the next publish to that target path are
+// accepted and remembered.
+func (c *CheckParallelCSIDriverRequests) Seed(targetPath string, stagingTargetPath string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.store[targetPath]; ok {
+		return
+	}
+	c.store[targetPath] = volumeInfo{unknownOptions, stagingTargetPath}
+}
+
+// TargetPaths lists every target path in the store.
+func (c *CheckParallelCSIDriverRequests) TargetPaths() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	targetPaths := []string{}
+	for targetPath := range c.store {
+		targetPaths = append(targetPaths, targetPath)
+	}
+	return targetPaths
+}
+
+// StagingTargetPath returns the staging path that targetPath was published from, if it was staged.
+func (c *CheckParallelCSIDriverRequests) StagingTargetPath(targetPath string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	val, ok := c.store[targetPath]
+	return val.stagingTargetPath, ok && val.stagingTargetPath != ""
+}
+
+func (c *CheckParallelCSIDriverRequests) PublishedTargetPaths(stagingTargetPath string) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	targetPaths := []string{}
+	for targetPath, val := range c.store {
+		if val.stagingTargetPath == stagingTargetPath {
+			targetPaths = append(targetPaths, targetPath)
+		}
+	}
+	return targetPaths
+}
+
 type smbNodeServer struct {
 	logger         lager.Logger
 	execshim       execshim.Exec
 	osshim         osshim.Os
+	ioutilshim     ioutilshim.Ioutil
+	syscallshim    syscallshim.Syscall
 	csiDriverStore CSIDriverStore
-	lock           *sync.Mutex
+	targetLocks    *inflight.Locks
+	volumeLocks    *inflight.Locks
+	config         Config
+	probes         *volumeProbes
 }
 
-func NewNodeServer(logger lager.Logger, execshim execshim.Exec, osshim osshim.Os, csiDriverStore CSIDriverStore) csi.NodeServer {
+func NewNodeServer(logger lager.Logger, execshim execshim.Exec, osshim osshim.Os, ioutilshim ioutilshim.Ioutil, syscallshim syscallshim.Syscall, csiDriverStore CSIDriverStore, config Config) csi.NodeServer {
 	return &smbNodeServer{
-		logger, execshim, osshim, csiDriverStore, &sync.Mutex{},
+		logger, execshim, osshim, ioutilshim, syscallshim, csiDriverStore, inflight.New(), inflight.New(), config.withDefaults(), newVolumeProbes(),
 	}
 }
 
+func (config Config) withDefaults() Config {
+	if config.MountTimeout == 0 {
+		config.MountTimeout = DefaultMountTimeout
+	}
+	if config.CredentialsDir == "" {
+		config.CredentialsDir = DefaultCredentialsDir
+	}
+	if config.KerberosCacheDir == "" {
+		config.KerberosCacheDir = DefaultKerberosCacheDir
+	}
+	if config.QuotaMountDir == "" {
+		config.QuotaMountDir = DefaultQuotaMountDir
+	}
+	if config.UnmountTimeout == 0 {
+		config.UnmountTimeout = DefaultUnmountTimeout
+	}
+	if len(config.UnmountPolicy) == 0 {
+		config.UnmountPolicy = DefaultUnmountPolicy()
+	}
+	if config.MountOptions == nil {
+		config.MountOptions = DefaultMountOptionSchema()
+	}
+	return config
+}
+
 func (smbNodeServer) NodeGetCapabilities(context.Context, *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	return &csi.NodeGetCapabilitiesResponse{}, nil
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: []*csi.NodeServiceCapability{
+			nodeServiceCapability(csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME),
+			nodeServiceCapability(csi.NodeServiceCapability_RPC_GET_VOLUME_STATS),
+			nodeServiceCapability(csi.NodeServiceCapability_RPC_VOLUME_CONDITION),
+		},
+	}, nil
 }
 
-func (smbNodeServer) NodeStageVolume(context.Context, *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	panic("implement me")
+func (n smbNodeServer) NodeStageVolume(c context.Context, r *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	if r.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "VolumeId"))
+	}
+	if r.StagingTargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "StagingTargetPath"))
+	}
+	if r.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "VolumeCapability"))
+	}
+	if err := ValidateVolumeCapability(r.VolumeCapability); err != nil {
+		return nil, err
+	}
+
+	// Persistent volumes that only carry a nodePublishSecretRef predate staging, and their CSI source cannot be changed
+	// to add a nodeStageSecretRef. They are not staged, and every publish mounts the share with its own credentials.
+	if len(r.GetSecrets()) == 0 {
+		n.logger.Info("not staging volume without node-stage credentials", lager.Data{"volumeId": r.VolumeId, "stagingTargetPath": r.StagingTargetPath})
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	if !n.volumeLocks.TryAcquire(r.VolumeId) {
+		return nil, status.Error(codes.Aborted, fmt.Sprintf(inFlightFmt, r.VolumeId))
+	}
+	defer n.volumeLocks.Release(r.VolumeId)
+
+	_, mounted, err := n.mountAt(r.StagingTargetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if mounted {
+		n.logger.Info("already staged", lager.Data{"volumeId": r.VolumeId, "stagingTargetPath": r.StagingTargetPath})
+		n.mountQuota(c, r)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	err = n.osshim.MkdirAll(r.StagingTargetPath, os.ModePerm)
+	if err != nil {
+		n.logger.Error("create-staging-target-path-fail", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	readOnly, err := volumeReadOnly(r.GetVolumeCapability(), r.GetVolumeContext())
+	if err != nil {
+		return nil, err
+	}
+
+	err = n.mountCifs(c, r.StagingTargetPath, r.GetVolumeCapability().GetMount().GetMountFlags(), r.GetVolumeContext(), r.GetSecrets(), readOnly)
+	if err != nil {
+		return nil, err
+	}
+	n.mountQuota(c, r)
+
+	return &csi.NodeStageVolumeResponse{}, nil
 }
 
-func (smbNodeServer) NodeUnstageVolume(context.Context, *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	panic("implement me")
+func (n smbNodeServer) NodeUnstageVolume(c context.Context, r *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	if r.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "VolumeId"))
+	}
+	if r.StagingTargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "StagingTargetPath"))
+	}
+
+	if !n.volumeLocks.TryAcquire(r.VolumeId) {
+		return nil, status.Error(codes.Aborted, fmt.Sprintf(inFlightFmt, r.VolumeId))
+	}
+	defer n.volumeLocks.Release(r.VolumeId)
+
+	if targetPaths := n.csiDriverStore.PublishedTargetPaths(r.StagingTargetPath); len(targetPaths) > 0 {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Error: volume is still published at %s", strings.Join(targetPaths, ", ")))
+	}
+
+	err := n.unmountQuota(c, r.StagingTargetPath)
+	if err != nil {
+		return nil, err
+	}
+
+	_, mounted, err := n.mountAt(r.StagingTargetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !mounted {
+		n.logger.Info("already unstaged", lager.Data{"volumeId": r.VolumeId, "stagingTargetPath": r.StagingTargetPath})
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+
+	err = n.unmount(c, r.StagingTargetPath)
+	if err != nil {
+		return nil, err
+	}
+	n.removeKerberosCache(r.StagingTargetPath)
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
 func (n smbNodeServer) NodePublishVolume(c context.Context, r *csi.NodePublishVolumeRequest) (_ *csi.NodePublishVolumeResponse, opErr error) {
-	n.lock.Lock()
-	defer func() {
-		n.lock.Unlock()
-	}()
+	if !n.targetLocks.TryAcquire(r.TargetPath) {
+		return nil, status.Error(codes.Aborted, fmt.Sprintf(inFlightFmt, r.TargetPath))
+	}
+	defer n.targetLocks.Release(r.TargetPath)
 
 	found, optionsMatch, err := n.csiDriverStore.Get(r.TargetPath, r)
 	if err != nil {
 		return &csi.NodePublishVolumeResponse{}, err
 	}
 	if found {
-		if optionsMatch == false {
-			return &csi.NodePublishVolumeResponse{}, status.Error(codes.AlreadyExists, "options mismatch")
+		// The store can outlive the mount, e.g. across a reboot, so only a target path that is still mounted counts
+		// as published.
+		_, mounted, err := n.mountAt(r.TargetPath)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
 		}
-
-		if opErr == nil {
+		if mounted {
+			if optionsMatch == false {
+				return &csi.NodePublishVolumeResponse{}, status.Error(codes.AlreadyExists, "options mismatch")
+			}
 			return &csi.NodePublishVolumeResponse{}, nil
 		}
+		n.logger.Info("published-target-path-not-mounted", lager.Data{"targetPath": r.TargetPath})
+		n.csiDriverStore.Delete(r.TargetPath)
 	}
 
 	defer func() {
@@ -127,89 +379,289 @@ func (n smbNodeServer) NodePublishVolume(c context.Context, r *csi.NodePublishVo
 	if r.VolumeCapability == nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "VolumeCapability"))
 	}
+	opErr = ValidateVolumeCapability(r.VolumeCapability)
+	if opErr != nil {
+		return nil, opErr
+	}
 
-	opErr = os.MkdirAll(r.TargetPath, os.ModePerm)
+	readOnly, opErr := publishReadOnly(r)
 	if opErr != nil {
-		n.logger.Error("create-targetpath-fail", opErr)
+		return nil, opErr
 	}
 
-	share := r.GetVolumeContext()["share"]
+	volumeContext := r.GetVolumeContext()
+	mountFlags := r.GetVolumeCapability().GetMount().GetMountFlags()
+	ephemeral := ephemeralVolume(volumeContext)
+	if ephemeral {
+		if volumeContext["share"] == "" {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "share"))
+		}
+		mountFlags = append(append([]string{}, mountFlags...), ephemeralMountFlags(volumeContext)...)
+	}
 
-	allMountOptions := r.GetVolumeCapability().GetMount().GetMountFlags()
-	mountOptions := []string{}
-	for _, option := range allMountOptions {
-		optionKeyVals := strings.Split(option, "=")
-		if len(optionKeyVals) != 2 || !allowedKey(optionKeyVals[0]){
-			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Error: invalid mountOption value for '%s'", option))
+	// A volume that was staged without credentials is not mounted at its staging path; its publishes mount the share
+	// with the publish credentials. Without those, bind mounting the bare staging path would hand the pod an empty
+	// directory of the node.
+	staged := false
+	if r.StagingTargetPath != "" {
+		_, staged, opErr = n.mountAt(r.StagingTargetPath)
+		if opErr != nil {
+			return nil, status.Error(codes.Internal, opErr.Error())
+		}
+		if !staged && len(r.GetSecrets()) == 0 {
+			return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("Error: volume %s is not staged at %s", r.VolumeId, r.StagingTargetPath))
 		}
-		mountOptions = append(mountOptions, option)
 	}
 
-	mountOptions = append(mountOptions, fmt.Sprintf("username=%s", r.GetSecrets()["username"]))
-	mountOptions = append(mountOptions, fmt.Sprintf("password=%s", r.GetSecrets()["password"]))
+	mountFlags, opErr = n.applyNamespacePolicy(volumeContext, mountFlags, staged)
+	if opErr != nil {
+		return nil, opErr
+	}
+
+	opErr = os.MkdirAll(r.TargetPath, os.ModePerm)
+	if opErr != nil {
+		n.logger.Error("create-targetpath-fail", opErr)
+	}
 
-	for _, option := range mountOptions {
-		if strings.Contains(option, ",") {
-			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Error: invalid mountOption value for '%s'", option))
+	share := volumeContext["share"]
+
+	if staged {
+		logData := withPodInfo(lager.Data{"share": share, "stagingTargetPath": r.StagingTargetPath, "readOnly": readOnly}, volumeContext)
+		opErr = n.mount(c, logData, nil, "--bind", r.StagingTargetPath, r.TargetPath)
+		if opErr != nil {
+			return nil, opErr
 		}
-	}
 
-	mountOptionsString := strings.Join(mountOptions, ",")
+		// A bind mount is made read-only by remounting it, which leaves the staging mount and the other bind mounts
+		// of the volume writable.
+		if readOnly {
+			opErr = n.mount(c, logData, nil, "-o", "remount,bind,ro", r.TargetPath)
+			if opErr != nil {
+				if err := n.unmount(c, r.TargetPath); err != nil {
+					n.logger.Error("unmount-after-remount-failed", err, logData)
+				}
+				return nil, opErr
+			}
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
 
-	n.logger.Info("started mount", lager.Data{"share": share})
-	cmdshim := n.execshim.Command("mount", "-t", "cifs", "-o", mountOptionsString, share, r.TargetPath)
-	combinedOutput, opErr := cmdshim.CombinedOutput()
+	opErr = n.mountCifs(c, r.TargetPath, mountFlags, volumeContext, r.GetSecrets(), readOnly)
 	if opErr != nil {
-		n.logger.Error("mount-failed", opErr, lager.Data{"combinedOutput": string(combinedOutput)})
-		return nil, status.Error(codes.Internal, opErr.Error())
+		// kubelet created the target path of an ephemeral volume for this publish only, and forgets it when the
+		// publish fails.
+		if ephemeral {
+			if err := n.osshim.Remove(r.TargetPath); err != nil && !os.IsNotExist(err) {
+				n.logger.Error("remove-ephemeral-target-path-failed", err, lager.Data{"targetPath": r.TargetPath})
+			}
+		}
+		return nil, opErr
 	}
-	n.logger.Info("finished mount", lager.Data{"share": share})
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
-func (n smbNodeServer) NodeUnpublishVolume(c context.Context, r *csi.NodeUnpublishVolumeRequest) (_ *csi.NodeUnpublishVolumeResponse, err error) {
-	n.lock.Lock()
-	defer func() {
-		n.lock.Unlock()
-	}()
-
-	defer func() {
-		n.csiDriverStore.Delete(r.TargetPath)
-	}()
-
+// NodeUnpublishVolume tears down the target path as far as it still exists, so that it succeeds when a previous
+// attempt already unmounted or removed it. The publish record is only dropped once the teardown is complete.
+func (n smbNodeServer) NodeUnpublishVolume(c context.Context, r *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	if r.TargetPath == "" {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "TargetPath"))
 	}
 
-	n.logger.Info("about to remove dir")
+	if !n.targetLocks.TryAcquire(r.TargetPath) {
+		return nil, status.Error(codes.Aborted, fmt.Sprintf(inFlightFmt, r.TargetPath))
+	}
+	defer n.targetLocks.Release(r.TargetPath)
+
+	logData := lager.Data{"volumeId": r.VolumeId, "targetPath": r.TargetPath}
 
-	cmdshim := n.execshim.Command("umount", "-l", r.TargetPath)
-	err = cmdshim.Start()
+	_, mounted, err := n.mountAt(r.TargetPath)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	if mounted {
+		err = n.unmount(c, r.TargetPath)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		n.logger.Info("target path not mounted", logData)
+	}
+
+	n.logger.Info("about to remove dir", logData)
+
+	err = n.osshim.Remove(r.TargetPath)
+	if err != nil && !os.IsNotExist(err) {
+		n.logger.Error("remove-target-path-failed", err, logData)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 
-	n.logger.Info("started umount")
+	n.logger.Info("removed dir", logData)
+	n.csiDriverStore.Delete(r.TargetPath)
+	n.removeKerberosCache(r.TargetPath)
 
-	err = cmdshim.Wait()
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+func (n smbNodeServer) NodeGetVolumeStats(c context.Context, r *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	if r.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "VolumeId"))
+	}
+	if r.VolumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "VolumePath"))
+	}
+
+	_, mounted, err := n.mountAt(r.VolumePath)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	n.logger.Info("finished umount")
+	if !mounted {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("Error: volume %s is not mounted at %s", r.VolumeId, r.VolumePath))
+	}
 
-	err = n.osshim.Remove(r.TargetPath)
+	stats, err := n.probeVolume(c, r.VolumePath)
+	if err == context.Canceled {
+		return nil, status.Error(codes.Canceled, err.Error())
+	}
 	if err != nil {
+		n.logger.Error("statfs-failed", err, lager.Data{"volumePath": r.VolumePath})
+		if condition, ok := abnormalVolumeCondition(r.VolumePath, err); ok {
+			return &csi.NodeGetVolumeStatsResponse{VolumeCondition: condition}, nil
+		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	n.logger.Info("removed dir")
+	blockSize := int64(stats.Bsize)
+	resp := &csi.NodeGetVolumeStatsResponse{
+		VolumeCondition: &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"},
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     int64(stats.Blocks) * blockSize,
+				Available: int64(stats.Bavail) * blockSize,
+				Used:      int64(stats.Blocks-stats.Bfree) * blockSize,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     int64(stats.Files),
+				Available: int64(stats.Ffree),
+				Used:      int64(stats.Files - stats.Ffree),
+			},
+		},
+	}
+	if n.config.Quotas != nil {
+		if usage, ok := n.quotaUsage(r); ok {
+			applyQuota(resp, usage)
+		}
+	}
+	return resp, nil
+}
 
-	return &csi.NodeUnpublishVolumeResponse{}, nil
+// applyQuota reports the usage of a volume with a soft quota against its quota rather than the share, so that the
+// volume metrics of kubelet show how full the volume is. A volume over its quota is reported as abnormal.
+func applyQuota(resp *csi.NodeGetVolumeStatsResponse, usage quotaUsage) {
+	bytes := resp.Usage[0]
+	available := usage.limitBytes - usage.usedBytes
+	if available < 0 {
+		available = 0
+	}
+	if available > bytes.Available {
+		available = bytes.Available
+	}
+	bytes.Total, bytes.Used, bytes.Available = usage.limitBytes, usage.usedBytes, available
+
+	if usage.usedBytes > usage.limitBytes {
+		resp.VolumeCondition = &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("volume uses %d bytes, more than its soft quota of %d bytes", usage.usedBytes, usage.limitBytes),
+		}
+	}
 }
 
-func (smbNodeServer) NodeGetVolumeStats(context.Context, *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	panic("implement me")
+// probeVolume runs statfs on the volume path, giving up once volumeHealthProbeTimeout or the request deadline passes
+// so that a hung CIFS mount cannot block the caller. A statfs on a hung mount blocks its thread in the kernel for good,
+// so a path has at most one probe in flight: later calls wait on it, and once it has timed out they report it as hung
+// straight away.
+func (n smbNodeServer) probeVolume(c context.Context, volumePath string) (syscall.Statfs_t, error) {
+	ctx, cancel := context.WithTimeout(c, volumeHealthProbeTimeout)
+	defer cancel()
+
+	probe := n.probes.start(volumePath, n.syscallshim)
+	if probe.timedOut() {
+		return syscall.Statfs_t{}, context.DeadlineExceeded
+	}
+
+	select {
+	case <-probe.done:
+		return probe.stats, probe.err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			probe.markTimedOut()
+		}
+		return syscall.Statfs_t{}, ctx.Err()
+	}
+}
+
+// volumeProbes tracks the statfs probes in flight by volume path.
+type volumeProbes struct {
+	lock     sync.Mutex
+	inFlight map[string]*volumeProbe
+}
+
+type volumeProbe struct {
+	done  chan struct{}
+	stats syscall.Statfs_t
+	err   error
+
+	lock        sync.Mutex
+	hasTimedOut bool
+}
+
+func newVolumeProbes() *volumeProbes {
+	return &volumeProbes{inFlight: map[string]*volumeProbe{}}
+}
+
+// start returns the probe of volumePath that is in flight, or starts one.
+func (p *volumeProbes) start(volumePath string, syscallshim syscallshim.Syscall) *volumeProbe {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if probe, ok := p.inFlight[volumePath]; ok {
+		return probe
+	}
+	probe := &volumeProbe{done: make(chan struct{})}
+	p.inFlight[volumePath] = probe
+	go func() {
+		probe.err = syscallshim.Statfs(volumePath, &probe.stats)
+
+		p.lock.Lock()
+		delete(p.inFlight, volumePath)
+		p.lock.Unlock()
+		close(probe.done)
+	}()
+	return probe
+}
+
+func (p *volumeProbe) timedOut() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.hasTimedOut
+}
+
+func (p *volumeProbe) markTimedOut() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.hasTimedOut = true
+}
+
+func abnormalVolumeCondition(volumePath string, err error) (*csi.VolumeCondition, bool) {
+	switch err {
+	case context.DeadlineExceeded:
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("probe of %s timed out, the mount may be hung", volumePath)}, true
+	case syscall.EHOSTDOWN, syscall.ESTALE, syscall.EACCES:
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("probe of %s failed: %s", volumePath, err.Error())}, true
+	}
+	return nil, false
 }
 
 func (smbNodeServer) NodeExpandVolume(context.Context, *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
@@ -227,12 +679,298 @@ func (s smbNodeServer) NodeGetInfo(context.Context, *csi.NodeGetInfoRequest) (*c
 	}, nil
 }
 
-func allowedKey(opt string) bool {
-	allowedKeys := []string{"uid", "gid", "vers"}
-	for _, key := range allowedKeys {
-		if opt == key {
-			return true
+func (n smbNodeServer) mount(c context.Context, logData lager.Data, env []string, args ...string) error {
+	ctx, cancel := context.WithTimeout(c, n.config.MountTimeout)
+	defer cancel()
+
+	n.logger.Info("started mount", logData)
+	cmdshim := n.execshim.CommandContext(ctx, "mount", args...)
+	if env != nil {
+		cmdshim.SetEnv(env)
+	}
+	combinedOutput, err := cmdshim.CombinedOutput()
+	if err != nil {
+		n.logger.Error("mount-failed", err, logData, lager.Data{"combinedOutput": string(combinedOutput)})
+		return commandError(ctx, "mount", err)
+	}
+	n.logger.Info("finished mount", logData)
+	return nil
+}
+
+// commandError maps the failure of a command run with ctx to a gRPC error, reporting commands that were killed
+// because the request deadline passed or the request was cancelled as such.
+func commandError(ctx context.Context, command string, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, fmt.Sprintf("Error: %s did not complete before the deadline: %s", command, err.Error()))
+	case context.Canceled:
+		return status.Error(codes.Canceled, fmt.Sprintf("Error: %s was cancelled: %s", command, err.Error()))
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (n smbNodeServer) mountCifs(c context.Context, targetPath string, mountFlags []string, volumeContext map[string]string, secrets map[string]string, readOnly bool) (err error) {
+	share := strings.TrimSuffix(volumeContext["share"], "/")
+	subDir, err := subDirectory(volumeContext)
+	if err != nil {
+		return err
+	}
+	createSubDir, err := boolAttribute(volumeContext, "createSubDir")
+	if err != nil {
+		return err
+	}
+
+	mountOptions, err := n.cifsMountOptions(mountFlags)
+	if err != nil {
+		return err
+	}
+
+	logData := withPodInfo(lager.Data{"share": share, "subDir": subDir, "ephemeral": ephemeralVolume(volumeContext)}, volumeContext)
+	var authOptions []string
+	var env []string
+	if kerberosRequested(volumeContext, secrets) {
+		var cachePath string
+		cachePath, err = n.prepareKerberosCache(c, targetPath, secrets)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				n.removeKerberosCache(targetPath)
+			}
+		}()
+
+		logData["authentication"] = kerberosAuthentication
+		authOptions = []string{"sec=krb5", fmt.Sprintf("cruid=%d", n.osshim.Getuid())}
+		env = append(n.osshim.Environ(), fmt.Sprintf("KRB5CCNAME=FILE:%s", cachePath))
+	} else {
+		credentialsFile, err := n.writeCredentials(secrets)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err := n.osshim.Remove(credentialsFile)
+			if err != nil {
+				n.logger.Error("remove-credentials-failed", err)
+			}
+		}()
+
+		authOptions = []string{fmt.Sprintf("credentials=%s", credentialsFile)}
+	}
+
+	source := share
+	if subDir != "" {
+		if createSubDir {
+			err = n.createSubDir(c, logData, env, append(append([]string{}, mountOptions...), authOptions...), share, subDir, targetPath)
+			if err != nil {
+				return err
+			}
+		}
+		source = share + "/" + subDir
+	}
+
+	if readOnly {
+		mountOptions = append(mountOptions, "ro")
+	}
+	mountOptions = append(mountOptions, authOptions...)
+	return n.mount(c, logData, env, "-t", "cifs", "-o", strings.Join(mountOptions, ","), source, targetPath)
+}
+
+// createSubDir mounts the root of the share read-write at targetPath just long enough to create subDir in it.
+func (n smbNodeServer) createSubDir(c context.Context, logData lager.Data, env []string, mountOptions []string, share string, subDir string, targetPath string) error {
+	err := n.mount(c, logData, env, "-t", "cifs", "-o", strings.Join(mountOptions, ","), share, targetPath)
+	if err != nil {
+		return err
+	}
+
+	mkdirErr := n.osshim.MkdirAll(filepath.Join(targetPath, subDir), os.ModePerm)
+	if mkdirErr != nil {
+		n.logger.Error("create-subdir-failed", mkdirErr, logData)
+	}
+
+	err = n.unmount(c, targetPath)
+	if err != nil {
+		return err
+	}
+	if mkdirErr != nil {
+		return status.Error(codes.Internal, mkdirErr.Error())
+	}
+	return nil
+}
+
+// writeCredentials writes the username and password to a file only root can read, so that they appear neither in
+// the mount command line nor in its option parser. TempFile creates the file with mode 0600.
+func (n smbNodeServer) writeCredentials(secrets map[string]string) (string, error) {
+	for _, key := range []string{"username", "password", "domain", "workgroup"} {
+		if strings.ContainsAny(secrets[key], "\n\r\x00") {
+			return "", status.Error(codes.InvalidArgument, fmt.Sprintf("Error: the %s secret must not contain line breaks or NUL characters", key))
+		}
+	}
+
+	username, domain, err := parseUsername(secrets)
+	if err != nil {
+		return "", err
+	}
+
+	contents := fmt.Sprintf("username=%s\npassword=%s\n", username, secrets["password"])
+	if domain != "" {
+		contents += fmt.Sprintf("domain=%s\n", domain)
+	}
+
+	file, err := n.ioutilshim.TempFile(n.config.CredentialsDir, "credentials")
+	if err != nil {
+		n.logger.Error("create-credentials-failed", err)
+		return "", status.Error(codes.Internal, err.Error())
+	}
+
+	_, err = file.WriteString(contents)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		n.logger.Error("write-credentials-failed", err)
+		_ = n.osshim.Remove(file.Name())
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	return file.Name(), nil
+}
+
+// parseUsername splits DOMAIN\user and user@domain usernames into the user and the domain, and reconciles the domain
+// with the optional domain (or workgroup) secret.
+func parseUsername(secrets map[string]string) (string, string, error) {
+	username := secrets["username"]
+	domain := secrets["domain"]
+	if workgroup := secrets["workgroup"]; workgroup != "" {
+		if domain != "" && !strings.EqualFold(domain, workgroup) {
+			return "", "", status.Error(codes.InvalidArgument, fmt.Sprintf("Error: the domain secret '%s' does not match the workgroup secret '%s'", domain, workgroup))
+		}
+		domain = workgroup
+	}
+
+	usernameDomain := ""
+	if i := strings.Index(username, `\`); i != -1 {
+		usernameDomain, username = username[:i], username[i+1:]
+	} else if i := strings.LastIndex(username, "@"); i != -1 {
+		username, usernameDomain = username[:i], username[i+1:]
+	}
+	if usernameDomain == "" {
+		return username, domain, nil
+	}
+
+	if username == "" {
+		return "", "", status.Error(codes.InvalidArgument, fmt.Sprintf("Error: the username secret '%s' does not name a user", secrets["username"]))
+	}
+	if domain != "" && !strings.EqualFold(domain, usernameDomain) {
+		return "", "", status.Error(codes.InvalidArgument, fmt.Sprintf("Error: the domain secret '%s' does not match the domain of the username secret '%s'", domain, secrets["username"]))
+	}
+	return username, usernameDomain, nil
+}
+
+// ValidateVolumeCapability accepts CIFS filesystem volumes in any of the single and multi node access modes. The reader
+// only modes are published read-only; the writer modes leave concurrent access to the SMB server.
+func ValidateVolumeCapability(volumeCapability *csi.VolumeCapability) error {
+	if volumeCapability.GetBlock() != nil {
+		return status.Error(codes.InvalidArgument, "Error: block volumes are not supported")
+	}
+	if fsType := volumeCapability.GetMount().GetFsType(); fsType != "" && fsType != "cifs" {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("Error: fsType '%s' is not supported, expected cifs", fsType))
+	}
+
+	if volumeCapability.GetAccessMode() == nil {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf(errorFmt, "VolumeCapability.AccessMode"))
+	}
+	switch mode := volumeCapability.GetAccessMode().GetMode(); mode {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+		return nil
+	default:
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("Error: access mode %s is not supported", mode))
+	}
+}
+
+// publishReadOnly reports whether a publish asks for a read-only view of the volume, through its Readonly flag, its
+// access mode or the readOnly volume attribute.
+func publishReadOnly(r *csi.NodePublishVolumeRequest) (bool, error) {
+	if r.GetReadonly() {
+		return true, nil
+	}
+	return volumeReadOnly(r.GetVolumeCapability(), r.GetVolumeContext())
+}
+
+// volumeReadOnly reports whether every user of the volume gets a read-only view of it, because its access mode only
+// allows readers or its readOnly volume attribute is set.
+func volumeReadOnly(volumeCapability *csi.VolumeCapability, volumeContext map[string]string) (bool, error) {
+	switch volumeCapability.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true, nil
+	}
+
+	return boolAttribute(volumeContext, "readOnly")
+}
+
+// ephemeralVolume reports whether kubelet publishes an inline volume of a pod. Inline volumes are never staged; their
+// share, options and the nodePublishSecretRef credentials come with the publish.
+func ephemeralVolume(volumeContext map[string]string) bool {
+	return volumeContext[ephemeralContextKey] == "true"
+}
+
+// ephemeralMountFlags returns the comma separated mountOptions attribute of an inline volume, which cannot carry
+// mount options of its own.
+func ephemeralMountFlags(volumeContext map[string]string) []string {
+	mountFlags := []string{}
+	for _, flag := range strings.Split(volumeContext["mountOptions"], ",") {
+		if flag = strings.TrimSpace(flag); flag != "" {
+			mountFlags = append(mountFlags, flag)
 		}
 	}
-	return false
-}
\ No newline at end of file
+	return mountFlags
+}
+
+func boolAttribute(volumeContext map[string]string, key string) (bool, error) {
+	value := volumeContext[key]
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, status.Error(codes.InvalidArgument, fmt.Sprintf("Error: invalid %s volume attribute '%s', expected true or false", key, value))
+	}
+	return b, nil
+}
+
+// subDirectory returns the subDir volume attribute as a clean path relative to the root of the share. Absolute paths
+// and paths that climb out of the share are refused.
+func subDirectory(volumeContext map[string]string) (string, error) {
+	subDir := volumeContext["subDir"]
+	if subDir == "" {
+		return "", nil
+	}
+	if strings.ContainsAny(subDir, "\\\x00\n\r") {
+		return "", status.Error(codes.InvalidArgument, fmt.Sprintf("Error: invalid subDir '%s', it must not contain backslashes or control characters", subDir))
+	}
+	if path.IsAbs(subDir) {
+		return "", status.Error(codes.InvalidArgument, fmt.Sprintf("Error: invalid subDir '%s', it must be relative to the share", subDir))
+	}
+	for _, element := range strings.Split(subDir, "/") {
+		if element == ".." {
+			return "", status.Error(codes.InvalidArgument, fmt.Sprintf("Error: invalid subDir '%s', it must not contain '..'", subDir))
+		}
+	}
+
+	subDir = path.Clean(subDir)
+	if subDir == "." {
+		return "", nil
+	}
+	return subDir, nil
+}
+
+func nodeServiceCapability(capability csi.NodeServiceCapability_RPC_Type) *csi.NodeServiceCapability {
+	return &csi.NodeServiceCapability{
+		Type: &csi.NodeServiceCapability_Rpc{
+			Rpc: &csi.NodeServiceCapability_RPC{Type: capability},
+		},
+	}
+}
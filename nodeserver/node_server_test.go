@@ -1,12 +1,20 @@
 package nodeserver_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"code.cloudfoundry.org/goshims/execshim/exec_fake"
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
 	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/goshims/syscallshim/syscall_fake"
 	"code.cloudfoundry.org/lager/lagertest"
 	. "code.cloudfoundry.org/smb-csi-driver/nodeserver"
 	smbcsidriverfakes "code.cloudfoundry.org/smb-csi-driver/smb-csi-driverfakes"
@@ -14,8 +22,12 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	. "github.com/onsi/gomega/gbytes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+var multiNodeMultiWriter = &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}
+
 var _ = Describe("NodeServer", func() {
 
 	var (
@@ -26,6 +38,9 @@ var _ = Describe("NodeServer", func() {
 		fakeOs             *os_fake.FakeOs
 		fakeExec           *exec_fake.FakeExec
 		fakeCmd            *exec_fake.FakeCmd
+		fakeIoutil         *ioutil_fake.FakeIoutil
+		fakeCredentials    *os_fake.FakeFile
+		fakeSyscall        *syscall_fake.FakeSyscall
 		fakeCSIDriverStore *smbcsidriverfakes.FakeCSIDriverStore
 	)
 
@@ -34,11 +49,16 @@ var _ = Describe("NodeServer", func() {
 		fakeOs = &os_fake.FakeOs{}
 		fakeExec = &exec_fake.FakeExec{}
 		fakeCmd = &exec_fake.FakeCmd{}
-		fakeExec.CommandReturns(fakeCmd)
+		fakeExec.CommandContextReturns(fakeCmd)
+		fakeIoutil = &ioutil_fake.FakeIoutil{}
+		fakeCredentials = &os_fake.FakeFile{}
+		fakeCredentials.NameReturns("/run/smb-csi-driver/credentials123")
+		fakeIoutil.TempFileReturns(fakeCredentials, nil)
+		fakeSyscall = &syscall_fake.FakeSyscall{}
 		fakeCSIDriverStore = &smbcsidriverfakes.FakeCSIDriverStore{}
 		ctx = context.Background()
 
-		nodeServer = NewNodeServer(logger, fakeExec, fakeOs, fakeCSIDriverStore)
+		nodeServer = NewNodeServer(logger, fakeExec, fakeOs, fakeIoutil, fakeSyscall, fakeCSIDriverStore, Config{})
 	})
 
 	Describe("parallel identical #NodePublish requests", func() {
@@ -48,7 +68,7 @@ var _ = Describe("NodeServer", func() {
 
 		BeforeEach(func() {
 			request = &csi.NodePublishVolumeRequest{
-				VolumeCapability: &csi.VolumeCapability{},
+				VolumeCapability: &csi.VolumeCapability{AccessMode: multiNodeMultiWriter},
 				TargetPath:       "/tmp/target_path",
 				VolumeContext: map[string]string{
 					"share": "//server/export",
@@ -60,6 +80,7 @@ var _ = Describe("NodeServer", func() {
 			}
 			fakeCSIDriverStore.GetReturns(true, true, nil)
 			fakeCSIDriverStore.GetReturnsOnCall(0, false, true, nil)
+			fakeIoutil.ReadFileReturns([]byte("130 25 0:52 / /tmp/target_path rw,relatime shared:70 - cifs //server/export rw,vers=3.0\n"), nil)
 
 		})
 
@@ -72,7 +93,9 @@ var _ = Describe("NodeServer", func() {
 					defer GinkgoRecover()
 					defer wg.Done()
 					_, err := nodeServer.NodePublishVolume(ctx, request)
-					Expect(err).NotTo(HaveOccurred())
+					if err != nil {
+						Expect(status.Code(err)).To(Equal(codes.Aborted))
+					}
 				}()
 			}
 			wg.Wait()
@@ -84,6 +107,70 @@ var _ = Describe("NodeServer", func() {
 		})
 	})
 
+	Describe("#NodePublishVolume while another operation is in flight", func() {
+		var (
+			request     *csi.NodePublishVolumeRequest
+			mountCalled chan struct{}
+			unblock     chan struct{}
+			done        chan error
+		)
+
+		BeforeEach(func() {
+			request = &csi.NodePublishVolumeRequest{
+				VolumeCapability: &csi.VolumeCapability{AccessMode: multiNodeMultiWriter},
+				TargetPath:       "/tmp/target_path",
+				VolumeContext: map[string]string{
+					"share": "//server/export",
+				},
+			}
+
+			mountCalled = make(chan struct{}, 1)
+			unblock = make(chan struct{})
+			blockingCmd := &exec_fake.FakeCmd{}
+			blockingCmd.CombinedOutputStub = func() ([]byte, error) {
+				mountCalled <- struct{}{}
+				<-unblock
+				return nil, nil
+			}
+			fakeExec.CommandContextReturnsOnCall(0, blockingCmd)
+
+			done = make(chan error)
+			go func() {
+				_, err := nodeServer.NodePublishVolume(ctx, request)
+				done <- err
+			}()
+			Eventually(mountCalled).Should(Receive())
+		})
+
+		AfterEach(func() {
+			close(unblock)
+			Eventually(done).Should(Receive(BeNil()))
+		})
+
+		It("should abort a second publish of the same target path", func() {
+			_, err := nodeServer.NodePublishVolume(ctx, request)
+			Expect(err).To(MatchError("rpc error: code = Aborted desc = Error: an operation on [/tmp/target_path] is already in progress"))
+		})
+
+		It("should abort an unpublish of the same target path", func() {
+			_, err := nodeServer.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "volume-id", TargetPath: "/tmp/target_path"})
+			Expect(status.Code(err)).To(Equal(codes.Aborted))
+		})
+
+		It("should publish other target paths in parallel", func() {
+			otherRequest := &csi.NodePublishVolumeRequest{
+				VolumeCapability: &csi.VolumeCapability{AccessMode: multiNodeMultiWriter},
+				TargetPath:       "/tmp/other_target_path",
+				VolumeContext: map[string]string{
+					"share": "//other-server/export",
+				},
+			}
+			_, err := nodeServer.NodePublishVolume(ctx, otherRequest)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeExec.CommandContextCallCount()).To(Equal(2))
+		})
+	})
+
 	Describe("#NodePublishVolume", func() {
 
 		var (
@@ -94,7 +181,7 @@ var _ = Describe("NodeServer", func() {
 
 		BeforeEach(func() {
 			request = &csi.NodePublishVolumeRequest{
-				VolumeCapability: &csi.VolumeCapability{},
+				VolumeCapability: &csi.VolumeCapability{AccessMode: multiNodeMultiWriter},
 				TargetPath:       "/tmp/target_path",
 				VolumeContext: map[string]string{
 					"share": "//server/export",
@@ -123,6 +210,380 @@ var _ = Describe("NodeServer", func() {
 			})
 		})
 
+		Context("when a block volume is requested", func() {
+			BeforeEach(func() {
+				request.VolumeCapability = &csi.VolumeCapability{
+					AccessMode: multiNodeMultiWriter,
+					AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				}
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: block volumes are not supported"))
+				Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+				Expect(fakeCSIDriverStore.CreateCallCount()).To(BeZero())
+			})
+		})
+
+		Context("when a filesystem other than cifs is requested", func() {
+			BeforeEach(func() {
+				request.VolumeCapability = &csi.VolumeCapability{
+					AccessMode: multiNodeMultiWriter,
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+				}
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: fsType 'ext4' is not supported, expected cifs"))
+				Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+			})
+		})
+
+		Context("when the cifs filesystem is requested", func() {
+			BeforeEach(func() {
+				request.VolumeCapability = &csi.VolumeCapability{
+					AccessMode: multiNodeMultiWriter,
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "cifs"}},
+				}
+			})
+
+			It("should perform a mount", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeExec.CommandContextCallCount()).To(Equal(1))
+			})
+		})
+
+		Context("when the access mode is not supplied", func() {
+			BeforeEach(func() {
+				request.VolumeCapability = &csi.VolumeCapability{}
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: a required property [VolumeCapability.AccessMode] was not provided"))
+			})
+		})
+
+		Context("when the access mode is unknown", func() {
+			BeforeEach(func() {
+				request.VolumeCapability = &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{}}
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: access mode UNKNOWN is not supported"))
+			})
+		})
+
+		Context("when a single node or multi node access mode is requested", func() {
+			It("should mount the share read-write unless the mode only allows readers", func() {
+				for mode, readOnly := range map[csi.VolumeCapability_AccessMode_Mode]bool{
+					csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:       false,
+					csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:  true,
+					csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:   true,
+					csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER: false,
+					csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:  false,
+				} {
+					request.TargetPath = "/tmp/target_path_" + mode.String()
+					request.VolumeCapability = &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode}}
+					_, err := nodeServer.NodePublishVolume(ctx, request)
+					Expect(err).NotTo(HaveOccurred(), mode.String())
+
+					_, _, args := fakeExec.CommandContextArgsForCall(fakeExec.CommandContextCallCount() - 1)
+					Expect(strings.HasPrefix(args[3], "ro,")).To(Equal(readOnly), mode.String())
+				}
+			})
+		})
+
+		Context("when an ephemeral inline volume is published", func() {
+			BeforeEach(func() {
+				request.VolumeCapability = &csi.VolumeCapability{
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				}
+				request.VolumeContext = map[string]string{
+					"csi.storage.k8s.io/ephemeral": "true",
+					"csi.storage.k8s.io/pod.name":  "pod-1",
+					"share":                        "//server/export",
+					"mountOptions":                 "uid=1000, nobrl",
+				}
+			})
+
+			It("should mount the share with the options from the volume attributes", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeExec.CommandContextCallCount()).To(Equal(1))
+				_, command, args := fakeExec.CommandContextArgsForCall(0)
+				Expect(command).To(Equal("mount"))
+				Expect(args).To(Equal([]string{"-t", "cifs", "-o", "uid=1000,nobrl,credentials=/run/smb-csi-driver/credentials123", "//server/export", request.TargetPath}))
+				Expect(fakeIoutil.TempFileCallCount()).To(Equal(1))
+				Expect(fakeCredentials.WriteStringArgsForCall(0)).To(Equal("username=user1\npassword=pass1\n"))
+			})
+
+			It("should record the publish", func() {
+				Expect(fakeCSIDriverStore.CreateCallCount()).To(Equal(1))
+			})
+
+			Context("when the share is not provided", func() {
+				BeforeEach(func() {
+					delete(request.VolumeContext, "share")
+				})
+
+				It("should return an error", func() {
+					Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: a required property [share] was not provided"))
+					Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+				})
+			})
+
+			Context("when the mountOptions attribute holds an option that is not allowed", func() {
+				BeforeEach(func() {
+					request.VolumeContext["mountOptions"] = "uid=1000,password=secret"
+				})
+
+				It("should return an error", func() {
+					Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+					Expect(err.Error()).To(ContainSubstring("mountOption 'password' is not allowed"))
+					Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+				})
+			})
+
+			Context("when the mount fails", func() {
+				BeforeEach(func() {
+					fakeCmd.CombinedOutputReturns([]byte("some-stdout"), errors.New("mount-failed"))
+				})
+
+				It("should remove the target path and return an error", func() {
+					Expect(err).To(MatchError("rpc error: code = Internal desc = mount-failed"))
+					Expect(fakeOs.RemoveArgsForCall(fakeOs.RemoveCallCount() - 1)).To(Equal(request.TargetPath))
+					Expect(fakeCSIDriverStore.CreateCallCount()).To(BeZero())
+				})
+			})
+		})
+
+		Context("when pod info is passed on mount", func() {
+			var policies NamespacePolicies
+
+			BeforeEach(func() {
+				request.VolumeContext["csi.storage.k8s.io/pod.namespace"] = "team-a"
+				request.VolumeContext["csi.storage.k8s.io/pod.name"] = "pod-1"
+				request.VolumeContext["csi.storage.k8s.io/pod.uid"] = "pod-uid-1"
+				request.VolumeContext["csi.storage.k8s.io/serviceAccount.name"] = "default"
+
+				uid, gid := uint32(2000), uint32(3000)
+				policies = NamespacePolicies{
+					"team-a": {AllowedServers: []string{"SERVER"}, UID: &uid, GID: &gid},
+					"*":      {AllowedServers: []string{"other-server"}},
+				}
+				nodeServer = NewNodeServer(logger, fakeExec, fakeOs, fakeIoutil, fakeSyscall, fakeCSIDriverStore, Config{NamespacePolicies: policies})
+			})
+
+			It("should include the pod in the mount log lines", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(logger.Buffer()).To(Say(`started mount.*"podName":"pod-1","podNamespace":"team-a","podUID":"pod-uid-1".*"serviceAccount":"default"`))
+				Expect(logger.Buffer()).To(Say(`finished mount.*"podNamespace":"team-a"`))
+			})
+
+			It("should apply the uid and gid of the namespace", func() {
+				_, _, args := fakeExec.CommandContextArgsForCall(0)
+				Expect(args[3]).To(Equal("uid=2000,gid=3000,credentials=/run/smb-csi-driver/credentials123"))
+			})
+
+			Context("when the volume sets another uid", func() {
+				BeforeEach(func() {
+					request.VolumeCapability = &csi.VolumeCapability{AccessMode: multiNodeMultiWriter, AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"uid=1000", "vers=3.0"}},
+					}}
+				})
+
+				It("should replace it with the uid of the namespace", func() {
+					_, _, args := fakeExec.CommandContextArgsForCall(0)
+					Expect(args[3]).To(Equal("vers=3.0,uid=2000,gid=3000,credentials=/run/smb-csi-driver/credentials123"))
+				})
+
+				Context("when the volume has been staged", func() {
+					BeforeEach(func() {
+						request.StagingTargetPath = "/tmp/staging_path"
+						fakeIoutil.ReadFileReturns([]byte("120 25 0:52 / /tmp/staging_path rw,relatime shared:70 - cifs //server/export rw,vers=3.0\n"), nil)
+					})
+
+					It("should refuse to publish it", func() {
+						Expect(err).To(MatchError("rpc error: code = PermissionDenied desc = Error: pods in namespace 'team-a' must mount with uid=2000"))
+						Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+					})
+				})
+			})
+
+			Context("when a staged volume was mounted with the uid and gid of the namespace", func() {
+				BeforeEach(func() {
+					request.StagingTargetPath = "/tmp/staging_path"
+					fakeIoutil.ReadFileReturns([]byte("120 25 0:52 / /tmp/staging_path rw,relatime shared:70 - cifs //server/export rw,vers=3.0\n"), nil)
+					request.VolumeCapability = &csi.VolumeCapability{AccessMode: multiNodeMultiWriter, AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"gid=3000", "uid=2000"}},
+					}}
+				})
+
+				It("should bind mount it", func() {
+					Expect(err).NotTo(HaveOccurred())
+					_, _, args := fakeExec.CommandContextArgsForCall(0)
+					Expect(args).To(Equal([]string{"--bind", "/tmp/staging_path", request.TargetPath}))
+				})
+			})
+
+			Context("when the share is on a server the namespace may not mount", func() {
+				BeforeEach(func() {
+					request.VolumeContext["share"] = "//other-server/export"
+				})
+
+				It("should refuse to publish it", func() {
+					Expect(err).To(MatchError("rpc error: code = PermissionDenied desc = Error: pods in namespace 'team-a' may not mount shares of server 'other-server'"))
+					Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+					Expect(fakeCSIDriverStore.CreateCallCount()).To(BeZero())
+				})
+			})
+
+			Context("when the namespace has no policy of its own", func() {
+				BeforeEach(func() {
+					request.VolumeContext["csi.storage.k8s.io/pod.namespace"] = "team-b"
+				})
+
+				It("should apply the default policy", func() {
+					Expect(err).To(MatchError("rpc error: code = PermissionDenied desc = Error: pods in namespace 'team-b' may not mount shares of server 'server'"))
+				})
+
+				Context("when there is no default policy", func() {
+					BeforeEach(func() {
+						delete(policies, "*")
+					})
+
+					It("should mount the share unrestricted", func() {
+						Expect(err).NotTo(HaveOccurred())
+						_, _, args := fakeExec.CommandContextArgsForCall(0)
+						Expect(args[3]).To(Equal("credentials=/run/smb-csi-driver/credentials123"))
+					})
+				})
+			})
+		})
+
+		Context("when a persistent volume carries a mountOptions attribute", func() {
+			BeforeEach(func() {
+				request.VolumeContext["mountOptions"] = "nobrl"
+			})
+
+			It("should ignore it", func() {
+				Expect(err).NotTo(HaveOccurred())
+				_, _, args := fakeExec.CommandContextArgsForCall(0)
+				Expect(args[3]).To(Equal("credentials=/run/smb-csi-driver/credentials123"))
+			})
+		})
+
+		Context("when a subDir is requested", func() {
+			BeforeEach(func() {
+				request.VolumeContext["subDir"] = "team-a/data"
+			})
+
+			It("should mount the subdirectory of the share", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeExec.CommandContextCallCount()).To(Equal(1))
+				_, _, args := fakeExec.CommandContextArgsForCall(0)
+				Expect(args).To(Equal([]string{"-t", "cifs", "-o", "credentials=/run/smb-csi-driver/credentials123", "//server/export/team-a/data", request.TargetPath}))
+				Expect(fakeOs.MkdirAllCallCount()).To(BeZero())
+			})
+
+			Context("when the subDir is not clean", func() {
+				BeforeEach(func() {
+					request.VolumeContext["share"] = "//server/export/"
+					request.VolumeContext["subDir"] = "./team-a//data/"
+				})
+
+				It("should clean it", func() {
+					Expect(err).NotTo(HaveOccurred())
+					_, _, args := fakeExec.CommandContextArgsForCall(0)
+					Expect(args[4]).To(Equal("//server/export/team-a/data"))
+				})
+			})
+
+			Context("when the subDir climbs out of the share", func() {
+				BeforeEach(func() {
+					request.VolumeContext["subDir"] = "team-a/../../other"
+				})
+
+				It("should return an error", func() {
+					Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: invalid subDir 'team-a/../../other', it must not contain '..'"))
+					Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+				})
+			})
+
+			Context("when the subDir is absolute", func() {
+				BeforeEach(func() {
+					request.VolumeContext["subDir"] = "/etc"
+				})
+
+				It("should return an error", func() {
+					Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: invalid subDir '/etc', it must be relative to the share"))
+					Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+				})
+			})
+
+			Context("when the subDir contains backslashes", func() {
+				BeforeEach(func() {
+					request.VolumeContext["subDir"] = `team-a\..\..\other`
+				})
+
+				It("should return an error", func() {
+					Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+					Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+				})
+			})
+
+			Context("when the subDir should be created", func() {
+				BeforeEach(func() {
+					request.VolumeContext["createSubDir"] = "true"
+					request.Readonly = true
+				})
+
+				It("should create it in a read-write mount of the share before mounting it", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeExec.CommandContextCallCount()).To(Equal(3))
+
+					_, command, args := fakeExec.CommandContextArgsForCall(0)
+					Expect(command).To(Equal("mount"))
+					Expect(args).To(Equal([]string{"-t", "cifs", "-o", "credentials=/run/smb-csi-driver/credentials123", "//server/export", request.TargetPath}))
+
+					Expect(fakeOs.MkdirAllCallCount()).To(Equal(1))
+					path, _ := fakeOs.MkdirAllArgsForCall(0)
+					Expect(path).To(Equal("/tmp/target_path/team-a/data"))
+
+					_, command, args = fakeExec.CommandContextArgsForCall(1)
+					Expect(command).To(Equal("umount"))
+					Expect(args).To(ContainElement(request.TargetPath))
+
+					_, command, args = fakeExec.CommandContextArgsForCall(2)
+					Expect(command).To(Equal("mount"))
+					Expect(args).To(Equal([]string{"-t", "cifs", "-o", "ro,credentials=/run/smb-csi-driver/credentials123", "//server/export/team-a/data", request.TargetPath}))
+				})
+
+				Context("when the subDir cannot be created", func() {
+					BeforeEach(func() {
+						fakeOs.MkdirAllReturns(errors.New("mkdir-failed"))
+					})
+
+					It("should unmount the share and return an error", func() {
+						Expect(err).To(MatchError("rpc error: code = Internal desc = mkdir-failed"))
+						Expect(fakeExec.CommandContextCallCount()).To(Equal(2))
+						_, command, _ := fakeExec.CommandContextArgsForCall(1)
+						Expect(command).To(Equal("umount"))
+					})
+				})
+			})
+
+			Context("when createSubDir is not a boolean", func() {
+				BeforeEach(func() {
+					request.VolumeContext["createSubDir"] = "please"
+				})
+
+				It("should return an error", func() {
+					Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: invalid createSubDir volume attribute 'please', expected true or false"))
+				})
+			})
+		})
+
 		Context("when making the target directory already exists", func() {
 			BeforeEach(func() {
 				request.TargetPath = "/tmp"
@@ -146,6 +607,7 @@ var _ = Describe("NodeServer", func() {
 			Context("when a second identical request is made", func() {
 				BeforeEach(func() {
 					fakeCSIDriverStore.GetReturns(true, false, nil)
+					fakeIoutil.ReadFileReturns([]byte("130 25 0:52 / /tmp/target_path rw,relatime shared:70 - cifs //server/export rw,vers=3.0\n"), nil)
 				})
 
 				It("return the response of the previous request", func() {
@@ -157,7 +619,7 @@ var _ = Describe("NodeServer", func() {
 			Context(" when given a smb version", func() {
 				BeforeEach(func() {
 					request = &csi.NodePublishVolumeRequest{
-						VolumeCapability: &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{
+						VolumeCapability: &csi.VolumeCapability{AccessMode: multiNodeMultiWriter, AccessType: &csi.VolumeCapability_Mount{
 							Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"vers=1.0"}},
 						}},
 						TargetPath:       "/tmp/target_path",
@@ -173,14 +635,14 @@ var _ = Describe("NodeServer", func() {
 
 				It("should perform a mount", func() {
 					Expect(err).NotTo(HaveOccurred())
-					_, args := fakeExec.CommandArgsForCall(0)
+					_, _, args := fakeExec.CommandContextArgsForCall(0)
 					Expect(args[3]).To(ContainSubstring("vers=1.0"))
 				})
 
 				Context("when the smb version contains a comma (which introduces injection vulnerabilities)", func() {
 					BeforeEach(func() {
 						request = &csi.NodePublishVolumeRequest{
-							VolumeCapability: &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{
+							VolumeCapability: &csi.VolumeCapability{AccessMode: multiNodeMultiWriter, AccessType: &csi.VolumeCapability_Mount{
 								Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"vers=1.0,"}},
 							}},
 							TargetPath:       "/tmp/target_path",
@@ -203,7 +665,7 @@ var _ = Describe("NodeServer", func() {
 			Context(" when given a uid", func() {
 				BeforeEach(func() {
 					request = &csi.NodePublishVolumeRequest{
-						VolumeCapability: &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{
+						VolumeCapability: &csi.VolumeCapability{AccessMode: multiNodeMultiWriter, AccessType: &csi.VolumeCapability_Mount{
 							Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"uid=1000"}},
 						}},
 						TargetPath:       "/tmp/target_path",
@@ -219,7 +681,7 @@ var _ = Describe("NodeServer", func() {
 
 				It("should perform a mount", func() {
 					Expect(err).NotTo(HaveOccurred())
-					_, args := fakeExec.CommandArgsForCall(0)
+					_, _, args := fakeExec.CommandContextArgsForCall(0)
 					Expect(args[3]).To(ContainSubstring("uid=1000"))
 				})
 			})
@@ -227,7 +689,7 @@ var _ = Describe("NodeServer", func() {
 			Context(" when given a gid", func() {
 				BeforeEach(func() {
 					request = &csi.NodePublishVolumeRequest{
-						VolumeCapability: &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{
+						VolumeCapability: &csi.VolumeCapability{AccessMode: multiNodeMultiWriter, AccessType: &csi.VolumeCapability_Mount{
 							Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"gid=1000"}},
 						}},
 						TargetPath:       "/tmp/target_path",
@@ -243,7 +705,7 @@ var _ = Describe("NodeServer", func() {
 
 				It("should perform a mount", func() {
 					Expect(err).NotTo(HaveOccurred())
-					_, args := fakeExec.CommandArgsForCall(0)
+					_, _, args := fakeExec.CommandContextArgsForCall(0)
 					Expect(args[3]).To(ContainSubstring("gid=1000"))
 				})
 			})
@@ -251,7 +713,7 @@ var _ = Describe("NodeServer", func() {
 			Context(" when given a random option", func() {
 				BeforeEach(func() {
 					request = &csi.NodePublishVolumeRequest{
-						VolumeCapability: &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{
+						VolumeCapability: &csi.VolumeCapability{AccessMode: multiNodeMultiWriter, AccessType: &csi.VolumeCapability_Mount{
 							Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"foo=bar"}},
 						}},
 						TargetPath:       "/tmp/target_path",
@@ -267,197 +729,1368 @@ var _ = Describe("NodeServer", func() {
 
 				It("should return an error.", func() {
 					Expect(err).To(HaveOccurred())
+					Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+					Expect(fakeExec.CommandContextCallCount()).To(BeZero())
 				})
 			})
 
-			It("should perform a mount", func() {
-				Expect(err).NotTo(HaveOccurred())
-				Expect(fakeExec.CommandCallCount()).To(Equal(1))
-				command, args := fakeExec.CommandArgsForCall(0)
-				Expect(command).To(Equal("mount"))
-				Expect(args).To(ContainElements("-t", "cifs", "-o", "username=user1,password=pass1", "//server/export", request.TargetPath))
-			})
-		})
-
-		Context("when the command fails to start", func() {
+			Context("when the publish is read-only", func() {
+				BeforeEach(func() {
+					request.Readonly = true
+				})
 
-			BeforeEach(func() {
-				fakeCmd.CombinedOutputReturns([]byte("some-stdout"), errors.New("cmd-failed"))
-			})
+				It("should mount the share read-only", func() {
+					Expect(err).NotTo(HaveOccurred())
+					_, _, args := fakeExec.CommandContextArgsForCall(0)
+					Expect(args[3]).To(Equal("ro,credentials=/run/smb-csi-driver/credentials123"))
+				})
 
-			It("should return an error", func() {
-				Expect(err).To(HaveOccurred())
-				Expect(err.Error()).To(Equal("rpc error: code = Internal desc = cmd-failed"))
+				It("should not match a read-write publish to the same target path", func() {
+					store := NewStore()
+					Expect(store.Create(request.TargetPath, request)).To(Succeed())
+					request.Readonly = false
+					_, optionsMatch, err := store.Get(request.TargetPath, request)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(optionsMatch).To(BeFalse())
+				})
 			})
 
-			It("should write the error, stdout and stderr to the logs", func() {
-				Eventually(logger.Buffer()).Should(Say("some-stdout"))
-				Eventually(logger.Buffer()).Should(Say("cmd-failed"))
-			})
+			Context("when the access mode only allows readers", func() {
+				BeforeEach(func() {
+					request.VolumeCapability = &csi.VolumeCapability{
+						AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+					}
+				})
 
-			It("should not store the error", func() {
-				Expect(fakeCSIDriverStore.CreateCallCount()).To(BeZero())
+				It("should mount the share read-only", func() {
+					Expect(err).NotTo(HaveOccurred())
+					_, _, args := fakeExec.CommandContextArgsForCall(0)
+					Expect(args[3]).To(Equal("ro,credentials=/run/smb-csi-driver/credentials123"))
+				})
 			})
 
-			Context("when NodePublishVolume is called a second time", func() {
+			Context("when the readOnly volume attribute is set", func() {
 				BeforeEach(func() {
-					nodeServer = NewNodeServer(logger, fakeExec, fakeOs, NewStore())
-				})
-				JustBeforeEach(func() {
-					fakeCmd.CombinedOutputReturnsOnCall(1, []byte("some-stdout"), nil)
-					nodePublishVolumeResponse, err = nodeServer.NodePublishVolume(ctx, request)
+					request.VolumeContext["readOnly"] = "true"
 				})
 
-				It("should try the operation a second time", func() {
+				It("should mount the share read-only", func() {
 					Expect(err).NotTo(HaveOccurred())
-					Expect(fakeExec.CommandCallCount()).To(Equal(2))
-					command, args := fakeExec.CommandArgsForCall(1)
-					Expect(command).To(Equal("mount"))
-					Expect(args).To(ContainElements("-t", "cifs", "-o", "username=user1,password=pass1", "//server/export", request.TargetPath))
+					_, _, args := fakeExec.CommandContextArgsForCall(0)
+					Expect(args[3]).To(Equal("ro,credentials=/run/smb-csi-driver/credentials123"))
 				})
+
+				Context("when it is false", func() {
+					BeforeEach(func() {
+						request.VolumeContext["readOnly"] = "false"
+					})
+
+					It("should mount the share read-write", func() {
+						Expect(err).NotTo(HaveOccurred())
+						_, _, args := fakeExec.CommandContextArgsForCall(0)
+						Expect(args[3]).To(Equal("credentials=/run/smb-csi-driver/credentials123"))
+					})
+				})
+
+				Context("when it is not a boolean", func() {
+					BeforeEach(func() {
+						request.VolumeContext["readOnly"] = "maybe"
+					})
+
+					It("should return an error", func() {
+						Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: invalid readOnly volume attribute 'maybe', expected true or false"))
+						Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+					})
+				})
+			})
+
+			Context(" when given flag and mode options", func() {
+				BeforeEach(func() {
+					request.VolumeCapability = &csi.VolumeCapability{AccessMode: multiNodeMultiWriter, AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"file_mode=0644", "nobrl", "cache=none"}},
+					}}
+				})
+
+				It("should pass them to the mount", func() {
+					Expect(err).NotTo(HaveOccurred())
+					_, _, args := fakeExec.CommandContextArgsForCall(0)
+					Expect(args[3]).To(HavePrefix("file_mode=0644,nobrl,cache=none,"))
+				})
+			})
+
+			Context(" when the operator restricts the mount options", func() {
+				BeforeEach(func() {
+					request.VolumeCapability = &csi.VolumeCapability{AccessMode: multiNodeMultiWriter, AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"nobrl"}},
+					}}
+					schema, err := ParseMountOptionSchema(DefaultMountOptionSchema(), "-nobrl")
+					Expect(err).NotTo(HaveOccurred())
+					nodeServer = NewNodeServer(logger, fakeExec, fakeOs, fakeIoutil, fakeSyscall, fakeCSIDriverStore, Config{MountOptions: schema})
+				})
+
+				It("should reject the removed option", func() {
+					Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+					Expect(err.Error()).To(ContainSubstring("mountOption 'nobrl' is not allowed"))
+				})
+			})
+
+			It("should perform a mount", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeExec.CommandContextCallCount()).To(Equal(1))
+				_, command, args := fakeExec.CommandContextArgsForCall(0)
+				Expect(command).To(Equal("mount"))
+				Expect(args).To(ContainElements("-t", "cifs", "-o", "credentials=/run/smb-csi-driver/credentials123", "//server/export", request.TargetPath))
+			})
+		})
+
+		Context("given SMB credentials", func() {
+			It("should write them to a credentials file in the credentials dir", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeIoutil.TempFileCallCount()).To(Equal(1))
+				dir, _ := fakeIoutil.TempFileArgsForCall(0)
+				Expect(dir).To(Equal(DefaultCredentialsDir))
+				Expect(fakeCredentials.WriteStringCallCount()).To(Equal(1))
+				Expect(fakeCredentials.WriteStringArgsForCall(0)).To(Equal("username=user1\npassword=pass1\n"))
+				Expect(fakeCredentials.CloseCallCount()).To(Equal(1))
+			})
+
+			It("should keep the password off the mount command line", func() {
+				_, _, args := fakeExec.CommandContextArgsForCall(0)
+				for _, arg := range args {
+					Expect(arg).NotTo(ContainSubstring("pass1"))
+				}
+			})
+
+			It("should remove the credentials file once the mount has completed", func() {
+				Expect(fakeOs.RemoveCallCount()).To(Equal(1))
+				Expect(fakeOs.RemoveArgsForCall(0)).To(Equal("/run/smb-csi-driver/credentials123"))
+			})
+
+			Context("when the mount fails", func() {
+				BeforeEach(func() {
+					fakeCmd.CombinedOutputReturns(nil, errors.New("cmd-failed"))
+				})
+
+				It("should still remove the credentials file", func() {
+					Expect(err).To(HaveOccurred())
+					Expect(fakeOs.RemoveCallCount()).To(Equal(1))
+					Expect(fakeOs.RemoveArgsForCall(0)).To(Equal("/run/smb-csi-driver/credentials123"))
+				})
+			})
+
+			Context("when the password contains commas and other special characters", func() {
+				BeforeEach(func() {
+					request.Secrets["password"] = `p,a=s s\"w'o$rd`
+				})
+
+				It("should pass the password through unchanged", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeCredentials.WriteStringArgsForCall(0)).To(Equal("username=user1\npassword=p,a=s s\\\"w'o$rd\n"))
+				})
+			})
+
+			Context("when a domain is provided", func() {
+				BeforeEach(func() {
+					request.Secrets["domain"] = "CORP"
+				})
+
+				It("should add the domain to the credentials", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeCredentials.WriteStringArgsForCall(0)).To(Equal("username=user1\npassword=pass1\ndomain=CORP\n"))
+				})
+
+				Context("when the username names a different domain", func() {
+					BeforeEach(func() {
+						request.Secrets["username"] = `OTHER\user1`
+					})
+
+					It("should return an error", func() {
+						Expect(err).To(MatchError(`rpc error: code = InvalidArgument desc = Error: the domain secret 'CORP' does not match the domain of the username secret 'OTHER\user1'`))
+						Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+					})
+				})
+
+				Context("when the username names the same domain", func() {
+					BeforeEach(func() {
+						request.Secrets["username"] = `corp\user1`
+					})
+
+					It("should use the domain from the username", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fakeCredentials.WriteStringArgsForCall(0)).To(Equal("username=user1\npassword=pass1\ndomain=corp\n"))
+					})
+				})
+			})
+
+			Context("when a workgroup is provided", func() {
+				BeforeEach(func() {
+					request.Secrets["workgroup"] = "WORKGROUP"
+				})
+
+				It("should pass it as the domain", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeCredentials.WriteStringArgsForCall(0)).To(Equal("username=user1\npassword=pass1\ndomain=WORKGROUP\n"))
+				})
+
+				Context("when it conflicts with the domain", func() {
+					BeforeEach(func() {
+						request.Secrets["domain"] = "CORP"
+					})
+
+					It("should return an error", func() {
+						Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: the domain secret 'CORP' does not match the workgroup secret 'WORKGROUP'"))
+					})
+				})
+			})
+
+			Context("when the username has the form DOMAIN\\user", func() {
+				BeforeEach(func() {
+					request.Secrets["username"] = `CORP\user1`
+				})
+
+				It("should split the domain from the username", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeCredentials.WriteStringArgsForCall(0)).To(Equal("username=user1\npassword=pass1\ndomain=CORP\n"))
+				})
+			})
+
+			Context("when the username has the form user@domain", func() {
+				BeforeEach(func() {
+					request.Secrets["username"] = "user1@corp.example.com"
+				})
+
+				It("should split the domain from the username", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeCredentials.WriteStringArgsForCall(0)).To(Equal("username=user1\npassword=pass1\ndomain=corp.example.com\n"))
+				})
+			})
+
+			Context("when the username consists of a domain only", func() {
+				BeforeEach(func() {
+					request.Secrets["username"] = `CORP\`
+				})
+
+				It("should return an error", func() {
+					Expect(err).To(MatchError(`rpc error: code = InvalidArgument desc = Error: the username secret 'CORP\' does not name a user`))
+				})
+			})
+
+			Context("when the password contains a line break", func() {
+				BeforeEach(func() {
+					request.Secrets["password"] = "pass\nusername=other"
+				})
+
+				It("should return an error", func() {
+					Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: the password secret must not contain line breaks or NUL characters"))
+					Expect(fakeIoutil.TempFileCallCount()).To(BeZero())
+				})
+			})
+
+			Context("when the credentials file cannot be created", func() {
+				BeforeEach(func() {
+					fakeIoutil.TempFileReturns(nil, errors.New("tempfile-failed"))
+				})
+
+				It("should return an error without mounting", func() {
+					Expect(err).To(MatchError("rpc error: code = Internal desc = tempfile-failed"))
+					Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+				})
+			})
+
+			Context("when the credentials cannot be written", func() {
+				BeforeEach(func() {
+					fakeCredentials.WriteStringReturns(0, errors.New("write-failed"))
+				})
+
+				It("should remove the partial file and return an error", func() {
+					Expect(err).To(MatchError("rpc error: code = Internal desc = write-failed"))
+					Expect(fakeOs.RemoveCallCount()).To(Equal(1))
+					Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+				})
+			})
+		})
+
+		Context("when kerberos authentication is requested", func() {
+			var fakeCCache *os_fake.FakeFile
+
+			BeforeEach(func() {
+				fakeCCache = &os_fake.FakeFile{}
+				fakeOs.OpenFileReturns(fakeCCache, nil)
+				fakeOs.GetuidReturns(0)
+				fakeOs.EnvironReturns([]string{"PATH=/usr/sbin"})
+				request.VolumeContext["authentication"] = "kerberos"
+				request.Secrets = map[string]string{"krb5ccache": "ticket-cache-bytes"}
+			})
+
+			It("should write the ticket cache to a private credential cache", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeOs.OpenFileCallCount()).To(Equal(1))
+				path, _, perm := fakeOs.OpenFileArgsForCall(0)
+				Expect(path).To(HavePrefix(DefaultKerberosCacheDir + "/krb5cc_"))
+				Expect(perm).To(Equal(os.FileMode(0600)))
+				Expect(fakeCCache.WriteStringArgsForCall(0)).To(Equal("ticket-cache-bytes"))
+				Expect(fakeCCache.CloseCallCount()).To(Equal(1))
+			})
+
+			It("should mount with sec=krb5 using the credential cache", func() {
+				path, _, _ := fakeOs.OpenFileArgsForCall(0)
+
+				Expect(fakeExec.CommandContextCallCount()).To(Equal(1))
+				_, command, args := fakeExec.CommandContextArgsForCall(0)
+				Expect(command).To(Equal("mount"))
+				Expect(args).To(Equal([]string{"-t", "cifs", "-o", "sec=krb5,cruid=0", "//server/export", request.TargetPath}))
+				Expect(fakeCmd.SetEnvCallCount()).To(Equal(1))
+				Expect(fakeCmd.SetEnvArgsForCall(0)).To(Equal([]string{"PATH=/usr/sbin", "KRB5CCNAME=FILE:" + path}))
+				Expect(fakeIoutil.TempFileCallCount()).To(BeZero())
+			})
+
+			Context("given a keytab", func() {
+				BeforeEach(func() {
+					request.Secrets = map[string]string{"krb5keytab": "keytab-bytes", "username": "user1@CORP.EXAMPLE.COM"}
+				})
+
+				It("should obtain a ticket with kinit and discard the keytab", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeCredentials.WriteStringArgsForCall(0)).To(Equal("keytab-bytes"))
+
+					Expect(fakeExec.CommandContextCallCount()).To(Equal(2))
+					_, command, args := fakeExec.CommandContextArgsForCall(0)
+					Expect(command).To(Equal("kinit"))
+					Expect(args[:4]).To(Equal([]string{"-k", "-t", "/run/smb-csi-driver/credentials123", "-c"}))
+					Expect(args[4]).To(HavePrefix("FILE:" + DefaultKerberosCacheDir + "/krb5cc_"))
+					Expect(args[5]).To(Equal("user1@CORP.EXAMPLE.COM"))
+
+					_, command, _ = fakeExec.CommandContextArgsForCall(1)
+					Expect(command).To(Equal("mount"))
+
+					Expect(fakeOs.RemoveCallCount()).To(Equal(1))
+					Expect(fakeOs.RemoveArgsForCall(0)).To(Equal("/run/smb-csi-driver/credentials123"))
+				})
+
+				Context("when kinit fails", func() {
+					BeforeEach(func() {
+						fakeCmd.CombinedOutputReturnsOnCall(0, []byte("kinit: Preauthentication failed"), errors.New("exit status 1"))
+					})
+
+					It("should return an error without mounting", func() {
+						Expect(err).To(MatchError("rpc error: code = Internal desc = exit status 1"))
+						Expect(fakeExec.CommandContextCallCount()).To(Equal(1))
+						Eventually(logger.Buffer()).Should(Say("Preauthentication failed"))
+					})
+
+					It("should remove the keytab and the credential cache", func() {
+						Expect(fakeOs.RemoveCallCount()).To(Equal(2))
+						Expect(fakeOs.RemoveArgsForCall(0)).To(HavePrefix(DefaultKerberosCacheDir + "/krb5cc_"))
+						Expect(fakeOs.RemoveArgsForCall(1)).To(Equal("/run/smb-csi-driver/credentials123"))
+					})
+				})
+			})
+
+			Context("when no kerberos credentials are provided", func() {
+				BeforeEach(func() {
+					request.Secrets = map[string]string{}
+				})
+
+				It("should return an error", func() {
+					Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: kerberos authentication requires a [krb5ccache] secret, or a [krb5keytab] and a [username] secret"))
+					Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+				})
+			})
+
+			Context("when the mount fails", func() {
+				BeforeEach(func() {
+					fakeCmd.CombinedOutputReturns(nil, errors.New("mount-failed"))
+				})
+
+				It("should remove the credential cache", func() {
+					Expect(err).To(HaveOccurred())
+					path, _, _ := fakeOs.OpenFileArgsForCall(0)
+					Expect(fakeOs.RemoveCallCount()).To(Equal(1))
+					Expect(fakeOs.RemoveArgsForCall(0)).To(Equal(path))
+				})
+			})
+		})
+
+		Context("when the command fails to start", func() {
+
+			BeforeEach(func() {
+				fakeCmd.CombinedOutputReturns([]byte("some-stdout"), errors.New("cmd-failed"))
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(Equal("rpc error: code = Internal desc = cmd-failed"))
+			})
+
+			It("should write the error, stdout and stderr to the logs", func() {
+				Eventually(logger.Buffer()).Should(Say("some-stdout"))
+				Eventually(logger.Buffer()).Should(Say("cmd-failed"))
+			})
+
+			It("should not store the error", func() {
+				Expect(fakeCSIDriverStore.CreateCallCount()).To(BeZero())
+			})
+
+			Context("when NodePublishVolume is called a second time", func() {
+				BeforeEach(func() {
+					nodeServer = NewNodeServer(logger, fakeExec, fakeOs, fakeIoutil, fakeSyscall, NewStore(), Config{})
+				})
+				JustBeforeEach(func() {
+					fakeCmd.CombinedOutputReturnsOnCall(1, []byte("some-stdout"), nil)
+					nodePublishVolumeResponse, err = nodeServer.NodePublishVolume(ctx, request)
+				})
+
+				It("should try the operation a second time", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeExec.CommandContextCallCount()).To(Equal(2))
+					_, command, args := fakeExec.CommandContextArgsForCall(1)
+					Expect(command).To(Equal("mount"))
+					Expect(args).To(ContainElements("-t", "cifs", "-o", "credentials=/run/smb-csi-driver/credentials123", "//server/export", request.TargetPath))
+				})
+			})
+		})
+
+		Context("when the volume has been staged", func() {
+			BeforeEach(func() {
+				request.StagingTargetPath = "/tmp/staging_path"
+				fakeIoutil.ReadFileReturns([]byte("120 25 0:52 / /tmp/staging_path rw,relatime shared:70 - cifs //server/export rw,vers=3.0\n"), nil)
+			})
+
+			It("should bind mount the staging path into the target path", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeExec.CommandContextCallCount()).To(Equal(1))
+				_, command, args := fakeExec.CommandContextArgsForCall(0)
+				Expect(command).To(Equal("mount"))
+				Expect(args).To(Equal([]string{"--bind", "/tmp/staging_path", request.TargetPath}))
+			})
+
+			It("should record the staging path with the operation", func() {
+				Expect(fakeCSIDriverStore.CreateCallCount()).To(Equal(1))
+				_, k := fakeCSIDriverStore.CreateArgsForCall(0)
+				Expect(k.StagingTargetPath).To(Equal("/tmp/staging_path"))
+			})
+
+			Context("when the bind mount fails", func() {
+				BeforeEach(func() {
+					fakeCmd.CombinedOutputReturns([]byte("some-stdout"), errors.New("bind-failed"))
+				})
+
+				It("should return an error", func() {
+					Expect(err).To(MatchError("rpc error: code = Internal desc = bind-failed"))
+					Expect(fakeCSIDriverStore.CreateCallCount()).To(BeZero())
+				})
+			})
+
+			Context("when the publish is read-only", func() {
+				BeforeEach(func() {
+					request.Readonly = true
+				})
+
+				It("should remount the bind mount read-only", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeExec.CommandContextCallCount()).To(Equal(2))
+					_, command, args := fakeExec.CommandContextArgsForCall(0)
+					Expect(command).To(Equal("mount"))
+					Expect(args).To(Equal([]string{"--bind", "/tmp/staging_path", request.TargetPath}))
+					_, command, args = fakeExec.CommandContextArgsForCall(1)
+					Expect(command).To(Equal("mount"))
+					Expect(args).To(Equal([]string{"-o", "remount,bind,ro", request.TargetPath}))
+				})
+
+				Context("when the remount fails", func() {
+					BeforeEach(func() {
+						fakeCmd.CombinedOutputReturnsOnCall(1, []byte("some-stdout"), errors.New("remount-failed"))
+					})
+
+					It("should unmount the writable bind mount and return an error", func() {
+						Expect(err).To(MatchError("rpc error: code = Internal desc = remount-failed"))
+						Expect(fakeExec.CommandContextCallCount()).To(Equal(3))
+						_, command, args := fakeExec.CommandContextArgsForCall(2)
+						Expect(command).To(Equal("umount"))
+						Expect(args).To(ContainElement(request.TargetPath))
+						Expect(fakeCSIDriverStore.CreateCallCount()).To(BeZero())
+					})
+				})
+			})
+		})
+
+		Context("when the staging path is not mounted", func() {
+			BeforeEach(func() {
+				request.VolumeId = "volume-id"
+				request.StagingTargetPath = "/tmp/staging_path"
+			})
+
+			It("should mount the share with the publish credentials, as for a volume staged without credentials", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeExec.CommandContextCallCount()).To(Equal(1))
+				_, command, args := fakeExec.CommandContextArgsForCall(0)
+				Expect(command).To(Equal("mount"))
+				Expect(args).To(Equal([]string{"-t", "cifs", "-o", "credentials=/run/smb-csi-driver/credentials123", "//server/export", request.TargetPath}))
+				Expect(fakeCredentials.WriteStringArgsForCall(0)).To(Equal("username=user1\npassword=pass1\n"))
+			})
+
+			It("should record the staging path with the operation", func() {
+				Expect(fakeCSIDriverStore.CreateCallCount()).To(Equal(1))
+				_, k := fakeCSIDriverStore.CreateArgsForCall(0)
+				Expect(k.StagingTargetPath).To(Equal("/tmp/staging_path"))
+			})
+
+			Context("when the publish has no credentials either", func() {
+				BeforeEach(func() {
+					request.Secrets = nil
+				})
+
+				It("should refuse to bind mount the bare staging path", func() {
+					Expect(err).To(MatchError("rpc error: code = FailedPrecondition desc = Error: volume volume-id is not staged at /tmp/staging_path"))
+					Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+					Expect(fakeCSIDriverStore.CreateCallCount()).To(BeZero())
+				})
+			})
+		})
+
+		Context("when getting an entry in the store fails", func() {
+
+			BeforeEach(func() {
+				fakeCSIDriverStore.GetReturns(true, true, errors.New("hash failure"))
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(HaveOccurred())
+				Expect(err).To(MatchError("hash failure"))
+			})
+		})
+
+		Context("when creating an entry in the store fails", func() {
+
+			BeforeEach(func() {
+				fakeCSIDriverStore.CreateReturns(errors.New("hash failure"))
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(HaveOccurred())
+				Expect(err).To(MatchError("hash failure"))
+			})
+		})
+
+		Context("when a second NodePublish occurs", func() {
+			BeforeEach(func() {
+				fakeCSIDriverStore.GetReturns(true, true, nil)
+				fakeIoutil.ReadFileReturns([]byte("130 25 0:52 / /tmp/target_path rw,relatime shared:70 - cifs //server/export rw,vers=3.0\n"), nil)
+			})
+
+			Context("when it uses the same mount options", func() {
+
+				It("return successfully without mounting again", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeExec.CommandContextCallCount()).To(Equal(0))
+					Expect(fakeCSIDriverStore.CreateCallCount()).To(Equal(0))
+				})
+			})
+
+			Context("when it uses different mount options", func() {
+				BeforeEach(func() {
+					fakeCSIDriverStore.GetReturns(true, false, nil)
+				})
+
+				It("return ALREADY_EXISTS", func() {
+					Expect(err).To(MatchError("rpc error: code = AlreadyExists desc = options mismatch"))
+				})
+			})
+
+			Context("when the target path is no longer mounted, e.g. after a reboot", func() {
+				BeforeEach(func() {
+					fakeIoutil.ReadFileReturns([]byte{}, nil)
+				})
+
+				It("should drop the stale entry and mount the share again", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeCSIDriverStore.DeleteCallCount()).To(Equal(1))
+					Expect(fakeCSIDriverStore.DeleteArgsForCall(0)).To(Equal(request.TargetPath))
+					Expect(fakeExec.CommandContextCallCount()).To(Equal(1))
+					_, command, _ := fakeExec.CommandContextArgsForCall(0)
+					Expect(command).To(Equal("mount"))
+					Expect(fakeCSIDriverStore.CreateCallCount()).To(Equal(1))
+				})
+			})
+		})
+	})
+
+	Describe("#NodeUnpublishVolume", func() {
+		var (
+			request *csi.NodeUnpublishVolumeRequest
+			err     error
+		)
+
+		JustBeforeEach(func() {
+			_, err = nodeServer.NodeUnpublishVolume(ctx, request)
+		})
+
+		BeforeEach(func() {
+			request = &csi.NodeUnpublishVolumeRequest{
+				TargetPath: "/tmp/target_path",
+			}
+			fakeIoutil.ReadFileReturns([]byte("130 25 0:52 / /tmp/target_path rw,relatime shared:70 - cifs //server/export rw,vers=3.0\n"), nil)
+		})
+
+		It("should unpublish the target path", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeIoutil.ReadFileArgsForCall(0)).To(Equal("/proc/self/mountinfo"))
+			Expect(fakeExec.CommandContextCallCount()).To(Equal(1))
+			_, command, args := fakeExec.CommandContextArgsForCall(0)
+			Expect(command).To(Equal("umount"))
+			Expect(args).To(Equal([]string{request.TargetPath}))
+			Expect(fakeCmd.StartCallCount()).To(Equal(1))
+			Expect(fakeCmd.WaitCallCount()).To(Equal(1))
+		})
+
+		It("should remove the publish volume record from the map", func() {
+			Expect(fakeCSIDriverStore.DeleteCallCount()).To(Equal(1))
+			k := fakeCSIDriverStore.DeleteArgsForCall(0)
+
+			Expect(k).To(Equal("/tmp/target_path"))
+		})
+
+		It("should remove the target path and any kerberos credential cache", func() {
+			Expect(fakeOs.RemoveCallCount()).To(Equal(2))
+			Expect(fakeOs.RemoveArgsForCall(0)).To(Equal("/tmp/target_path"))
+			Expect(fakeOs.RemoveArgsForCall(1)).To(HavePrefix(DefaultKerberosCacheDir + "/krb5cc_"))
+		})
+
+		Context("when target path is not provided", func() {
+			BeforeEach(func() {
+				request = &csi.NodeUnpublishVolumeRequest{
+					TargetPath: "",
+				}
+			})
+
+			It("should return a meaningful error", func() {
+				Expect(err).To(HaveOccurred())
+				Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: a required property [TargetPath] was not provided"))
+				Expect(fakeCSIDriverStore.DeleteCallCount()).To(BeZero())
+			})
+		})
+
+		Context("when the target path is not mounted", func() {
+			BeforeEach(func() {
+				fakeIoutil.ReadFileReturns([]byte("120 25 0:52 / /tmp/staging_path rw,relatime shared:70 - cifs //server/export rw,vers=3.0\n"), nil)
+			})
+
+			It("should not unmount it", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+			})
+
+			It("should remove the target path and the publish volume record", func() {
+				Expect(fakeOs.RemoveArgsForCall(0)).To(Equal("/tmp/target_path"))
+				Expect(fakeCSIDriverStore.DeleteCallCount()).To(Equal(1))
+			})
+
+			Context("when the target path no longer exists", func() {
+				BeforeEach(func() {
+					fakeOs.RemoveReturns(os.ErrNotExist)
+				})
+
+				It("should succeed", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeCSIDriverStore.DeleteCallCount()).To(Equal(1))
+				})
+			})
+		})
+
+		Context("when the mount table cannot be read", func() {
+			BeforeEach(func() {
+				fakeIoutil.ReadFileReturns(nil, errors.New("read-failed"))
+			})
+
+			It("should return an error and keep the publish volume record", func() {
+				Expect(err).To(MatchError("rpc error: code = Internal desc = read-failed"))
+				Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+				Expect(fakeCSIDriverStore.DeleteCallCount()).To(BeZero())
+			})
+		})
+
+		Context("when the command fails to start", func() {
+
+			BeforeEach(func() {
+				fakeCmd.StartReturns(errors.New("start-failed"))
+			})
+
+			It("should escalate through every unmount step and return an error naming each failure", func() {
+				Expect(err).To(MatchError("rpc error: code = Internal desc = Error: could not unmount /tmp/target_path: umount: start-failed; umount -f: start-failed; umount -l: start-failed"))
+				Expect(fakeExec.CommandContextCallCount()).To(Equal(3))
+				_, _, args := fakeExec.CommandContextArgsForCall(1)
+				Expect(args).To(Equal([]string{"-f", request.TargetPath}))
+				_, _, args = fakeExec.CommandContextArgsForCall(2)
+				Expect(args).To(Equal([]string{"-l", request.TargetPath}))
+				Expect(logger.Buffer()).To(Say("escalating-umount"))
+			})
+
+			It("should keep the target path and the publish volume record", func() {
+				Expect(fakeOs.RemoveCallCount()).To(BeZero())
+				Expect(fakeCSIDriverStore.DeleteCallCount()).To(BeZero())
+			})
+		})
+
+		Context("when the command fails to wait", func() {
+
+			BeforeEach(func() {
+				fakeCmd.WaitReturns(errors.New("wait-failed"))
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(MatchError("rpc error: code = Internal desc = Error: could not unmount /tmp/target_path: umount: wait-failed; umount -f: wait-failed; umount -l: wait-failed"))
+			})
+
+			It("should keep the target path and the publish volume record", func() {
+				Expect(fakeOs.RemoveCallCount()).To(BeZero())
+				Expect(fakeCSIDriverStore.DeleteCallCount()).To(BeZero())
+			})
+		})
+
+		Context("when the normal unmount fails because the mount is busy", func() {
+			BeforeEach(func() {
+				fakeCmd.SetStderrStub = func(stderr *bytes.Buffer) {
+					if fakeExec.CommandContextCallCount() == 1 {
+						stderr.WriteString("umount: /tmp/target_path: target is busy.\n")
+					}
+				}
+				fakeCmd.WaitReturnsOnCall(0, errors.New("exit status 32"))
+			})
+
+			It("should escalate to a forced unmount of the per-publish mount", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeExec.CommandContextCallCount()).To(Equal(2))
+				_, command, args := fakeExec.CommandContextArgsForCall(1)
+				Expect(command).To(Equal("umount"))
+				Expect(args).To(Equal([]string{"-f", request.TargetPath}))
+				Expect(logger.Buffer()).To(Say("umount-failed.*target is busy"))
+				Expect(fakeCSIDriverStore.DeleteCallCount()).To(Equal(1))
+			})
+
+			Context("when the forced unmount fails too", func() {
+				BeforeEach(func() {
+					fakeCmd.WaitReturnsOnCall(1, errors.New("exit status 32"))
+				})
+
+				It("should fall back to a lazy unmount", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeExec.CommandContextCallCount()).To(Equal(3))
+					_, _, args := fakeExec.CommandContextArgsForCall(2)
+					Expect(args).To(Equal([]string{"-l", request.TargetPath}))
+				})
+			})
+
+			Context("when the target path is bind mounted from a staging mount", func() {
+				BeforeEach(func() {
+					fakeIoutil.ReadFileReturns([]byte("120 25 0:52 / /tmp/staging_path rw,relatime shared:70 - cifs //server/export rw,vers=3.0\n"+
+						"130 25 0:52 / /tmp/target_path rw,relatime shared:70 - cifs //server/export rw,vers=3.0\n"), nil)
+				})
+
+				It("should skip the forced unmount, which would abort the requests on the staging mount, and unmount lazily", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeExec.CommandContextCallCount()).To(Equal(2))
+					_, command, args := fakeExec.CommandContextArgsForCall(1)
+					Expect(command).To(Equal("umount"))
+					Expect(args).To(Equal([]string{"-l", request.TargetPath}))
+					Expect(logger.Buffer()).To(Say("skipping-forced-umount-of-shared-superblock"))
+					Expect(fakeCSIDriverStore.DeleteCallCount()).To(Equal(1))
+				})
+			})
+
+			Context("when the unmount policy does not allow escalation", func() {
+				BeforeEach(func() {
+					nodeServer = NewNodeServer(logger, fakeExec, fakeOs, fakeIoutil, fakeSyscall, fakeCSIDriverStore, Config{UnmountPolicy: []UnmountStep{UnmountNormal}})
+				})
+
+				It("should return the error of the normal unmount", func() {
+					Expect(err).To(MatchError("rpc error: code = Internal desc = Error: could not unmount /tmp/target_path: umount: exit status 32 (umount: /tmp/target_path: target is busy.)"))
+					Expect(fakeExec.CommandContextCallCount()).To(Equal(1))
+					Expect(fakeCSIDriverStore.DeleteCallCount()).To(BeZero())
+				})
+			})
+
+			Context("when the normal unmount succeeded after all", func() {
+				BeforeEach(func() {
+					fakeIoutil.ReadFileReturnsOnCall(1, []byte(""), nil)
+				})
+
+				It("should not escalate", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeExec.CommandContextCallCount()).To(Equal(1))
+				})
+			})
+		})
+
+		Context("when a normal unmount hangs", func() {
+			BeforeEach(func() {
+				nodeServer = NewNodeServer(logger, fakeExec, fakeOs, fakeIoutil, fakeSyscall, fakeCSIDriverStore, Config{UnmountTimeout: 10 * time.Millisecond})
+				fakeCmd.WaitStub = func() error {
+					if fakeCmd.WaitCallCount() == 1 {
+						commandCtx, _, _ := fakeExec.CommandContextArgsForCall(0)
+						<-commandCtx.Done()
+						return errors.New("signal: killed")
+					}
+					return nil
+				}
+			})
+
+			It("should escalate to a forced unmount once the unmount timeout passes", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeExec.CommandContextCallCount()).To(Equal(2))
+				Expect(logger.Buffer()).To(Say("did not complete within 10ms"))
+			})
+		})
+
+		Context("when removing the unmounted target path fails", func() {
+			BeforeEach(func() {
+				fakeOs.RemoveReturns(errors.New("remove-failed"))
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(Equal("rpc error: code = Internal desc = remove-failed"))
+			})
+
+			It("should keep the publish volume record", func() {
+				Expect(fakeCSIDriverStore.DeleteCallCount()).To(BeZero())
+			})
+		})
+	})
+
+	Describe("mount and umount deadlines", func() {
+		var (
+			publishRequest *csi.NodePublishVolumeRequest
+			cancel         context.CancelFunc
+		)
+
+		BeforeEach(func() {
+			publishRequest = &csi.NodePublishVolumeRequest{
+				VolumeCapability: &csi.VolumeCapability{AccessMode: multiNodeMultiWriter},
+				TargetPath:       "/tmp/target_path",
+				VolumeContext: map[string]string{
+					"share": "//server/export",
+				},
+			}
+
+			waitForKill := func() error {
+				commandCtx, _, _ := fakeExec.CommandContextArgsForCall(fakeExec.CommandContextCallCount() - 1)
+				<-commandCtx.Done()
+				return errors.New("signal: killed")
+			}
+			fakeCmd.CombinedOutputStub = func() ([]byte, error) {
+				return nil, waitForKill()
+			}
+			fakeCmd.WaitStub = waitForKill
+			fakeIoutil.ReadFileReturns([]byte("130 25 0:52 / /tmp/target_path rw,relatime shared:70 - cifs //server/export rw,vers=3.0\n"), nil)
+			cancel = func() {}
+		})
+
+		AfterEach(func() {
+			cancel()
+		})
+
+		It("should bound commands with the default timeout when the request has no deadline", func() {
+			fakeCmd.CombinedOutputStub = nil
+			_, err := nodeServer.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{VolumeId: "volume-id", StagingTargetPath: "/tmp/staging_path", VolumeCapability: &csi.VolumeCapability{AccessMode: multiNodeMultiWriter}, Secrets: map[string]string{"username": "user1"}})
+			Expect(err).NotTo(HaveOccurred())
+
+			commandCtx, _, _ := fakeExec.CommandContextArgsForCall(0)
+			deadline, ok := commandCtx.Deadline()
+			Expect(ok).To(BeTrue())
+			Expect(deadline).To(BeTemporally("~", time.Now().Add(DefaultMountTimeout), time.Second))
+		})
+
+		Context("when the configured timeout passes", func() {
+			BeforeEach(func() {
+				nodeServer = NewNodeServer(logger, fakeExec, fakeOs, fakeIoutil, fakeSyscall, fakeCSIDriverStore, Config{MountTimeout: 10 * time.Millisecond})
+			})
+
+			It("should kill the mount and return DeadlineExceeded", func() {
+				_, err := nodeServer.NodePublishVolume(ctx, publishRequest)
+				Expect(err).To(MatchError("rpc error: code = DeadlineExceeded desc = Error: mount did not complete before the deadline: signal: killed"))
+				Expect(fakeCSIDriverStore.CreateCallCount()).To(BeZero())
 			})
 		})
 
-		Context("when getting an entry in the store fails", func() {
+		Context("when the request deadline passes", func() {
+			BeforeEach(func() {
+				ctx, cancel = context.WithTimeout(ctx, 10*time.Millisecond)
+			})
+
+			It("should kill the mount and return DeadlineExceeded", func() {
+				_, err := nodeServer.NodePublishVolume(ctx, publishRequest)
+				Expect(status.Code(err)).To(Equal(codes.DeadlineExceeded))
+			})
 
+			It("should kill the umount and return DeadlineExceeded", func() {
+				_, err := nodeServer.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "volume-id", TargetPath: "/tmp/target_path"})
+				Expect(err).To(MatchError("rpc error: code = DeadlineExceeded desc = Error: umount did not complete before the deadline: umount: signal: killed"))
+				Expect(fakeExec.CommandContextCallCount()).To(Equal(1))
+			})
+		})
+
+		Context("when the request is cancelled", func() {
 			BeforeEach(func() {
-				fakeCSIDriverStore.GetReturns(true, true, errors.New("hash failure"))
+				ctx, cancel = context.WithCancel(ctx)
+				time.AfterFunc(10*time.Millisecond, cancel)
 			})
 
-			It("should return an error", func() {
-				Expect(err).To(HaveOccurred())
-				Expect(err).To(MatchError("hash failure"))
+			It("should kill the mount and return Canceled", func() {
+				_, err := nodeServer.NodePublishVolume(ctx, publishRequest)
+				Expect(status.Code(err)).To(Equal(codes.Canceled))
 			})
 		})
+	})
 
-		Context("when creating an entry in the store fails", func() {
+	Describe("#NodeStageVolume", func() {
+		var (
+			request *csi.NodeStageVolumeRequest
+			err     error
+		)
 
+		BeforeEach(func() {
+			request = &csi.NodeStageVolumeRequest{
+				VolumeId:          "volume-id",
+				StagingTargetPath: "/tmp/staging_path",
+				VolumeCapability:  &csi.VolumeCapability{AccessMode: multiNodeMultiWriter},
+				VolumeContext: map[string]string{
+					"share": "//server/export",
+				},
+				Secrets: map[string]string{
+					"username": "user1",
+					"password": "pass1",
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			_, err = nodeServer.NodeStageVolume(ctx, request)
+		})
+
+		It("should mount the share at the staging path", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeOs.MkdirAllCallCount()).To(Equal(1))
+			path, _ := fakeOs.MkdirAllArgsForCall(0)
+			Expect(path).To(Equal("/tmp/staging_path"))
+
+			Expect(fakeExec.CommandContextCallCount()).To(Equal(1))
+			_, command, args := fakeExec.CommandContextArgsForCall(0)
+			Expect(command).To(Equal("mount"))
+			Expect(args).To(Equal([]string{"-t", "cifs", "-o", "credentials=/run/smb-csi-driver/credentials123", "//server/export", "/tmp/staging_path"}))
+		})
+
+		Context("when the volume has no node-stage credentials, e.g. a persistent volume with only a nodePublishSecretRef", func() {
 			BeforeEach(func() {
-				fakeCSIDriverStore.CreateReturns(errors.New("hash failure"))
+				request.Secrets = nil
+			})
+
+			It("should succeed without mounting the share", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeOs.MkdirAllCallCount()).To(BeZero())
+				Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+				Expect(fakeIoutil.TempFileCallCount()).To(BeZero())
+			})
+		})
+
+		Context("when the access mode only allows readers", func() {
+			BeforeEach(func() {
+				request.VolumeCapability = &csi.VolumeCapability{
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY},
+				}
+			})
+
+			It("should stage the share read-only", func() {
+				Expect(err).NotTo(HaveOccurred())
+				_, _, args := fakeExec.CommandContextArgsForCall(0)
+				Expect(args).To(Equal([]string{"-t", "cifs", "-o", "ro,credentials=/run/smb-csi-driver/credentials123", "//server/export", "/tmp/staging_path"}))
+			})
+		})
+
+		Context("when the volume is already being staged", func() {
+			var unblock chan struct{}
+
+			BeforeEach(func() {
+				unblock = make(chan struct{})
+				mountCalled := make(chan struct{}, 1)
+				fakeCmd.CombinedOutputStub = func() ([]byte, error) {
+					mountCalled <- struct{}{}
+					<-unblock
+					return nil, nil
+				}
+				go nodeServer.NodeStageVolume(ctx, request)
+				Eventually(mountCalled).Should(Receive())
+			})
+
+			AfterEach(func() {
+				close(unblock)
+			})
+
+			It("should abort the second request", func() {
+				Expect(err).To(MatchError("rpc error: code = Aborted desc = Error: an operation on [volume-id] is already in progress"))
+			})
+		})
+
+		Context("when the staging path is already mounted", func() {
+			BeforeEach(func() {
+				fakeIoutil.ReadFileReturns([]byte("120 25 0:52 / /tmp/staging_path rw,relatime shared:70 - cifs //server/export rw,vers=3.0\n"), nil)
+			})
+
+			It("should not mount the share a second time", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+			})
+		})
+
+		Context("when the mount table cannot be read", func() {
+			BeforeEach(func() {
+				fakeIoutil.ReadFileReturns(nil, errors.New("read-failed"))
 			})
 
 			It("should return an error", func() {
-				Expect(err).To(HaveOccurred())
-				Expect(err).To(MatchError("hash failure"))
+				Expect(err).To(MatchError("rpc error: code = Internal desc = read-failed"))
+				Expect(fakeExec.CommandContextCallCount()).To(BeZero())
 			})
 		})
 
-		Context("when a second NodePublish occurs", func() {
-			Context("when it uses the same mount options", func() {
+		Context("when the mount fails", func() {
+			BeforeEach(func() {
+				fakeCmd.CombinedOutputReturns([]byte("some-stdout"), errors.New("cmd-failed"))
+			})
 
-				It("return successfully", func() {
-					Expect(err).NotTo(HaveOccurred())
-				})
+			It("should return an error", func() {
+				Expect(err).To(MatchError("rpc error: code = Internal desc = cmd-failed"))
+				Eventually(logger.Buffer()).Should(Say("some-stdout"))
 			})
+		})
 
-			Context("when it uses different mount options", func() {
-				BeforeEach(func() {
-					fakeCSIDriverStore.GetReturns(true, false, nil)
-				})
+		Context("when the staging path is not provided", func() {
+			BeforeEach(func() {
+				request.StagingTargetPath = ""
+			})
 
-				It("return ALREADY_EXISTS", func() {
-					Expect(err).To(MatchError("rpc error: code = AlreadyExists desc = options mismatch"))
-				})
+			It("should return a meaningful error", func() {
+				Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: a required property [StagingTargetPath] was not provided"))
+			})
+		})
+
+		Context("when the volume id is not provided", func() {
+			BeforeEach(func() {
+				request.VolumeId = ""
+			})
+
+			It("should return a meaningful error", func() {
+				Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: a required property [VolumeId] was not provided"))
+			})
+		})
+
+		Context("when VolumeCapability is not supplied", func() {
+			BeforeEach(func() {
+				request.VolumeCapability = nil
+			})
+
+			It("should return a meaningful error", func() {
+				Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: a required property [VolumeCapability] was not provided"))
+			})
+		})
+
+		Context("when a block volume is requested", func() {
+			BeforeEach(func() {
+				request.VolumeCapability = &csi.VolumeCapability{
+					AccessMode: multiNodeMultiWriter,
+					AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				}
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: block volumes are not supported"))
+				Expect(fakeExec.CommandContextCallCount()).To(BeZero())
 			})
 		})
 	})
 
-	Describe("#NodeUnpublishVolume", func() {
+	Describe("#NodeUnstageVolume", func() {
 		var (
-			request *csi.NodeUnpublishVolumeRequest
+			request *csi.NodeUnstageVolumeRequest
 			err     error
 		)
 
-		JustBeforeEach(func() {
-			_, err = nodeServer.NodeUnpublishVolume(ctx, request)
-		})
-
 		BeforeEach(func() {
-			request = &csi.NodeUnpublishVolumeRequest{
-				TargetPath: "/tmp/target_path",
+			request = &csi.NodeUnstageVolumeRequest{
+				VolumeId:          "volume-id",
+				StagingTargetPath: "/tmp/staging_path",
 			}
+			fakeIoutil.ReadFileReturns([]byte("120 25 0:52 / /tmp/staging_path rw,relatime shared:70 - cifs //server/export rw,vers=3.0\n"), nil)
 		})
 
-		It("should unpublish the target path", func() {
+		JustBeforeEach(func() {
+			_, err = nodeServer.NodeUnstageVolume(ctx, request)
+		})
+
+		It("should unmount the staging path", func() {
 			Expect(err).NotTo(HaveOccurred())
-			Expect(fakeExec.CommandCallCount()).To(Equal(1))
-			command, args := fakeExec.CommandArgsForCall(0)
+			Expect(fakeCSIDriverStore.PublishedTargetPathsCallCount()).To(Equal(1))
+			Expect(fakeCSIDriverStore.PublishedTargetPathsArgsForCall(0)).To(Equal("/tmp/staging_path"))
+
+			Expect(fakeExec.CommandContextCallCount()).To(Equal(1))
+			_, command, args := fakeExec.CommandContextArgsForCall(0)
 			Expect(command).To(Equal("umount"))
-			Expect(args).To(ContainElements(request.TargetPath))
-			Expect(args).To(ContainElements("-l"))
-			Expect(fakeCmd.StartCallCount()).To(Equal(1))
-			Expect(fakeCmd.WaitCallCount()).To(Equal(1))
+			Expect(args).To(ContainElement("/tmp/staging_path"))
 		})
 
-		It("should remove the publish volume record from the map", func() {
-			Expect(fakeCSIDriverStore.DeleteCallCount()).To(Equal(1))
-			k := fakeCSIDriverStore.DeleteArgsForCall(0)
+		Context("when the volume is still published", func() {
+			BeforeEach(func() {
+				fakeCSIDriverStore.PublishedTargetPathsReturns([]string{"/tmp/target_path"})
+			})
 
-			Expect(k).To(Equal("/tmp/target_path"))
+			It("should not tear down the mount", func() {
+				Expect(err).To(MatchError("rpc error: code = FailedPrecondition desc = Error: volume is still published at /tmp/target_path"))
+				Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+			})
 		})
 
-		Context("when target path is not provided", func() {
+		Context("when the staging path is not mounted", func() {
 			BeforeEach(func() {
-				request = &csi.NodeUnpublishVolumeRequest{
-					TargetPath: "",
-				}
+				fakeIoutil.ReadFileReturns([]byte{}, nil)
+			})
+
+			It("should succeed without unmounting", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeExec.CommandContextCallCount()).To(BeZero())
+			})
+		})
+
+		Context("when the unmount fails", func() {
+			BeforeEach(func() {
+				fakeCmd.WaitReturns(errors.New("wait-failed"))
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(MatchError("rpc error: code = Internal desc = Error: could not unmount /tmp/staging_path: umount: wait-failed; umount -f: wait-failed; umount -l: wait-failed"))
+			})
+		})
+
+		Context("when the staging path is not provided", func() {
+			BeforeEach(func() {
+				request.StagingTargetPath = ""
 			})
 
 			It("should return a meaningful error", func() {
-				Expect(err).To(HaveOccurred())
-				Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: a required property [TargetPath] was not provided"))
+				Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: a required property [StagingTargetPath] was not provided"))
 			})
 		})
+	})
 
-		Context("when the command fails to start", func() {
+	Describe("#NodeGetVolumeStats", func() {
+		var (
+			request *csi.NodeGetVolumeStatsRequest
+			resp    *csi.NodeGetVolumeStatsResponse
+			err     error
+		)
+
+		BeforeEach(func() {
+			request = &csi.NodeGetVolumeStatsRequest{
+				VolumeId:   "volume-id",
+				VolumePath: "/tmp/target_path",
+			}
+			fakeIoutil.ReadFileReturns([]byte("121 25 0:52 / /tmp/target_path rw,relatime shared:70 - cifs //server/export rw,vers=3.0\n"), nil)
+			fakeSyscall.StatfsStub = func(path string, buf *syscall.Statfs_t) error {
+				buf.Bsize = 1024
+				buf.Blocks = 100
+				buf.Bfree = 40
+				buf.Bavail = 30
+				buf.Files = 50
+				buf.Ffree = 20
+				return nil
+			}
+		})
+
+		JustBeforeEach(func() {
+			resp, err = nodeServer.NodeGetVolumeStats(ctx, request)
+		})
+
+		It("should report byte and inode usage of the volume path", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeSyscall.StatfsCallCount()).To(Equal(1))
+			path, _ := fakeSyscall.StatfsArgsForCall(0)
+			Expect(path).To(Equal("/tmp/target_path"))
+
+			Expect(resp.GetUsage()).To(ConsistOf(
+				&csi.VolumeUsage{Unit: csi.VolumeUsage_BYTES, Total: 102400, Available: 30720, Used: 61440},
+				&csi.VolumeUsage{Unit: csi.VolumeUsage_INODES, Total: 50, Available: 20, Used: 30},
+			))
+		})
 
+		Context("when the volume path is not mounted", func() {
 			BeforeEach(func() {
-				fakeCmd.StartReturns(errors.New("start-failed"))
+				fakeIoutil.ReadFileReturns([]byte{}, nil)
 			})
 
-			It("should return an error", func() {
-				Expect(err).To(HaveOccurred())
-				Expect(err.Error()).To(Equal("rpc error: code = Internal desc = start-failed"))
+			It("should return NotFound", func() {
+				Expect(err).To(MatchError("rpc error: code = NotFound desc = Error: volume volume-id is not mounted at /tmp/target_path"))
+				Expect(fakeSyscall.StatfsCallCount()).To(BeZero())
 			})
 		})
 
-		Context("when the command fails to wait", func() {
+		It("should report the volume as healthy", func() {
+			Expect(resp.GetVolumeCondition()).To(Equal(&csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}))
+		})
 
+		Context("when statfs fails", func() {
 			BeforeEach(func() {
-				fakeCmd.WaitReturns(errors.New("wait-failed"))
+				fakeSyscall.StatfsStub = nil
+				fakeSyscall.StatfsReturns(errors.New("statfs-failed"))
 			})
 
 			It("should return an error", func() {
-				Expect(err).To(HaveOccurred())
-				Expect(err.Error()).To(Equal("rpc error: code = Internal desc = wait-failed"))
+				Expect(err).To(MatchError("rpc error: code = Internal desc = statfs-failed"))
 			})
 		})
 
-		Context("when removing the unmounted target path fails", func() {
+		Context("when the mount is stale", func() {
 			BeforeEach(func() {
-				fakeOs.RemoveReturns(errors.New("remove-failed"))
+				fakeSyscall.StatfsStub = nil
+				fakeSyscall.StatfsReturns(syscall.ESTALE)
 			})
 
-			It("should return an error", func() {
-				Expect(err).To(HaveOccurred())
-				Expect(err.Error()).To(Equal("rpc error: code = Internal desc = remove-failed"))
+			It("should report an abnormal volume condition", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.GetUsage()).To(BeEmpty())
+				Expect(resp.GetVolumeCondition().GetAbnormal()).To(BeTrue())
+				Expect(resp.GetVolumeCondition().GetMessage()).To(Equal("probe of /tmp/target_path failed: " + syscall.ESTALE.Error()))
 			})
+		})
 
-			It("should remove the publish volume record from the map", func() {
-				Expect(fakeCSIDriverStore.DeleteCallCount()).To(Equal(1))
-				k := fakeCSIDriverStore.DeleteArgsForCall(0)
+		Context("when the SMB server is down", func() {
+			BeforeEach(func() {
+				fakeSyscall.StatfsStub = nil
+				fakeSyscall.StatfsReturns(syscall.EHOSTDOWN)
+			})
+
+			It("should report an abnormal volume condition", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.GetVolumeCondition().GetAbnormal()).To(BeTrue())
+				Expect(resp.GetVolumeCondition().GetMessage()).To(ContainSubstring(syscall.EHOSTDOWN.Error()))
+			})
+		})
+
+		Context("when the credentials are no longer accepted", func() {
+			BeforeEach(func() {
+				fakeSyscall.StatfsStub = nil
+				fakeSyscall.StatfsReturns(syscall.EACCES)
+			})
+
+			It("should report an abnormal volume condition", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.GetVolumeCondition().GetAbnormal()).To(BeTrue())
+				Expect(resp.GetVolumeCondition().GetMessage()).To(ContainSubstring(syscall.EACCES.Error()))
+			})
+		})
+
+		Context("when the probe hangs", func() {
+			var (
+				unblock chan struct{}
+				cancel  context.CancelFunc
+			)
+
+			BeforeEach(func() {
+				unblock = make(chan struct{})
+				blocked := unblock
+				var calls int32
+				fakeSyscall.StatfsStub = func(string, *syscall.Statfs_t) error {
+					if atomic.AddInt32(&calls, 1) == 1 {
+						<-blocked
+					}
+					return nil
+				}
+				ctx, cancel = context.WithTimeout(ctx, 10*time.Millisecond)
+			})
+
+			AfterEach(func() {
+				close(unblock)
+				cancel()
+			})
 
-				Expect(k).To(Equal("/tmp/target_path"))
+			It("should report an abnormal volume condition once the deadline passes", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.GetVolumeCondition()).To(Equal(&csi.VolumeCondition{Abnormal: true, Message: "probe of /tmp/target_path timed out, the mount may be hung"}))
+			})
+
+			Context("when the volume is probed again while the probe is still blocked", func() {
+				It("should report the volume as hung without starting another probe", func() {
+					resp, err = nodeServer.NodeGetVolumeStats(context.Background(), request)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(resp.GetVolumeCondition().GetAbnormal()).To(BeTrue())
+					Expect(fakeSyscall.StatfsCallCount()).To(Equal(1))
+				})
+			})
+
+			Context("when the blocked probe returns", func() {
+				It("should probe the volume again", func() {
+					unblock <- struct{}{}
+					Eventually(func() int {
+						resp, err = nodeServer.NodeGetVolumeStats(context.Background(), request)
+						return fakeSyscall.StatfsCallCount()
+					}).Should(Equal(2))
+				})
+			})
+		})
+
+		Context("when the request is cancelled while probing", func() {
+			var unblock chan struct{}
+
+			BeforeEach(func() {
+				unblock = make(chan struct{})
+				blocked := unblock
+				fakeSyscall.StatfsStub = func(string, *syscall.Statfs_t) error {
+					<-blocked
+					return nil
+				}
+				cancelled, cancel := context.WithCancel(ctx)
+				cancel()
+				ctx = cancelled
+			})
+
+			AfterEach(func() {
+				close(unblock)
+			})
+
+			It("should return Canceled rather than report the volume as hung", func() {
+				Expect(status.Code(err)).To(Equal(codes.Canceled))
+				Expect(resp).To(BeNil())
+			})
+		})
+
+		Context("when the volume path is not provided", func() {
+			BeforeEach(func() {
+				request.VolumePath = ""
+			})
+
+			It("should return a meaningful error", func() {
+				Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: a required property [VolumePath] was not provided"))
+			})
+		})
+
+		Context("when the volume id is not provided", func() {
+			BeforeEach(func() {
+				request.VolumeId = ""
+			})
+
+			It("should return a meaningful error", func() {
+				Expect(err).To(MatchError("rpc error: code = InvalidArgument desc = Error: a required property [VolumeId] was not provided"))
 			})
 		})
 	})
 
 	Describe("#NodeGetCapabilities", func() {
-		It("should return no capabilities, and no errors", func() {
+		It("should advertise the node capabilities", func() {
 			resp, err := nodeServer.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
 
 			Expect(err).NotTo(HaveOccurred())
-			Expect(resp).To(Equal(&csi.NodeGetCapabilitiesResponse{}))
+			Expect(resp.GetCapabilities()).To(ConsistOf(
+				&csi.NodeServiceCapability{Type: &csi.NodeServiceCapability_Rpc{Rpc: &csi.NodeServiceCapability_RPC{Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME}}},
+				&csi.NodeServiceCapability{Type: &csi.NodeServiceCapability_Rpc{Rpc: &csi.NodeServiceCapability_RPC{Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS}}},
+				&csi.NodeServiceCapability{Type: &csi.NodeServiceCapability_Rpc{Rpc: &csi.NodeServiceCapability_RPC{Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION}}},
+			))
 		})
 	})
 
@@ -0,0 +1,136 @@
+package nodeserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The volume context keys kubelet fills in when the CSIDriver object asks for pod info on mount.
+const (
+	podNamespaceContextKey   = "csi.storage.k8s.io/pod.namespace"
+	podNameContextKey        = "csi.storage.k8s.io/pod.name"
+	podUIDContextKey         = "csi.storage.k8s.io/pod.uid"
+	serviceAccountContextKey = "csi.storage.k8s.io/serviceAccount.name"
+)
+
+var podLogKeys = map[string]string{
+	"podNamespace":   podNamespaceContextKey,
+	"podName":        podNameContextKey,
+	"podUID":         podUIDContextKey,
+	"serviceAccount": serviceAccountContextKey,
+}
+
+// withPodInfo adds the pod a volume is mounted for to the log data of a mount.
+func withPodInfo(logData lager.Data, volumeContext map[string]string) lager.Data {
+	for logKey, contextKey := range podLogKeys {
+		if value := volumeContext[contextKey]; value != "" {
+			logData[logKey] = value
+		}
+	}
+	return logData
+}
+
+// NamespacePolicy restricts the shares that pods of a namespace may mount.
+type NamespacePolicy struct {
+	// AllowedServers lists the SMB servers whose shares pods of the namespace may mount. Empty allows any server.
+	AllowedServers []string `json:"allowedServers,omitempty"`
+	// UID and GID, when set, own the files of every share mounted for pods of the namespace.
+	UID *uint32 `json:"uid,omitempty"`
+	GID *uint32 `json:"gid,omitempty"`
+}
+
+// NamespacePolicies maps namespaces to their policy. The policy of "*" applies to every namespace without a policy of
+// its own.
+type NamespacePolicies map[string]NamespacePolicy
+
+// ParseNamespacePolicies parses a JSON object of namespace policies, e.g.
+// {"team-a": {"allowedServers": ["fs1.example.com"], "uid": 2000, "gid": 2000}}.
+func ParseNamespacePolicies(data []byte) (NamespacePolicies, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	policies := NamespacePolicies{}
+	err := decoder.Decode(&policies)
+	if err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+func (p NamespacePolicies) lookup(namespace string) (NamespacePolicy, bool) {
+	if policy, ok := p[namespace]; ok {
+		return policy, true
+	}
+	policy, ok := p["*"]
+	return policy, ok
+}
+
+// applyNamespacePolicy checks a publish against the policy of the namespace of its pod and returns the mount flags to
+// mount it with. A staged volume is already mounted, so its mount flags must satisfy the policy as they are.
+func (n smbNodeServer) applyNamespacePolicy(volumeContext map[string]string, mountFlags []string, staged bool) ([]string, error) {
+	namespace := volumeContext[podNamespaceContextKey]
+	policy, ok := n.config.NamespacePolicies.lookup(namespace)
+	if !ok {
+		return mountFlags, nil
+	}
+
+	if len(policy.AllowedServers) > 0 {
+		server := shareServer(volumeContext["share"])
+		allowed := false
+		for _, allowedServer := range policy.AllowedServers {
+			if strings.EqualFold(server, allowedServer) {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return nil, status.Error(codes.PermissionDenied, fmt.Sprintf("Error: pods in namespace '%s' may not mount shares of server '%s'", namespace, server))
+		}
+	}
+
+	required := map[string]string{}
+	if policy.UID != nil {
+		required["uid"] = fmt.Sprintf("uid=%d", *policy.UID)
+	}
+	if policy.GID != nil {
+		required["gid"] = fmt.Sprintf("gid=%d", *policy.GID)
+	}
+
+	flags := []string{}
+	present := map[string]bool{}
+	for _, flag := range mountFlags {
+		key := strings.SplitN(flag, "=", 2)[0]
+		requiredFlag, ok := required[key]
+		if !ok {
+			flags = append(flags, flag)
+			continue
+		}
+		if staged && flag != requiredFlag {
+			return nil, status.Error(codes.PermissionDenied, fmt.Sprintf("Error: pods in namespace '%s' must mount with %s", namespace, requiredFlag))
+		}
+		present[key] = true
+	}
+
+	for _, key := range []string{"uid", "gid"} {
+		requiredFlag, ok := required[key]
+		if !ok {
+			continue
+		}
+		if staged && !present[key] {
+			return nil, status.Error(codes.PermissionDenied, fmt.Sprintf("Error: pods in namespace '%s' must mount with %s", namespace, requiredFlag))
+		}
+		flags = append(flags, requiredFlag)
+	}
+	return flags, nil
+}
+
+// shareServer returns the server of a //server/share address.
+func shareServer(share string) string {
+	share = strings.TrimLeft(strings.ReplaceAll(share, `\`, "/"), "/")
+	return strings.SplitN(share, "/", 2)[0]
+}
@@ -0,0 +1,29 @@
+package nodeserver_test
+
+import (
+	. "code.cloudfoundry.org/smb-csi-driver/nodeserver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseNamespacePolicies", func() {
+	It("should parse the policy of every namespace", func() {
+		policies, err := ParseNamespacePolicies([]byte(`{"team-a": {"allowedServers": ["fs1.example.com"], "uid": 2000, "gid": 3000}, "*": {}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policies).To(HaveLen(2))
+		Expect(policies["team-a"].AllowedServers).To(Equal([]string{"fs1.example.com"}))
+		Expect(*policies["team-a"].UID).To(Equal(uint32(2000)))
+		Expect(*policies["team-a"].GID).To(Equal(uint32(3000)))
+		Expect(policies["*"].UID).To(BeNil())
+	})
+
+	It("should refuse unknown fields", func() {
+		_, err := ParseNamespacePolicies([]byte(`{"team-a": {"allowedServer": ["fs1.example.com"]}}`))
+		Expect(err).To(MatchError(ContainSubstring(`unknown field "allowedServer"`)))
+	})
+
+	It("should refuse negative ids", func() {
+		_, err := ParseNamespacePolicies([]byte(`{"team-a": {"uid": -1}}`))
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,303 @@
+package nodeserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// QuotaFileName is the file in the quota directory of a volume in which the controller records its soft quota.
+const QuotaFileName = "quota.json"
+
+const DefaultQuotaScanInterval = 5 * time.Minute
+const DefaultQuotaMountDir = "/var/lib/smb-csi-driver/quotas"
+
+// Quota is the content of the QuotaFileName of a volume.
+type Quota struct {
+	LimitBytes int64 `json:"limitBytes"`
+}
+
+type quotaUsage struct {
+	limitBytes int64
+	usedBytes  int64
+	scanned    bool
+}
+
+// quotaVolume is a staged volume the scanner knows of. Volumes without a quota have no recordDir and are not scanned.
+type quotaVolume struct {
+	recordDir string
+	usage     quotaUsage
+	scanning  bool
+}
+
+// QuotaScanner periodically measures the space used by the volumes with a soft quota. SMB clients cannot limit the
+// space a directory of a share uses, so volumes that exceed their quota are only reported, not stopped from writing.
+// Volumes are known by their staging path, so a volume published to several pods is measured once.
+type QuotaScanner struct {
+	logger     lager.Logger
+	osshim     osshim.Os
+	ioutilshim ioutilshim.Ioutil
+	interval   time.Duration
+
+	lock    sync.Mutex
+	volumes map[string]quotaVolume
+}
+
+func NewQuotaScanner(logger lager.Logger, osshim osshim.Os, ioutilshim ioutilshim.Ioutil, interval time.Duration) *QuotaScanner {
+	return &QuotaScanner{
+		logger:     logger.Session("quota-scanner"),
+		osshim:     osshim,
+		ioutilshim: ioutilshim,
+		interval:   interval,
+		volumes:    map[string]quotaVolume{},
+	}
+}
+
+// Run scans the watched volumes every interval until stop is closed.
+func (q *QuotaScanner) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// A scan stuck on a hung mount must not hold up the next one, which skips the volumes still being scanned.
+			go q.Scan()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Scan measures every watched volume with a quota once, each on its own, and returns when they are measured. Volumes
+// whose previous scan is still running, e.g. because their mount hangs, are skipped.
+func (q *QuotaScanner) Scan() {
+	var wg sync.WaitGroup
+
+	q.lock.Lock()
+	for stagingPath, volume := range q.volumes {
+		if volume.recordDir == "" {
+			continue
+		}
+		if volume.scanning {
+			q.logger.Info("skipped-volume-still-scanning", lager.Data{"stagingPath": stagingPath})
+			continue
+		}
+		volume.scanning = true
+		q.volumes[stagingPath] = volume
+
+		wg.Add(1)
+		go func(stagingPath, recordDir string) {
+			defer wg.Done()
+			q.scan(stagingPath, recordDir)
+		}(stagingPath, volume.recordDir)
+	}
+	q.lock.Unlock()
+
+	wg.Wait()
+}
+
+// scan measures the volume staged at stagingPath and records its usage, unless the volume was forgotten meanwhile.
+func (q *QuotaScanner) scan(stagingPath, recordDir string) {
+	usage, err := q.scanVolume(stagingPath, recordDir)
+	if err != nil {
+		q.logger.Error("scan-failed", err, lager.Data{"stagingPath": stagingPath})
+	} else if usage.usedBytes > usage.limitBytes && usage.limitBytes > 0 {
+		q.logger.Info("over-quota", lager.Data{"stagingPath": stagingPath, "usedBytes": usage.usedBytes, "limitBytes": usage.limitBytes})
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	volume, ok := q.volumes[stagingPath]
+	if !ok || volume.recordDir != recordDir {
+		return
+	}
+	volume.scanning = false
+	if err == nil {
+		volume.usage = usage
+	}
+	q.volumes[stagingPath] = volume
+}
+
+// scanVolume reads the quota in recordDir and measures the volume staged at stagingPath against it. A volume whose
+// quota was dropped is not measured.
+func (q *QuotaScanner) scanVolume(stagingPath, recordDir string) (quotaUsage, error) {
+	data, err := q.ioutilshim.ReadFile(filepath.Join(recordDir, QuotaFileName))
+	if os.IsNotExist(err) {
+		return quotaUsage{scanned: true}, nil
+	}
+	if err != nil {
+		return quotaUsage{}, err
+	}
+	var quota Quota
+	err = json.Unmarshal(data, &quota)
+	if err != nil {
+		return quotaUsage{}, err
+	}
+
+	usedBytes, err := q.usedBytes(stagingPath)
+	if err != nil {
+		return quotaUsage{}, err
+	}
+	return quotaUsage{limitBytes: quota.LimitBytes, usedBytes: usedBytes, scanned: true}, nil
+}
+
+// usedBytes adds up the sizes of the regular files under dir. Directories that are removed while they are scanned are
+// skipped.
+func (q *QuotaScanner) usedBytes(dir string) (int64, error) {
+	entries, err := q.ioutilshim.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var usedBytes int64
+	for _, entry := range entries {
+		switch {
+		case entry.IsDir():
+			n, err := q.usedBytes(filepath.Join(dir, entry.Name()))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			usedBytes += n
+		case entry.Mode().IsRegular():
+			usedBytes += entry.Size()
+		}
+	}
+	return usedBytes, nil
+}
+
+// watch starts scanning the volume staged at stagingPath against the quota recorded in recordDir. An empty recordDir
+// marks a volume without a quota, so that it is not looked for again.
+func (q *QuotaScanner) watch(stagingPath, recordDir string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.volumes[stagingPath] = quotaVolume{recordDir: recordDir}
+}
+
+// usage returns the usage of the volume staged at stagingPath as of the last scan, and whether the volume is watched.
+func (q *QuotaScanner) usage(stagingPath string) (quotaUsage, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	volume, ok := q.volumes[stagingPath]
+	return volume.usage, ok
+}
+
+// forget stops scanning the volume staged at stagingPath, e.g. when it is unstaged.
+func (q *QuotaScanner) forget(stagingPath string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	delete(q.volumes, stagingPath)
+}
+
+// quotaMountPath is the private directory in which the quota directory of the volume staged at stagingTargetPath is
+// mounted.
+func (n smbNodeServer) quotaMountPath(stagingTargetPath string) string {
+	return filepath.Join(n.config.QuotaMountDir, fmt.Sprintf("%x", sha256.Sum256([]byte(filepath.Clean(stagingTargetPath)))))
+}
+
+// mountQuota mounts the quota directory that the controller named in the quotaDir volume attribute read-only, apart
+// from the volume, so that pods cannot change it, and watches the volume. A volume whose quota cannot be mounted is
+// still staged, and its usage is reported against its share.
+func (n smbNodeServer) mountQuota(c context.Context, r *csi.NodeStageVolumeRequest) {
+	quotaDir := r.GetVolumeContext()["quotaDir"]
+	if n.config.Quotas == nil || quotaDir == "" {
+		return
+	}
+	mountPath := n.quotaMountPath(r.StagingTargetPath)
+	logData := lager.Data{"volumeId": r.VolumeId, "quotaDir": quotaDir, "mountPath": mountPath}
+
+	_, mounted, err := n.mountAt(mountPath)
+	if err == nil && !mounted {
+		err = n.osshim.MkdirAll(mountPath, os.ModePerm)
+		if err == nil {
+			volumeContext := map[string]string{"share": r.VolumeContext["share"], "subDir": quotaDir, "authentication": r.VolumeContext["authentication"]}
+			err = n.mountCifs(c, mountPath, r.GetVolumeCapability().GetMount().GetMountFlags(), volumeContext, r.Secrets, true)
+		}
+	}
+	if err != nil {
+		n.logger.Error("mount-quota-failed", err, logData)
+		return
+	}
+	n.config.Quotas.watch(r.StagingTargetPath, mountPath)
+}
+
+// unmountQuota stops watching the volume staged at stagingTargetPath and unmounts its quota directory, if it has one.
+func (n smbNodeServer) unmountQuota(c context.Context, stagingTargetPath string) error {
+	if n.config.Quotas == nil {
+		return nil
+	}
+	n.config.Quotas.forget(stagingTargetPath)
+
+	mountPath := n.quotaMountPath(stagingTargetPath)
+	_, mounted, err := n.mountAt(mountPath)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if !mounted {
+		return nil
+	}
+	err = n.unmount(c, mountPath)
+	if err != nil {
+		return err
+	}
+	n.removeKerberosCache(mountPath)
+
+	err = n.osshim.Remove(mountPath)
+	if err != nil && !os.IsNotExist(err) {
+		n.logger.Error("remove-quota-mount-path-failed", err, lager.Data{"mountPath": mountPath})
+	}
+	return nil
+}
+
+// quotaUsage returns the usage of the volume of a NodeGetVolumeStats request as of the last scan, if it has a quota. A
+// volume staged before the driver restarted is watched again as long as its quota directory is still mounted, which
+// requires the quota mount dir to be a host path with bidirectional mount propagation. A quota directory that was
+// created but is no longer mounted cannot be mounted again without the node-stage secret, so it is logged and the
+// volume is reported against its share until it is staged again.
+func (n smbNodeServer) quotaUsage(r *csi.NodeGetVolumeStatsRequest) (quotaUsage, bool) {
+	stagingTargetPath := r.StagingTargetPath
+	if stagingTargetPath == "" {
+		stagingTargetPath, _ = n.csiDriverStore.StagingTargetPath(r.VolumePath)
+	}
+	if stagingTargetPath == "" {
+		return quotaUsage{}, false
+	}
+
+	usage, watched := n.config.Quotas.usage(stagingTargetPath)
+	if !watched {
+		recordDir := n.quotaMountPath(stagingTargetPath)
+		_, mounted, err := n.mountAt(recordDir)
+		if err != nil {
+			n.logger.Error("find-quota-mount-failed", err, lager.Data{"stagingTargetPath": stagingTargetPath})
+			return quotaUsage{}, false
+		}
+		if !mounted {
+			if _, err := n.osshim.Stat(recordDir); err == nil {
+				n.logger.Error("quota-mount-lost", errors.New("the quota directory is no longer mounted, restage the volume to mount it again"), lager.Data{"stagingTargetPath": stagingTargetPath, "mountPath": recordDir})
+			}
+			recordDir = ""
+		}
+		n.config.Quotas.watch(stagingTargetPath, recordDir)
+	}
+	return usage, usage.scanned && usage.limitBytes > 0
+}
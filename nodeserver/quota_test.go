@@ -0,0 +1,404 @@
+package nodeserver_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/goshims/execshim"
+	"code.cloudfoundry.org/goshims/execshim/exec_fake"
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/goshims/syscallshim/syscall_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "code.cloudfoundry.org/smb-csi-driver/nodeserver"
+	smbcsidriverfakes "code.cloudfoundry.org/smb-csi-driver/smb-csi-driverfakes"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("QuotaScanner", func() {
+	var (
+		logger        *lagertest.TestLogger
+		ctx           context.Context
+		nodeServer    csi.NodeServer
+		scanner       *QuotaScanner
+		volumePath    string
+		stagingPath   string
+		quotaMountDir string
+		recordDir     string
+		mountInfo     string
+		quotaMounted  bool
+
+		fakeIoutil  *ioutil_fake.FakeIoutil
+		fakeSyscall *syscall_fake.FakeSyscall
+		fakeExec    *exec_fake.FakeExec
+		fakeStore   *smbcsidriverfakes.FakeCSIDriverStore
+
+		stageRequest *csi.NodeStageVolumeRequest
+		request      *csi.NodeGetVolumeStatsRequest
+	)
+
+	mountLine := func(mountPoint, root string) string {
+		return "121 25 0:52 " + root + " " + mountPoint + " rw,relatime shared:70 - cifs //server/export rw,vers=3.0\n"
+	}
+
+	writeQuota := func(quota string) {
+		Expect(ioutil.WriteFile(filepath.Join(recordDir, QuotaFileName), []byte(quota), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		volumePath, err = ioutil.TempDir("", "volume")
+		Expect(err).NotTo(HaveOccurred())
+		stagingPath, err = ioutil.TempDir("", "staging")
+		Expect(err).NotTo(HaveOccurred())
+		quotaMountDir, err = ioutil.TempDir("", "quotas")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.MkdirAll(filepath.Join(stagingPath, "nested"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(stagingPath, "data"), make([]byte, 600), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(stagingPath, "nested", "more-data"), make([]byte, 300), 0644)).To(Succeed())
+		Expect(os.Symlink("data", filepath.Join(stagingPath, "link"))).To(Succeed())
+
+		logger = lagertest.NewTestLogger("quota-test")
+		ctx = context.Background()
+		scanner = NewQuotaScanner(logger, &osshim.OsShim{}, &ioutilshim.IoutilShim{}, time.Minute)
+
+		mountInfo = ""
+		quotaMounted = true
+		fakeIoutil = &ioutil_fake.FakeIoutil{}
+		fakeIoutil.ReadFileStub = func(string) ([]byte, error) {
+			return []byte(mountInfo), nil
+		}
+		credentials := &os_fake.FakeFile{}
+		credentials.NameReturns("/run/smb-csi-driver/credentials123")
+		fakeIoutil.TempFileReturns(credentials, nil)
+		fakeSyscall = &syscall_fake.FakeSyscall{}
+		fakeSyscall.StatfsStub = func(path string, buf *syscall.Statfs_t) error {
+			buf.Bsize = 100
+			buf.Blocks = 100
+			buf.Bfree = 40
+			buf.Bavail = 30
+			buf.Files = 50
+			buf.Ffree = 20
+			return nil
+		}
+		fakeExec = &exec_fake.FakeExec{}
+		fakeExec.CommandContextReturns(&exec_fake.FakeCmd{})
+		fakeStore = &smbcsidriverfakes.FakeCSIDriverStore{}
+		nodeServer = NewNodeServer(logger, fakeExec, &os_fake.FakeOs{}, fakeIoutil, fakeSyscall, fakeStore, Config{Quotas: scanner, QuotaMountDir: quotaMountDir})
+
+		stageRequest = &csi.NodeStageVolumeRequest{
+			VolumeId:          "//server/export#pvc-1",
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  &csi.VolumeCapability{AccessMode: multiNodeMultiWriter},
+			VolumeContext:     map[string]string{"share": "//server/export", "subDir": "pvc-1", "quotaDir": ".quotas/pvc-1"},
+			Secrets:           map[string]string{"username": "user1", "password": "pass1"},
+		}
+		request = &csi.NodeGetVolumeStatsRequest{VolumeId: "//server/export#pvc-1", VolumePath: volumePath, StagingTargetPath: stagingPath}
+	})
+
+	JustBeforeEach(func() {
+		_, err := nodeServer.NodeStageVolume(ctx, stageRequest)
+		Expect(err).NotTo(HaveOccurred())
+
+		recordDir = ""
+		for i := 0; i < fakeExec.CommandContextCallCount(); i++ {
+			_, command, args := fakeExec.CommandContextArgsForCall(i)
+			if command == "mount" && args[len(args)-2] == "//server/export/.quotas/pvc-1" {
+				recordDir = args[len(args)-1]
+			}
+		}
+		mountInfo = mountLine(stagingPath, "/pvc-1") + mountLine(volumePath, "/pvc-1")
+		if quotaMounted {
+			Expect(os.MkdirAll(recordDir, 0755)).To(Succeed())
+			mountInfo += mountLine(recordDir, "/.quotas/pvc-1")
+			writeQuota(`{"limitBytes":1000}`)
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(volumePath)).To(Succeed())
+		Expect(os.RemoveAll(stagingPath)).To(Succeed())
+		Expect(os.RemoveAll(quotaMountDir)).To(Succeed())
+	})
+
+	getVolumeStats := func() *csi.NodeGetVolumeStatsResponse {
+		resp, err := nodeServer.NodeGetVolumeStats(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		return resp
+	}
+
+	It("should mount the quota directory of the volume read-only in a private directory", func() {
+		Expect(recordDir).NotTo(BeEmpty())
+		Expect(filepath.Dir(recordDir)).To(Equal(quotaMountDir))
+
+		Expect(fakeExec.CommandContextCallCount()).To(Equal(2))
+		_, _, args := fakeExec.CommandContextArgsForCall(1)
+		Expect(args).To(Equal([]string{"-t", "cifs", "-o", "ro,credentials=/run/smb-csi-driver/credentials123", "//server/export/.quotas/pvc-1", recordDir}))
+	})
+
+	It("should report the usage of the share until the volume was scanned", func() {
+		resp := getVolumeStats()
+		Expect(resp.GetUsage()[0]).To(Equal(&csi.VolumeUsage{Unit: csi.VolumeUsage_BYTES, Total: 10000, Available: 3000, Used: 6000}))
+	})
+
+	Context("when the volume was scanned", func() {
+		JustBeforeEach(func() {
+			scanner.Scan()
+		})
+
+		It("should report the usage of the volume against its quota", func() {
+			resp := getVolumeStats()
+			Expect(resp.GetUsage()).To(ConsistOf(
+				&csi.VolumeUsage{Unit: csi.VolumeUsage_BYTES, Total: 1000, Available: 100, Used: 900},
+				&csi.VolumeUsage{Unit: csi.VolumeUsage_INODES, Total: 50, Available: 20, Used: 30},
+			))
+			Expect(resp.GetVolumeCondition()).To(Equal(&csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}))
+		})
+
+		Context("when the volume is over its quota", func() {
+			JustBeforeEach(func() {
+				Expect(ioutil.WriteFile(filepath.Join(stagingPath, "nested", "even-more-data"), make([]byte, 200), 0644)).To(Succeed())
+				scanner.Scan()
+			})
+
+			It("should report an abnormal volume condition", func() {
+				resp := getVolumeStats()
+				Expect(resp.GetUsage()[0]).To(Equal(&csi.VolumeUsage{Unit: csi.VolumeUsage_BYTES, Total: 1000, Available: 0, Used: 1100}))
+				Expect(resp.GetVolumeCondition()).To(Equal(&csi.VolumeCondition{Abnormal: true, Message: "volume uses 1100 bytes, more than its soft quota of 1000 bytes"}))
+			})
+
+			It("should log it", func() {
+				Expect(logger).To(Say("over-quota"))
+			})
+		})
+
+		Context("when the share has less space left than the quota", func() {
+			JustBeforeEach(func() {
+				writeQuota(`{"limitBytes":10000}`)
+				scanner.Scan()
+			})
+
+			It("should report the space left on the share as available", func() {
+				resp := getVolumeStats()
+				Expect(resp.GetUsage()[0]).To(Equal(&csi.VolumeUsage{Unit: csi.VolumeUsage_BYTES, Total: 10000, Available: 3000, Used: 900}))
+			})
+		})
+
+		Context("when kubelet does not pass the staging path", func() {
+			BeforeEach(func() {
+				request.StagingTargetPath = ""
+				fakeStore.StagingTargetPathReturns(stagingPath, true)
+			})
+
+			It("should find it in the store", func() {
+				resp := getVolumeStats()
+				Expect(resp.GetUsage()[0].GetTotal()).To(Equal(int64(1000)))
+				Expect(fakeStore.StagingTargetPathArgsForCall(0)).To(Equal(volumePath))
+			})
+		})
+
+		Context("when the volume is unstaged", func() {
+			JustBeforeEach(func() {
+				_, err := nodeServer.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: stageRequest.VolumeId, StagingTargetPath: stagingPath})
+				Expect(err).NotTo(HaveOccurred())
+				mountInfo = mountLine(volumePath, "/pvc-1")
+			})
+
+			It("should unmount the quota directory", func() {
+				_, command, args := fakeExec.CommandContextArgsForCall(2)
+				Expect(command).To(Equal("umount"))
+				Expect(args).To(Equal([]string{recordDir}))
+			})
+
+			It("should no longer report the usage of the volume", func() {
+				resp := getVolumeStats()
+				Expect(resp.GetUsage()[0].GetTotal()).To(Equal(int64(10000)))
+			})
+		})
+
+		Context("when the node plugin restarts", func() {
+			var quotaMountSurvives bool
+
+			BeforeEach(func() {
+				quotaMountSurvives = true
+			})
+
+			JustBeforeEach(func() {
+				if !quotaMountSurvives {
+					mountInfo = mountLine(stagingPath, "/pvc-1") + mountLine(volumePath, "/pvc-1")
+				}
+				scanner = NewQuotaScanner(logger, &osshim.OsShim{}, &ioutilshim.IoutilShim{}, time.Minute)
+				nodeServer = NewNodeServer(logger, fakeExec, &os_fake.FakeOs{}, fakeIoutil, fakeSyscall, fakeStore, Config{Quotas: scanner, QuotaMountDir: quotaMountDir})
+				getVolumeStats()
+				scanner.Scan()
+			})
+
+			It("should watch the volume again while its quota directory is mounted", func() {
+				resp := getVolumeStats()
+				Expect(resp.GetUsage()[0].GetTotal()).To(Equal(int64(1000)))
+			})
+
+			Context("when the quota directory was not mounted in a host path that survives the restart", func() {
+				BeforeEach(func() {
+					quotaMountSurvives = false
+				})
+
+				It("should report the usage of the share and log that the quota mount was lost", func() {
+					resp := getVolumeStats()
+					Expect(resp.GetUsage()[0].GetTotal()).To(Equal(int64(10000)))
+					Expect(logger).To(Say("quota-mount-lost"))
+				})
+			})
+		})
+	})
+
+	Context("when the scan of a volume hangs", func() {
+		var (
+			unblock          chan struct{}
+			scanned          chan struct{}
+			scanIoutil       *ioutil_fake.FakeIoutil
+			otherStagingPath string
+			otherRequest     *csi.NodeGetVolumeStatsRequest
+		)
+
+		hungScans := func() int {
+			count := 0
+			for i := 0; i < scanIoutil.ReadDirCallCount(); i++ {
+				if scanIoutil.ReadDirArgsForCall(i) == stagingPath {
+					count++
+				}
+			}
+			return count
+		}
+
+		BeforeEach(func() {
+			unblock = make(chan struct{})
+			blocked, hungPath := unblock, stagingPath
+			realIoutil := &ioutilshim.IoutilShim{}
+			scanIoutil = &ioutil_fake.FakeIoutil{}
+			scanIoutil.ReadFileStub = realIoutil.ReadFile
+			scanIoutil.ReadDirStub = func(dir string) ([]os.FileInfo, error) {
+				if dir == hungPath {
+					<-blocked
+				}
+				return realIoutil.ReadDir(dir)
+			}
+			scanner = NewQuotaScanner(logger, &osshim.OsShim{}, scanIoutil, time.Minute)
+			nodeServer = NewNodeServer(logger, fakeExec, &os_fake.FakeOs{}, fakeIoutil, fakeSyscall, fakeStore, Config{Quotas: scanner, QuotaMountDir: quotaMountDir})
+
+			var err error
+			otherStagingPath, err = ioutil.TempDir("", "staging")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(otherStagingPath, "data"), make([]byte, 600), 0644)).To(Succeed())
+			otherRequest = &csi.NodeGetVolumeStatsRequest{VolumeId: "//server/export#pvc-2", VolumePath: otherStagingPath, StagingTargetPath: otherStagingPath}
+		})
+
+		JustBeforeEach(func() {
+			_, err := nodeServer.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+				VolumeId:          otherRequest.VolumeId,
+				StagingTargetPath: otherStagingPath,
+				VolumeCapability:  stageRequest.VolumeCapability,
+				VolumeContext:     map[string]string{"share": "//server/export", "subDir": "pvc-2", "quotaDir": ".quotas/pvc-2"},
+				Secrets:           stageRequest.Secrets,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, _, args := fakeExec.CommandContextArgsForCall(fakeExec.CommandContextCallCount() - 1)
+			otherRecordDir := args[len(args)-1]
+			Expect(os.MkdirAll(otherRecordDir, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(otherRecordDir, QuotaFileName), []byte(`{"limitBytes":500}`), 0644)).To(Succeed())
+			mountInfo += mountLine(otherStagingPath, "/pvc-2") + mountLine(otherRecordDir, "/.quotas/pvc-2")
+
+			scanned = make(chan struct{})
+			go func() {
+				defer close(scanned)
+				scanner.Scan()
+			}()
+			Eventually(hungScans).Should(Equal(1))
+		})
+
+		AfterEach(func() {
+			close(unblock)
+			Eventually(scanned).Should(BeClosed())
+			Expect(os.RemoveAll(otherStagingPath)).To(Succeed())
+		})
+
+		It("should measure the other volumes", func() {
+			Eventually(func() int64 {
+				resp, err := nodeServer.NodeGetVolumeStats(ctx, otherRequest)
+				Expect(err).NotTo(HaveOccurred())
+				return resp.GetUsage()[0].GetTotal()
+			}).Should(Equal(int64(500)))
+			Expect(scanned).NotTo(BeClosed())
+		})
+
+		It("should skip the volume until its scan returns", func() {
+			scanner.Scan()
+			Expect(hungScans()).To(Equal(1))
+			Expect(logger).To(Say("skipped-volume-still-scanning"))
+		})
+	})
+
+	Context("when the volume has no quota", func() {
+		BeforeEach(func() {
+			delete(stageRequest.VolumeContext, "quotaDir")
+			quotaMounted = false
+		})
+
+		JustBeforeEach(func() {
+			getVolumeStats()
+			scanner.Scan()
+		})
+
+		It("should not mount a quota directory", func() {
+			Expect(fakeExec.CommandContextCallCount()).To(Equal(1))
+		})
+
+		It("should report the usage of the share", func() {
+			resp := getVolumeStats()
+			Expect(resp.GetUsage()[0]).To(Equal(&csi.VolumeUsage{Unit: csi.VolumeUsage_BYTES, Total: 10000, Available: 3000, Used: 6000}))
+		})
+	})
+
+	Context("when the quota directory cannot be mounted", func() {
+		BeforeEach(func() {
+			quotaMounted = false
+			fakeExec.CommandContextStub = func(_ context.Context, _ string, args ...string) execshim.Cmd {
+				cmd := &exec_fake.FakeCmd{}
+				if args[len(args)-2] == "//server/export/.quotas/pvc-1" {
+					cmd.CombinedOutputReturns([]byte("mount error(13): Permission denied"), errors.New("exit status 32"))
+				}
+				return cmd
+			}
+		})
+
+		It("should stage the volume anyway and log the failure", func() {
+			Expect(logger).To(Say("mount-quota-failed"))
+			resp := getVolumeStats()
+			Expect(resp.GetUsage()[0].GetTotal()).To(Equal(int64(10000)))
+		})
+	})
+
+	Context("when the quota cannot be read", func() {
+		JustBeforeEach(func() {
+			writeQuota("not json")
+			getVolumeStats()
+			scanner.Scan()
+		})
+
+		It("should log the failure and report the usage of the share", func() {
+			Expect(logger).To(Say("scan-failed"))
+			resp := getVolumeStats()
+			Expect(resp.GetUsage()[0].GetTotal()).To(Equal(int64(10000)))
+		})
+	})
+})
@@ -0,0 +1,137 @@
+package nodeserver
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager"
+)
+
+const csiPodVolumesDir = "volumes/kubernetes.io~csi"
+
+type volumeData struct {
+	DriverName   string `json:"driverName"`
+	VolumeHandle string `json:"volumeHandle"`
+}
+
+// Reconcile rebuilds the publish state of the driver after a restart. Every CIFS mount that kubelet created for
+// driverName under podsDir is seeded into the store. Target directories that are no longer mounted are removed when
+// their pod no longer exists, i.e. when nothing under its pod directory is mounted anymore; those of pods that still
+// have mounts are only logged, as kubelet may be about to publish them again. Target paths in the store that are no
+// longer mounted, e.g. those a file store remembers from before a reboot, are dropped from it, so that publishing them
+// again mounts them again.
+func Reconcile(logger lager.Logger, ioutilshim ioutilshim.Ioutil, osshim osshim.Os, store CSIDriverStore, podsDir string, driverName string) error {
+	logger = logger.Session("reconcile", lager.Data{"podsDir": podsDir})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	data, err := ioutilshim.ReadFile(mountInfoPath)
+	if err != nil {
+		return err
+	}
+	mounts := parseMountInfo(data)
+
+	for _, targetPath := range store.TargetPaths() {
+		if target, ok := findMount(mounts, targetPath); ok && target.fsType == "cifs" {
+			continue
+		}
+		store.Delete(targetPath)
+		logger.Info("dropped-unmounted-target-path", lager.Data{"targetPath": targetPath})
+	}
+
+	pods, err := ioutilshim.ReadDir(podsDir)
+	if err != nil {
+		return err
+	}
+
+	for _, pod := range pods {
+		volumesDir := filepath.Join(podsDir, pod.Name(), csiPodVolumesDir)
+		volumes, err := ioutilshim.ReadDir(volumesDir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			logger.Error("read-volumes-dir-failed", err, lager.Data{"volumesDir": volumesDir})
+			continue
+		}
+
+		for _, volume := range volumes {
+			volumeDir := filepath.Join(volumesDir, volume.Name())
+			contents, err := ioutilshim.ReadFile(filepath.Join(volumeDir, "vol_data.json"))
+			if err != nil {
+				logger.Error("read-volume-data-failed", err, lager.Data{"volumeDir": volumeDir})
+				continue
+			}
+
+			var volData volumeData
+			err = json.Unmarshal(contents, &volData)
+			if err != nil {
+				logger.Error("parse-volume-data-failed", err, lager.Data{"volumeDir": volumeDir})
+				continue
+			}
+			if volData.DriverName != driverName {
+				continue
+			}
+
+			targetPath := filepath.Join(volumeDir, "mount")
+			logData := lager.Data{"volumeId": volData.VolumeHandle, "targetPath": targetPath}
+
+			if target, ok := findMount(mounts, targetPath); ok && target.fsType == "cifs" {
+				stagingTargetPath := findStagingTargetPath(mounts, target, podsDir, volume.Name())
+				store.Seed(targetPath, stagingTargetPath)
+				logger.Info("recovered-volume", lager.Data{"volumeId": volData.VolumeHandle, "targetPath": targetPath, "stagingTargetPath": stagingTargetPath})
+				continue
+			}
+
+			if podHasMounts(mounts, filepath.Join(podsDir, pod.Name())) {
+				logger.Info("unmounted-target-path", logData)
+				continue
+			}
+
+			err = osshim.Remove(targetPath)
+			if err != nil && !os.IsNotExist(err) {
+				logger.Error("orphaned-target-path", err, logData)
+				continue
+			}
+			if err == nil {
+				logger.Info("removed-orphaned-target-path", logData)
+			}
+		}
+	}
+	return nil
+}
+
+// podHasMounts reports whether anything under podDir is mounted. Kubelet unmounts every volume of a pod before it
+// removes the pod, so a pod directory without mounts belongs to a pod that no longer exists.
+func podHasMounts(mounts []mountInfo, podDir string) bool {
+	for _, m := range mounts {
+		if strings.HasPrefix(m.mountPoint, podDir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// findStagingTargetPath looks for the mount a target path was bind mounted from. Bind mounts share the device and
+// root of their source; when the same share is staged more than once, only a staging path naming the volume is
+// trusted, and an empty staging path is returned rather than guessing between the others.
+func findStagingTargetPath(mounts []mountInfo, target mountInfo, podsDir string, volumeName string) string {
+	var candidates []string
+	for _, m := range mounts {
+		if m.device != target.device || m.root != target.root || strings.HasPrefix(m.mountPoint, podsDir+"/") {
+			continue
+		}
+		if strings.Contains(m.mountPoint, "/"+volumeName+"/") {
+			return m.mountPoint
+		}
+		candidates = append(candidates, m.mountPoint)
+	}
+	if len(candidates) != 1 {
+		return ""
+	}
+	return candidates[0]
+}
@@ -0,0 +1,242 @@
+package nodeserver_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "code.cloudfoundry.org/smb-csi-driver/nodeserver"
+	smbcsidriverfakes "code.cloudfoundry.org/smb-csi-driver/smb-csi-driverfakes"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("Reconcile", func() {
+	var (
+		logger             *lagertest.TestLogger
+		fakeIoutil         *ioutil_fake.FakeIoutil
+		fakeCSIDriverStore *smbcsidriverfakes.FakeCSIDriverStore
+		podsDir            string
+		mountInfo          string
+		err                error
+	)
+
+	createVolumeDir := func(podUID string, volumeName string, driverName string) string {
+		volumeDir := filepath.Join(podsDir, podUID, "volumes", "kubernetes.io~csi", volumeName)
+		Expect(os.MkdirAll(filepath.Join(volumeDir, "mount"), os.ModePerm)).To(Succeed())
+		volData := fmt.Sprintf(`{"driverName":"%s","volumeHandle":"%s-handle"}`, driverName, volumeName)
+		Expect(ioutil.WriteFile(filepath.Join(volumeDir, "vol_data.json"), []byte(volData), 0644)).To(Succeed())
+		return filepath.Join(volumeDir, "mount")
+	}
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("reconcile-test")
+		fakeCSIDriverStore = &smbcsidriverfakes.FakeCSIDriverStore{}
+		podsDir, err = ioutil.TempDir("", "pods")
+		Expect(err).NotTo(HaveOccurred())
+		mountInfo = ""
+
+		fakeIoutil = &ioutil_fake.FakeIoutil{}
+		fakeIoutil.ReadFileStub = func(path string) ([]byte, error) {
+			if path == "/proc/self/mountinfo" {
+				return []byte(mountInfo), nil
+			}
+			return ioutil.ReadFile(path)
+		}
+		fakeIoutil.ReadDirStub = ioutil.ReadDir
+	})
+
+	JustBeforeEach(func() {
+		err = Reconcile(logger, fakeIoutil, &osshim.OsShim{}, fakeCSIDriverStore, podsDir, "org.cloudfoundry.smb")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(podsDir)).To(Succeed())
+	})
+
+	Context("when a target path of this driver is mounted", func() {
+		var targetPath string
+
+		BeforeEach(func() {
+			targetPath = createVolumeDir("pod-1", "pv-1", "org.cloudfoundry.smb")
+			mountInfo = fmt.Sprintf("120 25 0:52 / /var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-1/globalmount rw,relatime shared:70 - cifs //server/export rw\n"+
+				"130 25 0:52 / %s rw,relatime shared:70 - cifs //server/export rw\n", targetPath)
+		})
+
+		It("should seed the store with the target and staging paths", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeCSIDriverStore.SeedCallCount()).To(Equal(1))
+			seededTargetPath, stagingTargetPath := fakeCSIDriverStore.SeedArgsForCall(0)
+			Expect(seededTargetPath).To(Equal(targetPath))
+			Expect(stagingTargetPath).To(Equal("/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv-1/globalmount"))
+			Expect(logger.Buffer()).To(Say("recovered-volume"))
+		})
+
+		It("should leave the target path in place", func() {
+			Expect(targetPath).To(BeADirectory())
+		})
+
+		Context("when the share is staged more than once and no staging path names the volume", func() {
+			BeforeEach(func() {
+				mountInfo = fmt.Sprintf("120 25 0:52 / /var/lib/kubelet/plugins/kubernetes.io/csi/pv/0a1b/globalmount rw,relatime shared:70 - cifs //server/export rw\n"+
+					"121 25 0:52 / /var/lib/kubelet/plugins/kubernetes.io/csi/pv/2c3d/globalmount rw,relatime shared:70 - cifs //server/export rw\n"+
+					"130 25 0:52 / %s rw,relatime shared:70 - cifs //server/export rw\n", targetPath)
+			})
+
+			It("should seed the store without a staging path", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeCSIDriverStore.SeedCallCount()).To(Equal(1))
+				seededTargetPath, stagingTargetPath := fakeCSIDriverStore.SeedArgsForCall(0)
+				Expect(seededTargetPath).To(Equal(targetPath))
+				Expect(stagingTargetPath).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("when a target path of another driver is mounted", func() {
+		var targetPath string
+
+		BeforeEach(func() {
+			targetPath = createVolumeDir("pod-1", "pv-1", "org.example.nfs")
+			mountInfo = fmt.Sprintf("130 25 0:52 / %s rw,relatime shared:70 - nfs server:/export rw\n", targetPath)
+		})
+
+		It("should ignore it", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeCSIDriverStore.SeedCallCount()).To(BeZero())
+			Expect(targetPath).To(BeADirectory())
+		})
+	})
+
+	Context("when a target path of this driver is no longer mounted", func() {
+		var targetPath string
+
+		BeforeEach(func() {
+			targetPath = createVolumeDir("pod-1", "pv-1", "org.cloudfoundry.smb")
+		})
+
+		It("should remove the orphaned target directory of the pod that no longer exists", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeCSIDriverStore.SeedCallCount()).To(BeZero())
+			Expect(targetPath).NotTo(BeAnExistingFile())
+			Expect(logger.Buffer()).To(Say("removed-orphaned-target-path"))
+		})
+
+		Context("when the pod still has other volumes mounted", func() {
+			BeforeEach(func() {
+				mountInfo = fmt.Sprintf("140 25 0:60 / %s rw,relatime - tmpfs tmpfs rw\n", filepath.Join(podsDir, "pod-1", "volumes", "kubernetes.io~projected", "token"))
+			})
+
+			It("should leave the target directory in place and log it", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeCSIDriverStore.SeedCallCount()).To(BeZero())
+				Expect(targetPath).To(BeADirectory())
+				Expect(logger.Buffer()).To(Say("unmounted-target-path"))
+			})
+		})
+
+		Context("when the orphaned target directory is not empty", func() {
+			BeforeEach(func() {
+				Expect(ioutil.WriteFile(filepath.Join(targetPath, "data"), []byte("data"), 0644)).To(Succeed())
+			})
+
+			It("should leave it in place and log it", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Join(targetPath, "data")).To(BeARegularFile())
+				Expect(logger.Buffer()).To(Say("orphaned-target-path"))
+			})
+		})
+	})
+
+	Context("when the mount table cannot be read", func() {
+		BeforeEach(func() {
+			fakeIoutil.ReadFileStub = nil
+			fakeIoutil.ReadFileReturns(nil, errors.New("read-failed"))
+		})
+
+		It("should return an error", func() {
+			Expect(err).To(MatchError("read-failed"))
+		})
+	})
+
+	Context("when the store remembers target paths from before a reboot", func() {
+		var (
+			stateDir      string
+			store         CSIDriverStore
+			request       *csi.NodePublishVolumeRequest
+			mountedTarget string
+			missingTarget string
+			orphanTarget  string
+		)
+
+		BeforeEach(func() {
+			stateDir, err = ioutil.TempDir("", "file-store")
+			Expect(err).NotTo(HaveOccurred())
+			fileStore, err := NewFileStore(logger, filepath.Join(stateDir, "volumes.json"))
+			Expect(err).NotTo(HaveOccurred())
+
+			mountedTarget = createVolumeDir("pod-1", "pv-1", "org.cloudfoundry.smb")
+			orphanTarget = createVolumeDir("pod-2", "pv-2", "org.cloudfoundry.smb")
+			missingTarget = filepath.Join(podsDir, "pod-3", "volumes", "kubernetes.io~csi", "pv-3", "mount")
+			mountInfo = "130 25 0:52 / " + mountedTarget + " rw,relatime shared:70 - cifs //server/export rw,vers=3.0\n"
+
+			request = &csi.NodePublishVolumeRequest{VolumeContext: map[string]string{"share": "//server/export"}}
+			for _, targetPath := range []string{mountedTarget, orphanTarget, missingTarget} {
+				Expect(fileStore.Create(targetPath, request)).To(Succeed())
+			}
+
+			store, err = NewFileStore(logger, filepath.Join(stateDir, "volumes.json"))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		JustBeforeEach(func() {
+			err = Reconcile(logger, fakeIoutil, &osshim.OsShim{}, store, podsDir, "org.cloudfoundry.smb")
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(stateDir)).To(Succeed())
+		})
+
+		It("should only keep the target paths that are still mounted", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(store.TargetPaths()).To(ConsistOf(mountedTarget))
+			Expect(logger).To(Say("dropped-unmounted-target-path"))
+		})
+
+		It("should forget the dropped target paths after a restart", func() {
+			restarted, err := NewFileStore(logger, filepath.Join(stateDir, "volumes.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restarted.TargetPaths()).To(ConsistOf(mountedTarget))
+
+			exists, _, err := restarted.Get(orphanTarget, request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+		})
+	})
+
+	Context("when a recovered volume is published again", func() {
+		It("should accept the options of the first publish and remember them", func() {
+			store := NewStore()
+			store.Seed("/tmp/target_path", "/tmp/staging_path")
+
+			request := &csi.NodePublishVolumeRequest{VolumeContext: map[string]string{"share": "//server/export"}}
+			exists, optionsMatch, err := store.Get("/tmp/target_path", request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeTrue())
+			Expect(optionsMatch).To(BeTrue())
+
+			request.VolumeContext["share"] = "//server/other"
+			_, optionsMatch, err = store.Get("/tmp/target_path", request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(optionsMatch).To(BeFalse())
+			Expect(store.PublishedTargetPaths("/tmp/staging_path")).To(ConsistOf("/tmp/target_path"))
+		})
+	})
+})
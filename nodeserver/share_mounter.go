@@ -0,0 +1,61 @@
+package nodeserver
+
+import (
+	"context"
+	"os"
+
+	"code.cloudfoundry.org/goshims/execshim"
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ShareMounter mounts whole shares in private directories, with the same options, credentials and unmount policy as
+// the node server. The controller service provisions volumes in the shares it mounts.
+type ShareMounter struct {
+	server  smbNodeServer
+	workDir string
+}
+
+func NewShareMounter(logger lager.Logger, execshim execshim.Exec, osshim osshim.Os, ioutilshim ioutilshim.Ioutil, config Config, workDir string) *ShareMounter {
+	return &ShareMounter{
+		server:  smbNodeServer{logger: logger, execshim: execshim, osshim: osshim, ioutilshim: ioutilshim, config: config.withDefaults()},
+		workDir: workDir,
+	}
+}
+
+// Mount mounts the share of volumeContext in a new directory under the work dir and returns that directory.
+func (m *ShareMounter) Mount(c context.Context, volumeContext map[string]string, mountFlags []string, secrets map[string]string) (string, error) {
+	dir, err := m.server.ioutilshim.TempDir(m.workDir, "share")
+	if err != nil {
+		m.server.logger.Error("create-mount-dir-failed", err, lager.Data{"workDir": m.workDir})
+		return "", status.Error(codes.Internal, err.Error())
+	}
+
+	err = m.server.mountCifs(c, dir, mountFlags, volumeContext, secrets, false)
+	if err != nil {
+		if removeErr := m.server.osshim.Remove(dir); removeErr != nil {
+			m.server.logger.Error("remove-mount-dir-failed", removeErr, lager.Data{"dir": dir})
+		}
+		return "", err
+	}
+	return dir, nil
+}
+
+// Unmount unmounts a directory returned by Mount and removes it.
+func (m *ShareMounter) Unmount(c context.Context, dir string) error {
+	err := m.server.unmount(c, dir)
+	if err != nil {
+		return err
+	}
+	m.server.removeKerberosCache(dir)
+
+	err = m.server.osshim.Remove(dir)
+	if err != nil && !os.IsNotExist(err) {
+		m.server.logger.Error("remove-mount-dir-failed", err, lager.Data{"dir": dir})
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package nodeserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type UnmountStep string
+
+const (
+	// UnmountNormal runs umount, which refuses to unmount a busy mount.
+	UnmountNormal UnmountStep = "normal"
+	// UnmountForce runs umount -f, which aborts the requests pending on an unresponsive server. CIFS aborts them for
+	// the whole superblock before it checks whether the mount is busy, so the step is skipped for a mount that shares
+	// its superblock with another one, such as a target path bind mounted from a staging mount; it would abort the
+	// requests of every other pod using the volume.
+	UnmountForce UnmountStep = "force"
+	// UnmountLazy runs umount -l, which detaches the mount at once and only cleans it up when it is no longer busy.
+	// Writes that are still pending at that point can fail without anybody noticing.
+	UnmountLazy UnmountStep = "lazy"
+)
+
+const DefaultUnmountTimeout = 20 * time.Second
+
+func DefaultUnmountPolicy() []UnmountStep {
+	return []UnmountStep{UnmountNormal, UnmountForce, UnmountLazy}
+}
+
+// ParseUnmountPolicy parses a comma separated list of unmount steps, e.g. "normal,force,lazy".
+func ParseUnmountPolicy(spec string) ([]UnmountStep, error) {
+	policy := []UnmountStep{}
+	for _, s := range strings.Split(spec, ",") {
+		step := UnmountStep(strings.TrimSpace(s))
+		switch step {
+		case UnmountNormal, UnmountForce, UnmountLazy:
+			policy = append(policy, step)
+		default:
+			return nil, fmt.Errorf("unknown unmount step '%s', expected one of [normal, force, lazy]", step)
+		}
+	}
+	return policy, nil
+}
+
+func (s UnmountStep) flags() []string {
+	switch s {
+	case UnmountForce:
+		return []string{"-f"}
+	case UnmountLazy:
+		return []string{"-l"}
+	}
+	return nil
+}
+
+// unmount runs the steps of the unmount policy in turn until one of them unmounts path. Every step is bounded by the
+// unmount timeout; a step that fails or times out escalates to the next one, unless the request itself is over. A
+// forced unmount is left out for mounts that share their superblock with another mount.
+func (n smbNodeServer) unmount(c context.Context, path string) error {
+	failures := []string{}
+	for i, step := range n.config.UnmountPolicy {
+		logData := lager.Data{"path": path, "step": step}
+		if i > 0 {
+			_, mounted, err := n.mountAt(path)
+			if err == nil && !mounted {
+				n.logger.Info("unmounted-by-previous-step", logData)
+				return nil
+			}
+			n.logger.Info("escalating-umount", logData)
+		}
+		if step == UnmountForce && n.sharesSuperblock(path) {
+			n.logger.Info("skipping-forced-umount-of-shared-superblock", logData)
+			continue
+		}
+
+		err := n.unmountStep(c, path, step, logData)
+		if err == nil {
+			return nil
+		}
+		failures = append(failures, err.Error())
+		if c.Err() != nil {
+			return commandError(c, "umount", errors.New(strings.Join(failures, "; ")))
+		}
+	}
+	return status.Error(codes.Internal, fmt.Sprintf("Error: could not unmount %s: %s", path, strings.Join(failures, "; ")))
+}
+
+func (n smbNodeServer) unmountStep(c context.Context, path string, step UnmountStep, logData lager.Data) error {
+	ctx, cancel := context.WithTimeout(c, n.config.UnmountTimeout)
+	defer cancel()
+
+	command := strings.Join(append([]string{"umount"}, step.flags()...), " ")
+	cmdshim := n.execshim.CommandContext(ctx, "umount", append(step.flags(), path)...)
+	stderr := &bytes.Buffer{}
+	cmdshim.SetStderr(stderr)
+
+	err := cmdshim.Start()
+	if err == nil {
+		n.logger.Info("started umount", logData)
+		err = cmdshim.Wait()
+	}
+	if err == nil {
+		n.logger.Info("finished umount", logData)
+		return nil
+	}
+
+	if ctx.Err() == context.DeadlineExceeded && c.Err() == nil {
+		err = fmt.Errorf("did not complete within %s", n.config.UnmountTimeout)
+	}
+	n.logger.Error("umount-failed", err, lager.Data{"path": path, "step": step, "stderr": stderr.String()})
+	if output := strings.TrimSpace(stderr.String()); output != "" {
+		return fmt.Errorf("%s: %s (%s)", command, err.Error(), output)
+	}
+	return fmt.Errorf("%s: %s", command, err.Error())
+}
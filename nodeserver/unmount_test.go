@@ -0,0 +1,26 @@
+package nodeserver_test
+
+import (
+	. "code.cloudfoundry.org/smb-csi-driver/nodeserver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseUnmountPolicy", func() {
+	It("should parse the unmount steps in order", func() {
+		policy, err := ParseUnmountPolicy("normal, lazy")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy).To(Equal([]UnmountStep{UnmountNormal, UnmountLazy}))
+	})
+
+	It("should parse the default policy", func() {
+		policy, err := ParseUnmountPolicy("normal,force,lazy")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy).To(Equal(DefaultUnmountPolicy()))
+	})
+
+	It("should refuse unknown steps", func() {
+		_, err := ParseUnmountPolicy("normal,detach")
+		Expect(err).To(MatchError("unknown unmount step 'detach', expected one of [normal, force, lazy]"))
+	})
+})